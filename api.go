@@ -1,6 +1,8 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
 	"github.com/gophergala2016/dbserver/plugins"
 	"net/http"
 	"os"
@@ -13,6 +15,11 @@ type Api struct {
 	Routes             []*Route
 	Plugins            map[string]Plugin
 	PluginsList        []string
+	JobQueue           *JobQueue
+	Schedule           *Schedule
+	Debug              bool
+	MaxBodySize        int64
+	Storage            Storage
 }
 
 func (self *Api) IsDeprecated(version int) bool {
@@ -24,11 +31,28 @@ func (self *Api) IsDeprecated(version int) bool {
 	return false
 }
 
-func (self *Api) RegisterPlugin(name string, plugin Plugin) {
+func (self *Api) GetRoute(name string) *Route {
+	for _, route := range self.Routes {
+		if route.Name == name {
+			return route
+		}
+	}
+	return nil
+}
+
+func (self *Api) RegisterPlugin(name string, plugin Plugin) error {
 	if _, err := os.Stat("plugins/" + name + ".toml"); err != nil {
-		return
+		return nil
 	}
-	plugin.ParseConfig("plugins/" + name + ".toml")
+	err := plugin.ParseConfig("plugins/" + name + ".toml")
+	if err != nil {
+		return err
+	}
+	self.AddPlugin(name, plugin)
+	return nil
+}
+
+func (self *Api) AddPlugin(name string, plugin Plugin) {
 	self.Plugins[name] = plugin
 	self.PluginsList = append(self.PluginsList, name)
 }
@@ -41,8 +65,59 @@ func (self *Api) GetPlugins() []string {
 	return self.PluginsList
 }
 
+func (self *Api) SetDb(db *sql.DB) {
+	for _, name := range self.PluginsList {
+		if plugin, ok := self.Plugins[name].(DbPlugin); ok {
+			plugin.SetDb(db)
+		}
+	}
+}
+
+// ValidatePipelines checks arguments of route pipelines.
+func (self *Api) ValidatePipelines() error {
+	for _, route := range self.Routes {
+		for _, pp := range route.PluginPipelines {
+			plugin, ok := self.Plugins[pp.Name].(ArgumentPlugin)
+			if !ok {
+				continue
+			}
+			err := plugin.ValidateArgument(pp.Argument)
+			if err != nil {
+				return fmt.Errorf("%v route, %v plugin: %v", route.Name, pp.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
 type Plugin interface {
 	ParseConfig(path string) error
 	Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response
 	ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response
 }
+
+type SessionPlugin interface {
+	Session(data map[string]interface{}) (*plugins.Session, error)
+}
+
+type DbPlugin interface {
+	SetDb(db *sql.DB)
+}
+
+type RouteHookPlugin interface {
+	ProcessRouteHook(route string, data map[string]interface{}, arg map[string]interface{}, r *http.Request) *plugins.Response
+}
+
+type PreflightPlugin interface {
+	ProcessPreflight(arg map[string]interface{}, methods []string, r *http.Request) *plugins.Response
+}
+
+// ArgumentPlugin validates pipeline arguments when api is loaded, so that
+// invalid ones fail on startup instead of every request.
+type ArgumentPlugin interface {
+	ValidateArgument(arg map[string]interface{}) error
+}
+
+type RenderPlugin interface {
+	Render(route string, data map[string]interface{}, jsonValue string, r *http.Request) *plugins.Response
+}
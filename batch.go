@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gophergala2016/dbserver/plugins"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxBatchSize = 50
+
+// batchRoute labels metrics and spans of batch requests.
+var batchRoute = &Route{Name: "_batch", Path: "/_batch"}
+
+type BatchRequest struct {
+	Transaction bool         `json:"transaction"`
+	Requests    []*BatchItem `json:"requests"`
+}
+
+type BatchItem struct {
+	Route  string                 `json:"route"`
+	Params map[string]interface{} `json:"params"`
+}
+
+type BatchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+	sql    string
+	data   map[string]interface{}
+	route  *Route
+	value  string
+}
+
+func batchBody(body string) json.RawMessage {
+	if body == "" {
+		return json.RawMessage("null")
+	}
+	if json.Valid([]byte(body)) {
+		return json.RawMessage(body)
+	}
+	content, _ := json.Marshal(body)
+	return json.RawMessage(content)
+}
+
+func (self *BatchResult) fail(status int, body string) {
+	self.Status = status
+	self.Body = batchBody(body)
+}
+
+// batchHooks run before hooks once for the whole batch and route hooks once
+// for every route in it, so that e.g. batch takes single rate limit token per
+// route instead of one per item.
+type batchHooks struct {
+	data     map[string]interface{}
+	response *plugins.Response
+	routes   map[string]*plugins.Response
+}
+
+func newBatchHooks(api *Api, r *http.Request, header http.Header) *batchHooks {
+	hooks := &batchHooks{
+		data:   map[string]interface{}{"params": make(map[string]interface{})},
+		routes: make(map[string]*plugins.Response),
+	}
+	hooks.response = processBeforeHooks(api, hooks.data, r, header)
+	return hooks
+}
+
+// process adds results of before hooks (jwt claims, api key, ...) to item
+// data and returns response of hook that stopped the item.
+func (self *batchHooks) process(api *Api, route *Route, data map[string]interface{}, r *http.Request, header http.Header) *plugins.Response {
+	if self.response != nil {
+		return self.response
+	}
+	for key, value := range self.data {
+		if key != "params" {
+			data[key] = value
+		}
+	}
+	response, ok := self.routes[route.Name]
+	if !ok {
+		response = processRouteHooks(api, route, data, r, header)
+		self.routes[route.Name] = response
+	}
+	return response
+}
+
+// prepareBatchItem runs plugin hooks and generates sql for batch item. Result status
+// is set if item can't be executed.
+func prepareBatchItem(api *Api, hooks *batchHooks, item *BatchItem, version int, r *http.Request, header http.Header) *BatchResult {
+	result := &BatchResult{route: api.GetRoute(item.Route)}
+	if result.route == nil || result.route.Stream != nil {
+		result.fail(http.StatusNotFound, fmt.Sprintf("Unknown route: %v", item.Route))
+		return result
+	}
+	params := item.Params
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	result.data = map[string]interface{}{"params": params}
+	response := hooks.process(api, result.route, result.data, r, header)
+	if response != nil {
+		result.fail(response.ResponseCode, response.Error)
+		return result
+	}
+	var err error
+	result.sql, err = result.route.SqlContext(r.Context(), result.data, version)
+	if err != nil && result.sql != "" {
+		result.fail(http.StatusBadRequest, result.sql)
+		return result
+	}
+	if err != nil {
+		log.Println(err)
+		result.fail(http.StatusInternalServerError, "")
+	}
+	return result
+}
+
+func (self *BatchResult) setValue(value sql.NullString, found bool) {
+	self.Status = http.StatusOK
+	if !found {
+		return
+	}
+	if value.Valid {
+		self.value = value.String
+	} else if self.route.Collection {
+		self.value = "[]"
+	} else {
+		self.fail(http.StatusNotFound, "")
+	}
+}
+
+func executeBatchItem(ctx context.Context, api *Api, result *BatchResult) error {
+	sessions, err := getSessions(api, result.data)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	value, found, err := ExecuteSqlContext(ctx, db, result.sql, sessions, routeJobs(api, result.route))
+	queryDuration.Observe(time.Since(start).Seconds(), result.route.Name)
+	if err != nil {
+		return err
+	}
+	result.setValue(value, found)
+	return nil
+}
+
+// executeBatchTransaction executes all items in single transaction. If one
+// of them fails, nothing is committed.
+func executeBatchTransaction(ctx context.Context, api *Api, results []*BatchResult) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+	for i, result := range results {
+		sessions, err := getSessions(api, result.data)
+		if err != nil {
+			return i, err
+		}
+		start := time.Now()
+		value, found, err := queryTx(ctx, tx, result.sql, sessions)
+		queryDuration.Observe(time.Since(start).Seconds(), result.route.Name)
+		if err != nil {
+			return i, err
+		}
+		if hook := routeJobs(api, result.route); hook != nil && value.Valid {
+			value.String, err = hook(tx, value.String)
+			if err != nil {
+				return i, err
+			}
+		}
+		result.setValue(value, found)
+		if result.Status != http.StatusOK {
+			return i, nil
+		}
+	}
+	return -1, tx.Commit()
+}
+
+// queryTx runs query of batch transaction in span of request from context.
+func queryTx(ctx context.Context, tx *sql.Tx, query string, sessions []*plugins.Session) (sql.NullString, bool, error) {
+	_, span := startSpan(ctx, "db.query", spanKindClient)
+	defer span.End()
+	query, sessions = traceSql(span, query, sessions)
+	for _, session := range sessions {
+		err := applySession(tx, session)
+		if err != nil {
+			span.SetError(err)
+			return sql.NullString{}, false, err
+		}
+	}
+	value, found, err := queryJson(tx, query)
+	span.SetError(err)
+	return value, found, err
+}
+
+func finishBatchItem(ctx context.Context, api *Api, result *BatchResult, header http.Header) error {
+	pipelines := responsePipelines(api, result.route.PluginPipelines)
+	if len(pipelines) > 0 && result.value != "" {
+		value, response, err := runPipelines(ctx, api, result.value, pipelines, header)
+		if err != nil {
+			return err
+		}
+		if response != nil {
+			result.fail(response.ResponseCode, response.Error)
+			return nil
+		}
+		result.value = value
+	}
+	result.Body = batchBody(result.value)
+	return nil
+}
+
+func batchHandler(api *Api) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		version := api.Version
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		w = recorder
+		r, span := startRequestSpan(r, batchRoute, 0)
+		defer func() {
+			observeRequest(batchRoute, version, recorder, start)
+			endRequestSpan(span, version, recorder)
+		}()
+		limitBody(api, w, r)
+		batch := &BatchRequest{}
+		err := json.NewDecoder(r.Body).Decode(batch)
+		if err == nil && len(batch.Requests) > maxBatchSize {
+			err = fmt.Errorf("Batch can have at most %v requests", maxBatchSize)
+		}
+		if err == nil && len(batch.Requests) == 0 {
+			err = errors.New("Batch has no requests")
+		}
+		if err != nil {
+			w.WriteHeader(bodyErrorStatus(err))
+			fmt.Fprint(w, err.Error())
+			return
+		}
+		if headerVersion := r.Header.Get("api-version"); headerVersion != "" {
+			version, err = strconv.Atoi(headerVersion)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		results := make([]*BatchResult, len(batch.Requests))
+		failed := -1
+		hooks := newBatchHooks(api, r, w.Header())
+		for i, item := range batch.Requests {
+			results[i] = prepareBatchItem(api, hooks, item, version, r, w.Header())
+			if results[i].Status != 0 && failed == -1 {
+				failed = i
+			}
+		}
+		if batch.Transaction && failed == -1 {
+			failed, err = executeBatchTransaction(r.Context(), api, results)
+			if err != nil && failed == -1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			if err != nil {
+				log.Println(results[failed].sql)
+				log.Println(err)
+				results[failed].fail(http.StatusInternalServerError, "")
+			}
+		}
+		for _, result := range results {
+			if batch.Transaction && failed != -1 {
+				// Nothing has been committed.
+				if result.Status == 0 || result.Status == http.StatusOK {
+					result.fail(http.StatusFailedDependency, "")
+				}
+				continue
+			}
+			if result.Status != 0 && result.Status != http.StatusOK {
+				continue
+			}
+			if !batch.Transaction {
+				err = executeBatchItem(r.Context(), api, result)
+				if err != nil {
+					log.Println(result.sql)
+					log.Println(err)
+					result.fail(http.StatusInternalServerError, "")
+					continue
+				}
+				if result.Status != http.StatusOK {
+					continue
+				}
+			}
+			err = finishBatchItem(r.Context(), api, result, w.Header())
+			if err != nil {
+				log.Println(err)
+				result.fail(http.StatusInternalServerError, "")
+			}
+		}
+		content, err := json.Marshal(results)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(content))
+	}
+}
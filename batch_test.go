@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gophergala2016/dbserver/plugins"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type denyPlugin struct{}
+
+func (self *denyPlugin) ParseConfig(path string) error {
+	return nil
+}
+
+func (self *denyPlugin) Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response {
+	return &plugins.Response{Data: data}
+}
+
+func (self *denyPlugin) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	if r.Header.Get("Authorization") != "" {
+		return nil
+	}
+	return &plugins.Response{ResponseCode: http.StatusUnauthorized, Error: "Unauthorized"}
+}
+
+type countPlugin struct {
+	denyPlugin
+	calls int
+}
+
+func (self *countPlugin) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	return nil
+}
+
+func (self *countPlugin) ProcessRouteHook(route string, data map[string]interface{}, arg map[string]interface{}, r *http.Request) *plugins.Response {
+	self.calls++
+	return nil
+}
+
+func batchResults(t *testing.T, api *Api, body string, authorized bool) (int, []map[string]interface{}) {
+	r := httptest.NewRequest("POST", "/_batch", strings.NewReader(body))
+	if authorized {
+		r.Header.Set("Authorization", "Bearer token")
+	}
+	w := httptest.NewRecorder()
+	batchHandler(api)(w, r, nil)
+	results := make([]map[string]interface{}, 0)
+	if w.Code == http.StatusOK {
+		err := json.Unmarshal(w.Body.Bytes(), &results)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	return w.Code, results
+}
+
+func TestPrepareBatchItem(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	r := httptest.NewRequest("POST", "/_batch", nil)
+	hooks := newBatchHooks(api, r, make(http.Header))
+	result := prepareBatchItem(api, hooks, &BatchItem{Route: "missing"}, api.Version, r, make(http.Header))
+	if result.Status != http.StatusNotFound {
+		t.Errorf("Expected to get 404 status code for unknown route, but got %v", result.Status)
+	}
+	result = prepareBatchItem(api, hooks, &BatchItem{Route: "create_user", Params: map[string]interface{}{"name": "John"}}, api.Version, r, make(http.Header))
+	if result.Status != http.StatusBadRequest || !strings.Contains(string(result.Body), "email") {
+		t.Errorf("Expected to get validation errors, but got %v %s", result.Status, result.Body)
+	}
+	result = prepareBatchItem(api, hooks, &BatchItem{Route: "get_users"}, api.Version, r, make(http.Header))
+	if result.Status != 0 || !strings.Contains(result.sql, "array_to_json") {
+		t.Errorf("Expected to get sql for get_users, but got %v %v", result.Status, result.sql)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	api.AddPlugin("deny", &denyPlugin{})
+	code, _ := batchResults(t, api, `{"requests": []}`, true)
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected to get 400 status code for empty batch, but got %v", code)
+	}
+	code, _ = batchResults(t, api, `{"requests": [`+strings.Repeat(`{"route": "get_users"},`, maxBatchSize)+`{"route": "get_users"}]}`, true)
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected to get 400 status code for too large batch, but got %v", code)
+	}
+	body := `{"transaction": true, "requests": [{"route": "get_users"}, {"route": "create_user", "params": {"name": "John"}}]}`
+	code, results := batchResults(t, api, body, true)
+	if code != http.StatusOK || len(results) != 2 {
+		t.Fatalf("Expected to get 2 results, but got %v %v", code, results)
+	}
+	if results[0]["status"] != float64(http.StatusFailedDependency) {
+		t.Errorf("Expected first item not to be executed, but got %v", results[0])
+	}
+	if results[1]["status"] != float64(http.StatusBadRequest) {
+		t.Errorf("Expected second item to fail validation, but got %v", results[1])
+	}
+	_, results = batchResults(t, api, body, false)
+	if results[0]["status"] != float64(http.StatusUnauthorized) || results[1]["status"] != float64(http.StatusUnauthorized) || results[1]["body"] != "Unauthorized" {
+		t.Errorf("Expected before hook to stop item, but got %v", results[1])
+	}
+}
+
+func TestBatchHooksRunOnce(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	plugin := &countPlugin{}
+	api.AddPlugin("count", plugin)
+	route := api.GetRoute("create_user")
+	route.PluginPipelines = append(route.PluginPipelines, &PluginPipeline{Name: "count"})
+	requests := requestsTotal.Value("_batch", "5", "200")
+	item := `{"route": "create_user", "params": {"name": "John"}}`
+	_, results := batchResults(t, api, `{"requests": [`+item+`,`+item+`,`+item+`]}`, true)
+	if len(results) != 3 || results[2]["status"] != float64(http.StatusBadRequest) {
+		t.Fatalf("Expected items to fail validation, but got %v", results)
+	}
+	if plugin.calls != 1 {
+		t.Errorf("Expected route hooks to run once per batch, but got %v calls", plugin.calls)
+	}
+	if value := requestsTotal.Value("_batch", "5", "200"); value != requests+1 {
+		t.Errorf("Expected batch request to be counted, but got %v", value)
+	}
+}
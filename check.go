@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template/parse"
+)
+
+type CheckIssue struct {
+	Route   string
+	Version int
+	Message string
+}
+
+func (self *CheckIssue) String() string {
+	if self.Version == 0 {
+		return self.Route + ": " + self.Message
+	}
+	return fmt.Sprintf("%v (v%v): %v", self.Route, self.Version, self.Message)
+}
+
+// templateInspector collects fields that sql template references and params
+// that it outputs without quote.
+type templateInspector struct {
+	references [][]string
+	unquoted   []string
+}
+
+func (self *templateInspector) walk(node parse.Node) {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, child := range node.Nodes {
+			self.walk(child)
+		}
+	case *parse.ActionNode:
+		self.pipe(node.Pipe, len(node.Pipe.Decl) == 0)
+	case *parse.IfNode:
+		self.branch(&node.BranchNode)
+	case *parse.RangeNode:
+		self.branch(&node.BranchNode)
+	case *parse.WithNode:
+		self.branch(&node.BranchNode)
+	case *parse.TemplateNode:
+		self.pipe(node.Pipe, false)
+	}
+}
+
+func (self *templateInspector) branch(node *parse.BranchNode) {
+	self.pipe(node.Pipe, false)
+	self.walk(node.List)
+	self.walk(node.ElseList)
+}
+
+// pipe inspects pipeline, output is set when pipeline result is written to
+// sql.
+func (self *templateInspector) pipe(pipe *parse.PipeNode, output bool) {
+	if pipe == nil {
+		return
+	}
+	for _, command := range pipe.Cmds {
+		if name, ok := indexedParam(command); ok {
+			self.references = append(self.references, []string{"params", name})
+		}
+		for _, arg := range command.Args {
+			switch arg := arg.(type) {
+			case *parse.FieldNode:
+				self.references = append(self.references, arg.Ident)
+			case *parse.VariableNode:
+				if arg.Ident[0] == "$" && len(arg.Ident) > 1 {
+					self.references = append(self.references, arg.Ident[1:])
+				}
+			case *parse.PipeNode:
+				self.pipe(arg, false)
+			}
+		}
+	}
+	if !output || len(pipe.Cmds) == 0 {
+		return
+	}
+	if name, ok := outputParam(pipe.Cmds[len(pipe.Cmds)-1]); ok {
+		self.unquoted = append(self.unquoted, name)
+	}
+}
+
+// indexedParam recognizes {{index .params "name"}}.
+func indexedParam(command *parse.CommandNode) (string, bool) {
+	if len(command.Args) != 3 {
+		return "", false
+	}
+	identifier, ok := command.Args[0].(*parse.IdentifierNode)
+	field, ok2 := command.Args[1].(*parse.FieldNode)
+	name, ok3 := command.Args[2].(*parse.StringNode)
+	if !ok || !ok2 || !ok3 || identifier.Ident != "index" || len(field.Ident) != 1 || field.Ident[0] != "params" {
+		return "", false
+	}
+	return name.Text, true
+}
+
+// outputParam returns param that command outputs as is.
+func outputParam(command *parse.CommandNode) (string, bool) {
+	if name, ok := indexedParam(command); ok {
+		return name, true
+	}
+	if len(command.Args) != 1 {
+		return "", false
+	}
+	if field, ok := command.Args[0].(*parse.FieldNode); ok && len(field.Ident) == 2 && field.Ident[0] == "params" {
+		return field.Ident[1], true
+	}
+	return "", false
+}
+
+var sampleStrings = []string{"1", "sample", "00000000-0000-0000-0000-000000000000", "2000-01-01", "user@example.com"}
+
+// sampleValue returns value that satisfies property schema well enough to
+// render sql template.
+func sampleValue(schema interface{}) interface{} {
+	property, _ := schema.(map[string]interface{})
+	if _, ok := property["example"]; ok {
+		return exampleValue(property)
+	}
+	if _, ok := property["enum"]; ok {
+		return exampleValue(property)
+	}
+	switch property["format"] {
+	case "date":
+		return "2000-01-01"
+	case "date-time":
+		return "2000-01-01T00:00:00Z"
+	case "time":
+		return "00:00:00"
+	case "uuid":
+		return "00000000-0000-0000-0000-000000000000"
+	case "email":
+		return "user@example.com"
+	}
+	switch property["type"] {
+	case "string", nil:
+		pattern, ok := property["pattern"].(string)
+		if !ok {
+			return "sample"
+		}
+		if expression, err := regexp.Compile(pattern); err == nil {
+			for _, value := range sampleStrings {
+				if expression.MatchString(value) {
+					return value
+				}
+			}
+		}
+		return "1"
+	case "array":
+		return []interface{}{sampleValue(property["items"])}
+	case "object":
+		properties, _ := property["properties"].(map[string]interface{})
+		return sampleParams(properties, nil)
+	}
+	return exampleValue(property)
+}
+
+func sampleParams(properties map[string]interface{}, only map[string]bool) map[string]interface{} {
+	params := make(map[string]interface{})
+	for name, property := range properties {
+		if only == nil || only[name] {
+			params[name] = sampleValue(property)
+		}
+	}
+	return params
+}
+
+func isStringSchema(schema interface{}) bool {
+	property, _ := schema.(map[string]interface{})
+	switch value := property["type"].(type) {
+	case string:
+		return value == "string"
+	case []interface{}:
+		for _, item := range value {
+			if item == "string" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restricted string params are validated to have safe values, e.g. numeric id
+// with "^\d+$" pattern.
+func isRestrictedSchema(schema interface{}) bool {
+	property, _ := schema.(map[string]interface{})
+	_, hasPattern := property["pattern"]
+	_, hasEnum := property["enum"]
+	_, hasFormat := property["format"]
+	return hasPattern || hasEnum || hasFormat
+}
+
+// sampleData builds template data with sample params and value 1 for every
+// other referenced field, e.g. .jwt.user_id.
+func sampleData(references [][]string, params map[string]interface{}, pathParams []string) map[string]interface{} {
+	data := map[string]interface{}{"params": params}
+	for _, name := range pathParams {
+		if _, ok := params[name]; !ok {
+			params[name] = "1"
+		}
+	}
+	for _, reference := range references {
+		if len(reference) < 2 || reference[0] == "params" {
+			continue
+		}
+		current := data
+		for _, name := range reference[:len(reference)-1] {
+			next, ok := current[name].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				current[name] = next
+			}
+			current = next
+		}
+		if _, ok := current[reference[len(reference)-1]]; !ok {
+			current[reference[len(reference)-1]] = 1
+		}
+	}
+	return data
+}
+
+// CheckRoute inspects every sql template of route. If db is set, templates
+// rendered with sample params are explained to find sql errors.
+func CheckRoute(db *sql.DB, label string, route *Route) []*CheckIssue {
+	issues := make([]*CheckIssue, 0)
+	versions := make([]int, 0, len(route.Versions))
+	for version, routeVersion := range route.Versions {
+		if routeVersion.SqlTemplate != nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	_, pathParams := openApiPath(route.Path)
+	for _, version := range versions {
+		routeVersion := route.Versions[version]
+		issue := func(format string, args ...interface{}) {
+			issues = append(issues, &CheckIssue{Route: label, Version: version, Message: fmt.Sprintf(format, args...)})
+		}
+		inspector := &templateInspector{}
+		inspector.walk(routeVersion.SqlTemplate.Tree.Root)
+		properties := make(map[string]interface{})
+		if routeVersion.SchemaJson != nil {
+			properties, _ = routeVersion.SchemaJson["properties"].(map[string]interface{})
+		}
+		declared := make(map[string]bool)
+		for name := range properties {
+			declared[name] = true
+		}
+		for _, name := range pathParams {
+			declared[name] = true
+		}
+		reported := make(map[string]bool)
+		for _, reference := range inspector.references {
+			if len(reference) < 2 || reference[0] != "params" || declared[reference[1]] || reported[reference[1]] {
+				continue
+			}
+			reported[reference[1]] = true
+			issue("params.%v is not declared in schema", reference[1])
+		}
+		reported = make(map[string]bool)
+		for _, name := range inspector.unquoted {
+			if reported[name] || !isStringSchema(properties[name]) || isRestrictedSchema(properties[name]) {
+				continue
+			}
+			reported[name] = true
+			issue("params.%v is string, but it's not quoted, use {{.params.%v | quote}}", name, name)
+		}
+		if db == nil {
+			continue
+		}
+		required := make(map[string]bool)
+		if names, ok := routeVersion.SchemaJson["required"].([]interface{}); ok {
+			for _, name := range names {
+				required[fmt.Sprint(name)] = true
+			}
+		}
+		// Rendering with all params and with required ones only covers both
+		// sides of {{if .params.x}}.
+		rendered := make(map[string]bool)
+		for _, only := range []map[string]bool{nil, required} {
+			data := sampleData(inspector.references, sampleParams(properties, only), pathParams)
+			query, err := route.render(routeVersion, data)
+			if err != nil {
+				issue("%v", err)
+				break
+			}
+			if rendered[query] {
+				continue
+			}
+			rendered[query] = true
+			err = explain(db, query)
+			if err != nil {
+				issue("%v\n%v", err, query)
+				break
+			}
+		}
+	}
+	return issues
+}
+
+func explain(db *sql.DB, query string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("explain " + query)
+	return err
+}
+
+// CheckApi checks routes, jobs and scheduled tasks.
+func CheckApi(db *sql.DB, api *Api) []*CheckIssue {
+	issues := make([]*CheckIssue, 0)
+	for _, route := range api.Routes {
+		if route.Stream == nil {
+			issues = append(issues, CheckRoute(db, route.Name, route)...)
+		}
+	}
+	for _, job := range api.JobQueue.Jobs {
+		issues = append(issues, CheckRoute(db, "job "+job.Name, job.Route)...)
+	}
+	for _, task := range api.Schedule.Tasks {
+		issues = append(issues, CheckRoute(db, "task "+task.Name, task.Route)...)
+	}
+	return issues
+}
+
+func checkCommand(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	offline := flags.Bool("offline", false, "only inspect templates, don't explain them in database")
+	flags.Parse(args)
+	api, err := loadApi()
+	if err != nil {
+		return err
+	}
+	var db *sql.DB
+	if !*offline {
+		db, err = GetDbConnection()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+	}
+	issues := CheckApi(db, api)
+	for _, issue := range issues {
+		fmt.Println(strings.Replace(issue.String(), "\n", "\n    ", -1))
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%v problems found", len(issues))
+	}
+	fmt.Println("No problems found")
+	return nil
+}
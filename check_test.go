@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func checkRoute(t *testing.T, path string, sql string, schema map[string]interface{}) *Route {
+	tmpl, err := makeTemplate(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Route{
+		Name:     "update_product",
+		Method:   "PUT",
+		Path:     path,
+		Versions: map[int]*RouteVersion{0: {SqlTemplate: tmpl, SchemaJson: schema}},
+	}
+}
+
+func TestCheckRoute(t *testing.T) {
+	schema := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"name":   map[string]interface{}{"type": "string"},
+			"price":  map[string]interface{}{"type": "integer"},
+			"status": map[string]interface{}{"type": "string", "enum": []interface{}{"new", "sold"}},
+			"note":   map[string]interface{}{"type": []interface{}{"string", "null"}},
+		},
+	}
+	route := checkRoute(t, "/products/:id", `update products set name={{.params.name}}, price={{.params.price}}, status={{.params.status}},
+  note={{index .params "note"}}, color={{.params.color | quote}} where id={{.params.id}} and owner={{.jwt.user_id}}
+  {{if .params.size}}and size={{quote .params.size}}{{end}} returning *`, schema)
+	issues := CheckRoute(nil, route.Name, route)
+	messages := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		messages = append(messages, issue.String())
+	}
+	expected := []string{
+		"update_product: params.color is not declared in schema",
+		"update_product: params.size is not declared in schema",
+		"update_product: params.name is string, but it's not quoted, use {{.params.name | quote}}",
+		"update_product: params.note is string, but it's not quoted, use {{.params.note | quote}}",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected to get issues %v, but got %v", expected, messages)
+	}
+	route = checkRoute(t, "", `select * from products where name={{.params.name | quote}}`, schema)
+	route.Versions[3] = route.Versions[0]
+	route.Versions[0] = &RouteVersion{}
+	issues = CheckRoute(nil, route.Name, route)
+	if len(issues) != 0 {
+		t.Errorf("Expected to get no issues, but got %v", issues)
+	}
+}
+
+func TestSampleData(t *testing.T) {
+	properties := map[string]interface{}{
+		"id":    map[string]interface{}{"type": "string", "pattern": `^\d+$`},
+		"code":  map[string]interface{}{"type": "string", "pattern": `^[a-z]+$`},
+		"day":   map[string]interface{}{"type": "string", "format": "date"},
+		"tags":  map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer"}},
+		"color": map[string]interface{}{"type": "string", "enum": []interface{}{"red"}},
+	}
+	references := [][]string{{"jwt", "user_id"}, {"files", "photo", "url"}, {"params", "missing"}}
+	data := sampleData(references, sampleParams(properties, nil), []string{"shop"})
+	expected := map[string]interface{}{
+		"params": map[string]interface{}{
+			"id":    "1",
+			"code":  "sample",
+			"day":   "2000-01-01",
+			"tags":  []interface{}{1},
+			"color": "red",
+			"shop":  "1",
+		},
+		"jwt":   map[string]interface{}{"user_id": 1},
+		"files": map[string]interface{}{"photo": map[string]interface{}{"url": 1}},
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("Expected sample data %v, but got %v", expected, data)
+	}
+	params := sampleParams(properties, map[string]bool{"id": true})
+	if !reflect.DeepEqual(params, map[string]interface{}{"id": "1"}) {
+		t.Errorf("Expected only required params, but got %v", params)
+	}
+}
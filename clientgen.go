@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type clientRoute struct {
+	Name        string
+	Method      string
+	Path        string
+	Description string
+	Fields      []*clientField
+	Response    map[string]interface{}
+	Collection  bool
+}
+
+type clientField struct {
+	Name     string
+	In       string
+	Schema   map[string]interface{}
+	Required bool
+}
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// clientRoutes describes routes of api version for client generators. Stream
+// routes are skipped.
+func clientRoutes(api *Api, version int) []*clientRoute {
+	routes := make([]*clientRoute, 0, len(api.Routes))
+	for _, route := range api.Routes {
+		if route.Stream != nil {
+			continue
+		}
+		_, pathParams := openApiPath(route.Path)
+		operation := openApiOperation(api, route, version, pathParams)
+		clientRoute := &clientRoute{
+			Name:        route.Name,
+			Method:      route.Method,
+			Path:        route.Path,
+			Description: route.GetDescription(version),
+			Response:    route.ResponseSchema,
+			Collection:  route.Collection,
+		}
+		parameters, _ := operation["parameters"].([]interface{})
+		for _, value := range parameters {
+			parameter := value.(map[string]interface{})
+			schema, _ := parameter["schema"].(map[string]interface{})
+			clientRoute.Fields = append(clientRoute.Fields, &clientField{
+				Name:     parameter["name"].(string),
+				In:       parameter["in"].(string),
+				Schema:   schema,
+				Required: parameter["required"].(bool),
+			})
+		}
+		if requestBody, ok := operation["requestBody"].(map[string]interface{}); ok {
+			content := requestBody["content"].(map[string]interface{})
+			schema := content["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+			required := make(map[string]bool)
+			names, _ := schema["required"].([]string)
+			for _, name := range names {
+				required[name] = true
+			}
+			properties, _ := schema["properties"].(map[string]interface{})
+			for _, name := range sortedKeys(properties) {
+				property, _ := properties[name].(map[string]interface{})
+				clientRoute.Fields = append(clientRoute.Fields, &clientField{Name: name, In: "body", Schema: property, Required: required[name]})
+			}
+		}
+		routes = append(routes, clientRoute)
+	}
+	return routes
+}
+
+func (self *clientRoute) hasRequiredFields() bool {
+	for _, field := range self.Fields {
+		if field.Required {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *clientRoute) sendsBody() bool {
+	return self.Method == "POST" || self.Method == "PUT"
+}
+
+func pascalCase(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	})
+	for i, part := range parts {
+		parts[i] = strings.ToUpper(part[:1]) + part[1:]
+	}
+	result := strings.Join(parts, "")
+	if result == "" || result[0] >= '0' && result[0] <= '9' {
+		result = "X" + result
+	}
+	return result
+}
+
+func camelCase(name string) string {
+	name = pascalCase(name)
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+func schemaProperties(schema map[string]interface{}) (map[string]interface{}, map[string]bool) {
+	properties, _ := schema["properties"].(map[string]interface{})
+	required := make(map[string]bool)
+	names, _ := schema["required"].([]interface{})
+	for _, name := range names {
+		required[fmt.Sprint(name)] = true
+	}
+	return properties, required
+}
+
+func tsType(schema map[string]interface{}) string {
+	if values, ok := schema["enum"].([]interface{}); ok && len(values) > 0 {
+		literals := make([]string, 0, len(values))
+		for _, value := range values {
+			literal, _ := json.Marshal(value)
+			literals = append(literals, string(literal))
+		}
+		return strings.Join(literals, " | ")
+	}
+	switch schema["type"] {
+	case "string":
+		return "string"
+	case "integer", "number":
+		return "number"
+	case "boolean":
+		return "boolean"
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		itemType := tsType(items)
+		if strings.Contains(itemType, "|") {
+			itemType = "(" + itemType + ")"
+		}
+		return itemType + "[]"
+	case "object":
+		properties, required := schemaProperties(schema)
+		if len(properties) == 0 {
+			return "Record<string, unknown>"
+		}
+		fields := make([]string, 0, len(properties))
+		for _, name := range sortedKeys(properties) {
+			property, _ := properties[name].(map[string]interface{})
+			fields = append(fields, tsField(name, required[name])+": "+tsType(property))
+		}
+		return "{ " + strings.Join(fields, "; ") + " }"
+	}
+	return "unknown"
+}
+
+func tsField(name string, required bool) string {
+	if !identifierRegexp.MatchString(name) {
+		quoted, _ := json.Marshal(name)
+		name = string(quoted)
+	}
+	if !required {
+		name += "?"
+	}
+	return name
+}
+
+func tsResponseType(route *clientRoute) string {
+	if route.Response != nil {
+		return tsType(route.Response)
+	}
+	if route.Collection {
+		return "Record<string, unknown>[]"
+	}
+	return "Record<string, unknown>"
+}
+
+const tsClientRuntime = `// Code generated by dbservice gen client. DO NOT EDIT.
+
+export interface ClientOptions {
+  baseUrl?: string;
+  version?: number;
+  token?: string;
+  onToken?: (token: string) => void;
+  fetch?: typeof fetch;
+}
+
+export class ApiError extends Error {
+  status: number;
+  body: unknown;
+
+  constructor(status: number, body: unknown) {
+    super("Request failed with status " + status);
+    this.status = status;
+    this.body = body;
+  }
+}
+`
+
+const tsClientRequest = `
+export class Client {
+  baseUrl: string;
+  version: number;
+  token: string;
+  onToken?: (token: string) => void;
+  private fetchFn: typeof fetch;
+
+  constructor(options: ClientOptions = {}) {
+    this.baseUrl = options.baseUrl || "";
+    this.version = options.version || 0;
+    this.token = options.token || "";
+    this.onToken = options.onToken;
+    this.fetchFn = options.fetch || fetch.bind(globalThis);
+  }
+
+  private async request<T>(method: string, path: string, params: object, body: boolean): Promise<T> {
+    let url = this.baseUrl + path;
+    const headers: Record<string, string> = {};
+    const init: RequestInit = { method: method, headers: headers };
+    if (body) {
+      headers["Content-Type"] = "application/json";
+      init.body = JSON.stringify(params);
+    } else {
+      const query = new URLSearchParams();
+      const values = params as Record<string, unknown>;
+      for (const key of Object.keys(values)) {
+        const value = values[key];
+        if (value === undefined || value === null) {
+          continue;
+        }
+        for (const item of Array.isArray(value) ? value : [value]) {
+          query.append(key, String(item));
+        }
+      }
+      const queryString = query.toString();
+      if (queryString) {
+        url += "?" + queryString;
+      }
+    }
+    if (this.version) {
+      headers["api-version"] = String(this.version);
+    }
+    if (this.token) {
+      headers["Authorization"] = "Bearer " + this.token;
+    }
+    const response = await this.fetchFn(url, init);
+    const authorization = response.headers.get("Authorization");
+    if (authorization && authorization.indexOf("Bearer ") === 0) {
+      this.token = authorization.slice("Bearer ".length);
+      if (this.onToken) {
+        this.onToken(this.token);
+      }
+    }
+    const text = await response.text();
+    let data: unknown = text;
+    try {
+      data = text ? JSON.parse(text) : null;
+    } catch (e) {
+      // Plain text error.
+    }
+    if (!response.ok) {
+      throw new ApiError(response.status, data);
+    }
+    return data as T;
+  }
+`
+
+func GenerateTypeScriptClient(api *Api, version int) string {
+	var out bytes.Buffer
+	out.WriteString(tsClientRuntime)
+	routes := clientRoutes(api, version)
+	for _, route := range routes {
+		typeName := pascalCase(route.Name)
+		fmt.Fprintf(&out, "\nexport interface %vParams {\n", typeName)
+		for _, field := range route.Fields {
+			fmt.Fprintf(&out, "  %v: %v;\n", tsField(field.Name, field.Required), tsType(field.Schema))
+		}
+		fmt.Fprintf(&out, "}\n\nexport type %vResponse = %v;\n", typeName, tsResponseType(route))
+	}
+	out.WriteString(tsClientRequest)
+	for _, route := range routes {
+		typeName := pascalCase(route.Name)
+		out.WriteString("\n")
+		if route.Description != "" {
+			fmt.Fprintf(&out, "  /** %v */\n", strings.Replace(route.Description, "*/", "* /", -1))
+		}
+		defaultParams := ""
+		if !route.hasRequiredFields() {
+			defaultParams = " = {}"
+		}
+		fmt.Fprintf(&out, "  %v(params: %vParams%v): Promise<%vResponse> {\n", camelCase(route.Name), typeName, defaultParams, typeName)
+		path, pathParams := openApiPath(route.Path)
+		rest := "params"
+		if len(pathParams) > 0 {
+			fmt.Fprintf(&out, "    const { %v, ...rest } = params;\n", strings.Join(pathParams, ", "))
+			rest = "rest"
+		}
+		pathExpression, _ := json.Marshal(path)
+		expression := string(pathExpression)
+		for _, name := range pathParams {
+			expression = strings.Replace(expression, "{"+name+"}", `" + encodeURIComponent(String(`+name+`)) + "`, 1)
+		}
+		expression = strings.Replace(strings.Replace(expression, ` + ""`, "", -1), `"" + `, "", -1)
+		fmt.Fprintf(&out, "    return this.request<%vResponse>(%q, %v, %v, %v);\n  }\n", typeName, route.Method, expression, rest, route.sendsBody())
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
+func goType(schema map[string]interface{}) string {
+	switch schema["type"] {
+	case "string":
+		return "string"
+	case "integer":
+		return "int64"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		return "[]" + goType(items)
+	case "object":
+		return "map[string]interface{}"
+	}
+	return "interface{}"
+}
+
+// goFieldType returns pointer for optional scalar fields, so zero values can
+// be sent.
+func goFieldType(schema map[string]interface{}, required bool) string {
+	fieldType := goType(schema)
+	if required || strings.HasPrefix(fieldType, "[]") || strings.HasPrefix(fieldType, "map") || fieldType == "interface{}" {
+		return fieldType
+	}
+	return "*" + fieldType
+}
+
+// goFieldNames returns struct field names for json names. Names that differ
+// only in case or separators (e.g. user_id and userId) would give struct
+// with duplicate fields, so they are rejected.
+func goFieldNames(typeName string, names []string) ([]string, error) {
+	fields := make([]string, len(names))
+	seen := make(map[string]string)
+	for i, name := range names {
+		fields[i] = pascalCase(name)
+		if other, ok := seen[fields[i]]; ok {
+			return nil, fmt.Errorf("%v: properties %q and %q both become field %v", typeName, other, name, fields[i])
+		}
+		seen[fields[i]] = name
+	}
+	return fields, nil
+}
+
+func goStruct(out *bytes.Buffer, name string, properties map[string]interface{}, required map[string]bool) error {
+	names := sortedKeys(properties)
+	fields, err := goFieldNames(name, names)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "type %v struct {\n", name)
+	for i, property := range names {
+		schema, _ := properties[property].(map[string]interface{})
+		tag := property
+		if !required[property] {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(out, "\t%v %v `json:%q`\n", fields[i], goFieldType(schema, required[property]), tag)
+	}
+	out.WriteString("}\n\n")
+	return nil
+}
+
+// goResponseType generates struct for documented response object (or
+// response array items) and returns response type.
+func goResponseType(out *bytes.Buffer, route *clientRoute) (string, error) {
+	typeName := pascalCase(route.Name) + "Response"
+	if route.Response == nil {
+		if route.Collection {
+			return "[]map[string]interface{}", nil
+		}
+		return "map[string]interface{}", nil
+	}
+	schema := route.Response
+	prefix := ""
+	if schema["type"] == "array" {
+		schema, _ = schema["items"].(map[string]interface{})
+		prefix = "[]"
+		typeName = pascalCase(route.Name) + "Item"
+	}
+	properties, required := schemaProperties(schema)
+	if schema["type"] != "object" || len(properties) == 0 {
+		return goType(route.Response), nil
+	}
+	err := goStruct(out, typeName, properties, required)
+	return prefix + typeName, err
+}
+
+const goClientRuntime = `// Code generated by dbservice gen client. DO NOT EDIT.
+
+package %v
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Client struct {
+	BaseUrl    string
+	Version    int
+	HttpClient *http.Client
+	OnToken    func(token string)
+	token      string
+	mutex      sync.Mutex
+}
+
+type Error struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (self *Error) Error() string {
+	return fmt.Sprintf("request failed with status %%v: %%s", self.StatusCode, self.Body)
+}
+
+func New(baseUrl string) *Client {
+	return &Client{BaseUrl: baseUrl, HttpClient: http.DefaultClient}
+}
+
+func (self *Client) Token() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.token
+}
+
+func (self *Client) SetToken(token string) {
+	self.mutex.Lock()
+	self.token = token
+	self.mutex.Unlock()
+	if self.OnToken != nil {
+		self.OnToken(token)
+	}
+}
+
+func queryValues(params interface{}) (url.Values, error) {
+	content, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	err = decoder.Decode(&fields)
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	for name, value := range fields {
+		if items, ok := value.([]interface{}); ok {
+			for _, item := range items {
+				values.Add(name, fmt.Sprint(item))
+			}
+		} else {
+			values.Set(name, fmt.Sprint(value))
+		}
+	}
+	return values, nil
+}
+
+func (self *Client) do(ctx context.Context, method string, path string, params interface{}, body bool, result interface{}) error {
+	var requestBody []byte
+	if body {
+		var err error
+		requestBody, err = json.Marshal(params)
+		if err != nil {
+			return err
+		}
+	} else {
+		query, err := queryValues(params)
+		if err != nil {
+			return err
+		}
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+	}
+	request, err := http.NewRequest(method, self.BaseUrl+path, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	if body {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if self.Version != 0 {
+		request.Header.Set("api-version", strconv.Itoa(self.Version))
+	}
+	if token := self.Token(); token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := self.HttpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if authorization := response.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		self.SetToken(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &Error{StatusCode: response.StatusCode, Body: content}
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content, result)
+}
+`
+
+func GenerateGoClient(api *Api, version int, packageName string) (string, error) {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, goClientRuntime, packageName)
+	out.WriteString("\n")
+	routes := clientRoutes(api, version)
+	responseTypes := make([]string, len(routes))
+	routeNames := make(map[string]string)
+	for i, route := range routes {
+		typeName := pascalCase(route.Name)
+		if other, ok := routeNames[typeName]; ok {
+			return "", fmt.Errorf("routes %v and %v both become method %v", other, route.Name, typeName)
+		}
+		routeNames[typeName] = route.Name
+		names := make([]string, len(route.Fields))
+		for j, field := range route.Fields {
+			names[j] = field.Name
+		}
+		fields, err := goFieldNames(typeName+"Params", names)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&out, "type %vParams struct {\n", typeName)
+		for j, field := range route.Fields {
+			tag := field.Name
+			if field.In == "path" {
+				tag = "-"
+			} else if !field.Required {
+				tag += ",omitempty"
+			}
+			fmt.Fprintf(&out, "\t%v %v `json:%q`\n", fields[j], goFieldType(field.Schema, field.Required), tag)
+		}
+		out.WriteString("}\n\n")
+		responseTypes[i], err = goResponseType(&out, route)
+		if err != nil {
+			return "", err
+		}
+	}
+	for i, route := range routes {
+		name := pascalCase(route.Name)
+		fmt.Fprintf(&out, "// %v calls %v %v.\n", name, route.Method, route.Path)
+		if route.Description != "" {
+			fmt.Fprintf(&out, "// %v\n", strings.Replace(route.Description, "\n", " ", -1))
+		}
+		fmt.Fprintf(&out, "func (self *Client) %v(ctx context.Context, params *%vParams) (%v, error) {\n", name, name, responseTypes[i])
+		fmt.Fprintf(&out, "\tif params == nil {\n\t\tparams = &%vParams{}\n\t}\n", name)
+		path, pathParams := openApiPath(route.Path)
+		pathExpression := fmt.Sprintf("%q", path)
+		for _, param := range pathParams {
+			pathExpression = strings.Replace(pathExpression, "{"+param+"}", `" + url.PathEscape(fmt.Sprint(params.`+pascalCase(param)+`)) + "`, 1)
+		}
+		pathExpression = strings.Replace(strings.Replace(pathExpression, ` + ""`, "", -1), `"" + `, "", -1)
+		fmt.Fprintf(&out, "\tvar result %v\n", responseTypes[i])
+		fmt.Fprintf(&out, "\terr := self.do(ctx, %q, %v, params, %v, &result)\n", route.Method, pathExpression, route.sendsBody())
+		out.WriteString("\treturn result, err\n}\n\n")
+	}
+	source, err := format.Source(out.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("generated client is invalid: %v", err)
+	}
+	return string(source), nil
+}
+
+func genCommand(args []string) error {
+	if len(args) == 0 || args[0] != "client" {
+		return errors.New("usage: dbservice gen client -lang ts|go [-output file] [-package name] [-version n]")
+	}
+	flags := flag.NewFlagSet("gen client", flag.ExitOnError)
+	lang := flags.String("lang", "ts", "client language: ts or go")
+	output := flags.String("output", "", "output file (stdout by default)")
+	packageName := flags.String("package", "client", "go package name")
+	version := flags.Int("version", -1, "api version that types are generated for (latest by default)")
+	flags.Parse(args[1:])
+	api, err := loadApi()
+	if err != nil {
+		return err
+	}
+	if *version == -1 {
+		*version = api.Version
+	}
+	var source string
+	switch *lang {
+	case "ts":
+		source = GenerateTypeScriptClient(api, *version)
+	case "go":
+		source, err = GenerateGoClient(api, *version, *packageName)
+	default:
+		err = fmt.Errorf("unknown client language: %v", *lang)
+	}
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.WriteString(source)
+		return err
+	}
+	return ioutil.WriteFile(*output, []byte(source), 0644)
+}
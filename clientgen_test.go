@@ -0,0 +1,145 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateTypeScriptClient(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	source := GenerateTypeScriptClient(api, 5)
+	if source != GenerateTypeScriptClient(api, 5) {
+		t.Error("Expected generated client to be deterministic")
+	}
+	for _, part := range []string{
+		"export type GetUsersResponse = { email?: string; id: number; name: string }[];",
+		"getUsers(params: GetUsersParams = {}): Promise<GetUsersResponse> {",
+		"  email: string;\n  name: string;\n",
+		"  /** Create user */\n  createUser(params: CreateUserParams): Promise<CreateUserResponse> {",
+		`return this.request<UpdateUserResponse>("PUT", "/users/" + encodeURIComponent(String(id)), rest, true);`,
+		`headers["api-version"] = String(this.version);`,
+	} {
+		if !strings.Contains(source, part) {
+			t.Errorf("Expected typescript client to contain %v", part)
+		}
+	}
+	source = GenerateTypeScriptClient(api, 3)
+	if !strings.Contains(source, "export interface CreateUserParams {\n  email: string;\n}") {
+		t.Error("Expected version 3 client to use version 3 schema")
+	}
+}
+
+func TestGenerateGoClient(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	source, err := GenerateGoClient(api, 5, "users")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "client.go", source, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	config := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	_, err = config.Check("users", fset, []*ast.File{file}, nil)
+	if err != nil {
+		t.Errorf("Expected generated client to compile, but got: %v", err)
+	}
+	for _, part := range []string{
+		"type GetUsersItem struct {\n\tEmail *string `json:\"email,omitempty\"`\n\tId    int64   `json:\"id\"`",
+		"func (self *Client) GetUsers(ctx context.Context, params *GetUsersParams) ([]GetUsersItem, error) {",
+		"// CreateUser calls POST /users.\n// Create user\n",
+		"Id string `json:\"-\"`",
+		`self.do(ctx, "PUT", "/users/"+url.PathEscape(fmt.Sprint(params.Id)), params, true, &result)`,
+	} {
+		if !strings.Contains(source, part) {
+			t.Errorf("Expected go client to contain %v", part)
+		}
+	}
+}
+
+func TestGenerateGoClientCollisions(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	route := api.GetRoute("get_users")
+	route.ResponseSchema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+		"user_id": map[string]interface{}{"type": "integer"},
+		"userId":  map[string]interface{}{"type": "integer"},
+	}}
+	_, err = GenerateGoClient(api, 5, "users")
+	if err == nil || err.Error() != `GetUsersResponse: properties "userId" and "user_id" both become field UserId` {
+		t.Errorf("Expected field collision error, but got %v", err)
+	}
+	route.ResponseSchema = nil
+	api.Routes = append(api.Routes, &Route{Name: "getUsers", Method: "GET", Path: "/all_users"})
+	_, err = GenerateGoClient(api, 5, "users")
+	if err == nil || err.Error() != "routes get_users and getUsers both become method GetUsers" {
+		t.Errorf("Expected route collision error, but got %v", err)
+	}
+}
+
+func TestGoClientQueryValues(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	source, err := GenerateGoClient(api, 5, "users")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"go.mod":    "module users\n",
+		"client.go": source,
+		"client_test.go": `package users
+
+import "testing"
+
+func TestQueryValues(t *testing.T) {
+	values, err := queryValues(map[string]interface{}{"id": 1234567, "ids": []int64{7654321}, "price": 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query := values.Encode(); query != "id=1234567&ids=7654321&price=1.5" {
+		t.Errorf("Unexpected query: %v", query)
+	}
+}
+`,
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	command := exec.Command("go", "test", ".")
+	command.Dir = dir
+	output, err := command.CombinedOutput()
+	if err != nil {
+		t.Errorf("Generated client test failed: %v\n%s", err, output)
+	}
+}
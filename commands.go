@@ -0,0 +1,14 @@
+package main
+
+// commands are run instead of server when first argument is command name,
+// otherwise first argument is server port.
+var commands = map[string]func(args []string) error{
+	"openapi":  openApiCommand,
+	"gen":      genCommand,
+	"migrate":  migrateCommand,
+	"init":     initCommand,
+	"generate": generateCommand,
+	"test":     testCommand,
+	"check":    checkCommand,
+	"routes":   routesCommand,
+}
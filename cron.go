@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is parsed standard 5 field cron expression (minute, hour,
+// day of month, month, day of week).
+type CronSchedule struct {
+	Minute     map[int]bool
+	Hour       map[int]bool
+	DayOfMonth map[int]bool
+	Month      map[int]bool
+	DayOfWeek  map[int]bool
+	// Day matches when either day of month or day of week matches if both
+	// of them are restricted (same as in cron).
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func ParseCron(expression string) (*CronSchedule, error) {
+	if macro, ok := cronMacros[expression]; ok {
+		expression = macro
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression should have 5 fields, but got: '%v'", expression)
+	}
+	schedule := &CronSchedule{
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}
+	var err error
+	ranges := []struct {
+		field    *map[int]bool
+		min, max int
+	}{
+		{&schedule.Minute, 0, 59},
+		{&schedule.Hour, 0, 23},
+		{&schedule.DayOfMonth, 1, 31},
+		{&schedule.Month, 1, 12},
+		{&schedule.DayOfWeek, 0, 7},
+	}
+	for i, r := range ranges {
+		*r.field, err = parseCronField(fields[i], r.min, r.max)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", expression, err)
+		}
+	}
+	if schedule.DayOfWeek[7] {
+		schedule.DayOfWeek[0] = true
+	}
+	return schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in '%v'", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%v'", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid value '%v'", part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("'%v' is out of %v-%v range", part, min, max)
+		}
+		for value := from; value <= to; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+func (self *CronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := self.DayOfMonth[t.Day()]
+	dayOfWeek := self.DayOfWeek[int(t.Weekday())]
+	if self.anyDayOfMonth || self.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// Next returns first time after t that matches schedule.
+func (self *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !self.Month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !self.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !self.Hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !self.Minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	start := time.Date(2016, 1, 30, 10, 15, 30, 0, time.UTC)
+	tests := []struct {
+		expression string
+		next       time.Time
+	}{
+		{"* * * * *", time.Date(2016, 1, 30, 10, 16, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2016, 1, 30, 10, 20, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2016, 1, 31, 3, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2016, 1, 30, 11, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2016, 2, 1, 9, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2016, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,15 * *", time.Date(2016, 2, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		schedule, err := ParseCron(test.expression)
+		if err != nil {
+			t.Errorf("Unexpected error for '%v': %v", test.expression, err)
+			continue
+		}
+		next := schedule.Next(start)
+		if !next.Equal(test.next) {
+			t.Errorf("Expected '%v' next run to be %v, but got %v", test.expression, test.next, next)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expression := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		_, err := ParseCron(expression)
+		if err == nil {
+			t.Errorf("Expected to get error for '%v', but got nil", expression)
+		}
+	}
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/gophergala2016/dbserver/plugins"
+	"github.com/lib/pq"
 )
 
-func GetDbConnection() (*sql.DB, error) {
+func GetDbConnectionString() (string, error) {
 	config, err := ParseDbConfig(".")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("postgres://%s:%s@%s:%v/%s?sslmode=%s",
+		config.User, config.Password, config.Host, config.Port, config.Database, config.SslMode), nil
+}
+
+func GetDbConnection() (*sql.DB, error) {
+	dbinfo, err := GetDbConnectionString()
 	if err != nil {
 		return nil, err
 	}
-	dbinfo := fmt.Sprintf("postgres://%s:%s@%s:%v/%s?sslmode=%s",
-		config.User, config.Password, config.Host, config.Port, config.Database, config.SslMode)
 	db, err := sql.Open("postgres", dbinfo)
 	if err != nil {
 		return nil, err
@@ -23,3 +32,83 @@ func GetDbConnection() (*sql.DB, error) {
 	}
 	return db, nil
 }
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryJson(q queryer, query string) (sql.NullString, bool, error) {
+	var value sql.NullString
+	rows, err := q.Query(query)
+	if err != nil {
+		return value, false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return value, false, rows.Err()
+	}
+	err = rows.Scan(&value)
+	return value, true, err
+}
+
+// resultHook runs in query transaction before it's committed and can change
+// result.
+type resultHook func(tx *sql.Tx, value string) (string, error)
+
+func ExecuteSql(db *sql.DB, query string, sessions []*plugins.Session) (sql.NullString, bool, error) {
+	return executeSql(db, query, sessions, nil)
+}
+
+func executeSql(db *sql.DB, query string, sessions []*plugins.Session, hook resultHook) (sql.NullString, bool, error) {
+	if len(sessions) == 0 && hook == nil {
+		return queryJson(db, query)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return sql.NullString{}, false, err
+	}
+	defer tx.Rollback()
+	for _, session := range sessions {
+		err = applySession(tx, session)
+		if err != nil {
+			return sql.NullString{}, false, err
+		}
+	}
+	value, found, err := queryJson(tx, query)
+	if err != nil {
+		return value, found, err
+	}
+	if hook != nil && value.Valid {
+		value.String, err = hook(tx, value.String)
+		if err != nil {
+			return value, found, err
+		}
+	}
+	return value, found, tx.Commit()
+}
+
+// ExecuteSqlContext executes query in span of request from context.
+func ExecuteSqlContext(ctx context.Context, db *sql.DB, query string, sessions []*plugins.Session, hook resultHook) (sql.NullString, bool, error) {
+	_, span := startSpan(ctx, "db.query", spanKindClient)
+	defer span.End()
+	query, sessions = traceSql(span, query, sessions)
+	value, found, err := executeSql(db, query, sessions, hook)
+	span.SetError(err)
+	return value, found, err
+}
+
+func applySession(tx *sql.Tx, session *plugins.Session) error {
+	if session.Role != "" {
+		_, err := tx.Exec("SET LOCAL ROLE " + pq.QuoteIdentifier(session.Role))
+		if err != nil {
+			return err
+		}
+	}
+	for name, value := range session.Settings {
+		_, err := tx.Exec("select set_config($1, $2, true)", name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/gophergala2016/dbserver/plugins"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	debugHeader = "X-Debug"
+	debugParam  = "_debug"
+)
+
+// DebugInfo describes how request would be or was executed.
+type DebugInfo struct {
+	Route           string             `json:"route"`
+	Version         int                `json:"version"`
+	ResolvedVersion int                `json:"resolved_version"`
+	Template        string             `json:"template"`
+	Schema          string             `json:"schema"`
+	SchemaResult    *DebugSchemaResult `json:"schema_result"`
+	Params          interface{}        `json:"params"`
+	Sql             string             `json:"sql,omitempty"`
+	Sessions        []*plugins.Session `json:"sessions"`
+	Explain         []string           `json:"explain,omitempty"`
+	Result          json.RawMessage    `json:"result,omitempty"`
+	Duration        string             `json:"duration,omitempty"`
+	Error           string             `json:"error,omitempty"`
+	modes           map[string]bool
+}
+
+type DebugSchemaResult struct {
+	Valid  bool            `json:"valid"`
+	Errors json.RawMessage `json:"errors,omitempty"`
+}
+
+// debugModes returns requested debug modes: "sql" only renders sql (it's
+// implied by other modes), "explain" runs EXPLAIN (ANALYZE, BUFFERS) in
+// transaction that is rolled back and "result" executes query in transaction
+// that is rolled back too. Nil is
+// returned if debug is not requested or not enabled.
+func debugModes(api *Api, r *http.Request) map[string]bool {
+	if !api.Debug {
+		return nil
+	}
+	value := r.Header.Get(debugHeader)
+	if value == "" {
+		value = r.URL.Query().Get(debugParam)
+	}
+	if value == "" {
+		return nil
+	}
+	modes := map[string]bool{"sql": true}
+	for _, mode := range strings.Split(value, ",") {
+		modes[strings.TrimSpace(mode)] = true
+	}
+	return modes
+}
+
+func explainSql(db *sql.DB, query string, sessions []*plugins.Session) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	// Analyze executes query, changes are never committed.
+	defer tx.Rollback()
+	for _, session := range sessions {
+		err = applySession(tx, session)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rows, err := tx.Query("explain (analyze, buffers) " + query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	plan := make([]string, 0)
+	for rows.Next() {
+		var line string
+		err = rows.Scan(&line)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, line)
+	}
+	return plan, rows.Err()
+}
+
+// resultSql returns query result, changes are never committed, so debug
+// request doesn't need side effects (uploads, jobs, response plugins) of
+// real request.
+func resultSql(db *sql.DB, query string, sessions []*plugins.Session) (sql.NullString, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return sql.NullString{}, false, err
+	}
+	defer tx.Rollback()
+	return queryTx(context.Background(), tx, query, sessions)
+}
+
+// debugRequest fills debug info and returns response status.
+func debugRequest(api *Api, route *Route, version int, data map[string]interface{}, info *DebugInfo) int {
+	info.ResolvedVersion = route.GetAvailableVersion(version)
+	routeVersion := route.Versions[info.ResolvedVersion]
+	if routeVersion == nil || routeVersion.SqlTemplate == nil {
+		info.Error = "Route version is missing sql template"
+		return http.StatusInternalServerError
+	}
+	info.Template = routeVersion.SqlFile
+	info.Schema = routeVersion.SchemaFile
+	validationErrors, err := route.validate(data["params"], info.ResolvedVersion)
+	if err != nil {
+		info.Error = err.Error()
+		return http.StatusInternalServerError
+	}
+	info.Params = data["params"]
+	info.SchemaResult = &DebugSchemaResult{Valid: validationErrors == ""}
+	if validationErrors != "" {
+		info.SchemaResult.Errors = json.RawMessage(validationErrors)
+		return http.StatusBadRequest
+	}
+	info.Sql, err = route.render(routeVersion, data)
+	if err != nil {
+		info.Error = err.Error()
+		return http.StatusInternalServerError
+	}
+	sessions, err := getSessions(api, data)
+	if err != nil {
+		info.Error = err.Error()
+		return http.StatusInternalServerError
+	}
+	info.Sessions = append(info.Sessions, sessions...)
+	if info.modes["explain"] {
+		info.Explain, err = explainSql(db, info.Sql, info.Sessions)
+		if err != nil {
+			info.Error = err.Error()
+			return http.StatusInternalServerError
+		}
+	}
+	if info.modes["result"] {
+		start := time.Now()
+		value, found, err := resultSql(db, info.Sql, info.Sessions)
+		info.Duration = time.Since(start).String()
+		if err != nil {
+			info.Error = err.Error()
+			return http.StatusInternalServerError
+		}
+		info.Result = batchBody(value.String)
+		if found && !value.Valid && route.Collection {
+			info.Result = json.RawMessage("[]")
+		}
+	}
+	return http.StatusOK
+}
+
+func serveDebug(api *Api, route *Route, version int, data map[string]interface{}, modes map[string]bool, w http.ResponseWriter) {
+	info := &DebugInfo{Route: route.Name, Version: version, Sessions: []*plugins.Session{}, modes: modes}
+	status := debugRequest(api, route, version, data, info)
+	content, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
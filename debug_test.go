@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDebugModes(t *testing.T) {
+	api := &Api{}
+	r := httptest.NewRequest("GET", "/users?_debug=explain", nil)
+	if modes := debugModes(api, r); modes != nil {
+		t.Errorf("Expected debug to be disabled, but got %v", modes)
+	}
+	api.Debug = true
+	if modes := debugModes(api, r); !reflect.DeepEqual(modes, map[string]bool{"sql": true, "explain": true}) {
+		t.Errorf("Unexpected modes: %v", modes)
+	}
+	r = httptest.NewRequest("GET", "/users", nil)
+	r.Header.Set("X-Debug", "explain, result")
+	if modes := debugModes(api, r); !reflect.DeepEqual(modes, map[string]bool{"sql": true, "explain": true, "result": true}) {
+		t.Errorf("Unexpected modes: %v", modes)
+	}
+	if modes := debugModes(api, httptest.NewRequest("GET", "/users", nil)); modes != nil {
+		t.Errorf("Expected no modes without header, but got %v", modes)
+	}
+}
+
+func TestDebugConfig(t *testing.T) {
+	config := &Config{Debug: DebugConfig{Enabled: true}}
+	if !config.DebugEnabled() {
+		t.Errorf("Expected debug to be enabled")
+	}
+	config.Mode = "production"
+	if config.DebugEnabled() {
+		t.Errorf("Expected debug to be disabled in production mode")
+	}
+}
+
+func TestServeDebug(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	data := map[string]interface{}{"params": map[string]interface{}{}}
+	serveDebug(api, api.GetRoute("get_users"), 3, data, map[string]bool{"sql": true}, w)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %v: %v", w.Code, w.Body.String())
+	}
+	info := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if info["resolved_version"] != 4.0 || info["template"] != "testapp/sql/get_users.v4.sql" {
+		t.Errorf("Unexpected debug info: %v", info)
+	}
+	if info["sql"] != "with response_table as (select name from users) select array_to_json(array_agg(row_to_json(t))) as value from (select * from response_table) t" {
+		t.Errorf("Unexpected sql: %v", info["sql"])
+	}
+	if _, ok := info["result"]; ok {
+		t.Errorf("Expected dry run to have no result, but got %v", info["result"])
+	}
+	w = httptest.NewRecorder()
+	serveDebug(api, api.GetRoute("create_user"), 5, data, map[string]bool{"sql": true}, w)
+	info = make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &info)
+	schemaResult, _ := info["schema_result"].(map[string]interface{})
+	if w.Code != http.StatusBadRequest || schemaResult["valid"] != false || schemaResult["errors"] == nil || info["schema"] != "testapp/schemas/create_user.schema" {
+		t.Errorf("Expected schema errors, but got %v: %v", w.Code, w.Body.String())
+	}
+}
+
+func TestServeDebugResult(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector := &fakeConnector{}
+	defer func(previous *sql.DB) { db = previous }(db)
+	db = sql.OpenDB(connector)
+	defer db.Close()
+	w := httptest.NewRecorder()
+	data := map[string]interface{}{"params": map[string]interface{}{"name": "Alice"}}
+	serveDebug(api, api.GetRoute("get_users"), 4, data, map[string]bool{"sql": true, "result": true}, w)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %v: %v", w.Code, w.Body.String())
+	}
+	info := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if !reflect.DeepEqual(info["result"], []interface{}{}) || !reflect.DeepEqual(info["params"], map[string]interface{}{"name": "Alice"}) {
+		t.Errorf("Unexpected debug info: %v", info)
+	}
+	if connector.commits != 0 {
+		t.Errorf("Expected debug result to be rolled back, but got %v commits", connector.commits)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gophergala2016/dbserver/plugins/jwt"
+	"github.com/julienschmidt/httprouter"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type DocsPage struct {
+	Title       string
+	Description string
+	Version     int
+	Versions    []*DocsVersion
+	Routes      []*DocsRoute
+	CsrfCookie  string
+	CsrfHeader  string
+}
+
+type DocsVersion struct {
+	Number     int
+	Deprecated bool
+}
+
+type DocsRoute struct {
+	Name        string
+	Method      string
+	Path        string
+	Description string
+	Stream      bool
+	Params      []*DocsParam
+	Example     string
+}
+
+type DocsParam struct {
+	Name        string
+	In          string
+	Type        string
+	Required    bool
+	Description string
+}
+
+// NewDocsPage describes api version for docs page. Parameters are taken
+// from OpenAPI operations, so both of them show the same thing.
+func NewDocsPage(api *Api, version int, config OpenApiConfig, baseUrl string) *DocsPage {
+	page := &DocsPage{Title: config.Title, Description: config.Description, Version: version}
+	if plugin, ok := api.GetPlugin("jwt").(*jwt.JWT); ok && plugin.CookieName != "" {
+		page.CsrfCookie = plugin.CsrfCookieName
+		page.CsrfHeader = plugin.CsrfHeader
+	}
+	if api.Version > 0 {
+		for i := api.MinVersion; i <= api.Version; i++ {
+			page.Versions = append(page.Versions, &DocsVersion{Number: i, Deprecated: api.IsDeprecated(i)})
+		}
+	}
+	prefix := ""
+	if version > 0 {
+		prefix = "/v" + strconv.Itoa(version)
+	}
+	for _, route := range api.Routes {
+		_, pathParams := openApiPath(route.Path)
+		operation := openApiOperation(api, route, version, pathParams)
+		docsRoute := &DocsRoute{
+			Name:        route.Name,
+			Method:      route.HttpMethod(),
+			Path:        prefix + route.Path,
+			Description: route.GetDescription(version),
+			Stream:      route.Stream != nil,
+		}
+		parameters, _ := operation["parameters"].([]interface{})
+		for _, value := range parameters {
+			parameter := value.(map[string]interface{})
+			docsRoute.Params = append(docsRoute.Params, newDocsParam(parameter["name"].(string), parameter["in"].(string),
+				parameter["schema"], parameter["required"].(bool)))
+		}
+		body := make(map[string]interface{})
+		if requestBody, ok := operation["requestBody"].(map[string]interface{}); ok {
+			content := requestBody["content"].(map[string]interface{})
+			schema := content["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+			if multipart, ok := content["multipart/form-data"].(map[string]interface{}); ok {
+				schema = multipart["schema"].(map[string]interface{})
+			}
+			required := make(map[string]bool)
+			if names, ok := schema["required"].([]string); ok {
+				for _, name := range names {
+					required[name] = true
+				}
+			}
+			properties, _ := schema["properties"].(map[string]interface{})
+			for _, name := range sortedKeys(properties) {
+				param := newDocsParam(name, "body", properties[name], required[name])
+				docsRoute.Params = append(docsRoute.Params, param)
+				if param.Type != "file" && param.Type != "file[]" {
+					body[name] = exampleValue(properties[name])
+				}
+			}
+		}
+		docsRoute.Example = exampleRequest(docsRoute, body, baseUrl)
+		page.Routes = append(page.Routes, docsRoute)
+	}
+	return page
+}
+
+func newDocsParam(name string, in string, schema interface{}, required bool) *DocsParam {
+	param := &DocsParam{Name: name, In: in, Required: required, Type: "string"}
+	property, _ := schema.(map[string]interface{})
+	if description, ok := property["description"].(string); ok {
+		param.Description = description
+	}
+	if propertyType, ok := property["type"].(string); ok {
+		param.Type = propertyType
+	}
+	if property["contentMediaType"] != nil {
+		param.Type = "file"
+	}
+	if items, ok := property["items"].(map[string]interface{}); ok && items["contentMediaType"] != nil {
+		param.Type = "file[]"
+	}
+	return param
+}
+
+func exampleValue(schema interface{}) interface{} {
+	property, _ := schema.(map[string]interface{})
+	if example, ok := property["example"]; ok {
+		return example
+	}
+	if values, ok := property["enum"].([]interface{}); ok && len(values) > 0 {
+		return values[0]
+	}
+	switch property["type"] {
+	case "integer":
+		return 1
+	case "number":
+		return 1.5
+	case "boolean":
+		return true
+	case "array":
+		return []interface{}{}
+	case "object":
+		return map[string]interface{}{}
+	}
+	return "string"
+}
+
+func exampleRequest(route *DocsRoute, body map[string]interface{}, baseUrl string) string {
+	path := route.Path
+	query := url.Values{}
+	for _, param := range route.Params {
+		value := fmt.Sprint(exampleValue(map[string]interface{}{"type": param.Type}))
+		if param.In == "path" {
+			path = strings.Replace(path, ":"+param.Name, value, 1)
+			path = strings.Replace(path, "*"+param.Name, value, 1)
+		}
+		if param.In == "query" && param.Required {
+			query.Set(param.Name, value)
+		}
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	command := "curl"
+	if route.Method != "GET" {
+		command += " -X " + route.Method
+	}
+	command += " '" + baseUrl + path + "'"
+	if route.Stream {
+		command += " -H 'Accept: text/event-stream'"
+	}
+	if route.Method == "POST" || route.Method == "PUT" {
+		content, _ := json.Marshal(body)
+		command += " -H 'Content-Type: application/json' -d '" + strings.Replace(string(content), "'", "'\\''", -1) + "'"
+	}
+	return command
+}
+
+func docsHandler(api *Api, config OpenApiConfig) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		version := api.Version
+		if value := r.URL.Query().Get("version"); value != "" {
+			var err error
+			version, err = strconv.Atoi(value)
+			if err != nil || version < api.MinVersion || version > api.Version {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Unknown api version: %v", value)
+				return
+			}
+		}
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		page := NewDocsPage(api, version, config, scheme+"://"+r.Host)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := docsTemplate.Execute(w, page)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+var docsTemplate = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 960px; padding: 0 20px; color: #222; }
+.route { border: 1px solid #ddd; border-radius: 4px; margin: 20px 0; padding: 10px 15px; }
+.method { display: inline-block; min-width: 60px; font-weight: bold; }
+.GET { color: #2a7ae2; } .POST { color: #2e9d4e; } .PUT { color: #c27c0e; } .DELETE { color: #c7254e; }
+.path { font-family: monospace; font-size: 1.1em; }
+table { border-collapse: collapse; width: 100%; margin: 10px 0; }
+th, td { border-bottom: 1px solid #eee; padding: 4px 8px; text-align: left; }
+pre { background: #f6f8fa; padding: 8px; overflow-x: auto; }
+.deprecated { color: #999; }
+.try input { margin: 2px 0; }
+.required { color: #c7254e; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+{{if .Versions}}<p>Versions:
+{{range .Versions}}
+  {{if eq .Number $.Version}}<strong>v{{.Number}}</strong>{{else}}<a href="?version={{.Number}}">v{{.Number}}</a>{{end}}{{if .Deprecated}} <span class="deprecated">(deprecated)</span>{{end}}
+{{end}}</p>{{end}}
+<p>Token: <input id="token" size="60" placeholder="jwt token used by try it forms"></p>
+{{range .Routes}}
+<div class="route" id="{{.Name}}">
+  <div><span class="method {{.Method}}">{{.Method}}</span> <span class="path">{{.Path}}</span> <small>{{.Name}}</small></div>
+  {{if .Description}}<p>{{.Description}}</p>{{end}}
+  {{if .Params}}
+  <table>
+    <tr><th>Parameter</th><th>In</th><th>Type</th><th>Description</th></tr>
+    {{range .Params}}<tr><td>{{.Name}}{{if .Required}} <span class="required">*</span>{{end}}</td><td>{{.In}}</td><td>{{.Type}}</td><td>{{.Description}}</td></tr>
+    {{end}}
+  </table>
+  {{end}}
+  <pre>{{.Example}}</pre>
+  {{if not .Stream}}
+  <details class="try">
+    <summary>Try it</summary>
+    <form data-method="{{.Method}}" data-path="{{.Path}}">
+      {{range .Params}}<div><label>{{.Name}} <input name="{{.Name}}" data-in="{{.In}}" data-type="{{.Type}}"{{if or (eq .Type "file") (eq .Type "file[]")}} type="file"{{if eq .Type "file[]"}} multiple{{end}}{{end}}></label></div>
+      {{end}}
+      <button type="submit">Send</button>
+    </form>
+    <pre class="result"></pre>
+  </details>
+  {{end}}
+</div>
+{{end}}
+<script>
+(function() {
+  var token = document.getElementById("token");
+  token.value = localStorage.getItem("dbservice_docs_token") || "";
+  token.addEventListener("change", function() {
+    localStorage.setItem("dbservice_docs_token", token.value);
+  });
+  function cookie(name) {
+    var match = document.cookie.match(new RegExp("(?:^|; )" + name + "=([^;]*)"));
+    return match ? decodeURIComponent(match[1]) : "";
+  }
+  function value(input) {
+    var type = input.getAttribute("data-type");
+    if (type == "integer" || type == "number") {
+      return Number(input.value);
+    }
+    if (type == "boolean") {
+      return input.value == "true";
+    }
+    if (type == "array" || type == "object") {
+      return JSON.parse(input.value);
+    }
+    return input.value;
+  }
+  Array.prototype.forEach.call(document.querySelectorAll(".try form"), function(form) {
+    form.addEventListener("submit", function(event) {
+      event.preventDefault();
+      var method = form.getAttribute("data-method");
+      var path = form.getAttribute("data-path");
+      var query = [];
+      var body = {};
+      var files = [];
+      Array.prototype.forEach.call(form.querySelectorAll("input"), function(input) {
+        var location = input.getAttribute("data-in");
+        if (input.type == "file") {
+          files.push(input);
+        } else if (location == "path") {
+          path = path.replace(/[:*][^\/]+/, function(param) {
+            return param.slice(1) == input.name ? encodeURIComponent(input.value) : param;
+          });
+        } else if (input.value !== "" && location == "query") {
+          query.push(encodeURIComponent(input.name) + "=" + encodeURIComponent(input.value));
+        } else if (input.value !== "") {
+          body[input.name] = value(input);
+        }
+      });
+      var headers = {};
+      {{if .CsrfHeader}}headers[{{.CsrfHeader}}] = cookie({{.CsrfCookie}});{{end}}
+      if (token.value) {
+        headers["Authorization"] = "Bearer " + token.value;
+      }
+      var options = {method: method, headers: headers, credentials: "same-origin"};
+      if (files.length > 0) {
+        var data = new FormData();
+        Object.keys(body).forEach(function(name) { data.append(name, body[name]); });
+        files.forEach(function(input) {
+          Array.prototype.forEach.call(input.files, function(file) { data.append(input.name, file); });
+        });
+        options.body = data;
+      } else if (method == "POST" || method == "PUT") {
+        headers["Content-Type"] = "application/json";
+        options.body = JSON.stringify(body);
+      }
+      var result = form.parentNode.querySelector(".result");
+      fetch(path + (query.length ? "?" + query.join("&") : ""), options).then(function(response) {
+        var authorization = response.headers.get("Authorization");
+        if (authorization) {
+          token.value = authorization.replace(/^Bearer /, "");
+          localStorage.setItem("dbservice_docs_token", token.value);
+        }
+        return response.text().then(function(text) {
+          result.textContent = response.status + " " + response.statusText + "\n\n" + text;
+        });
+      }).catch(function(error) {
+        result.textContent = error;
+      });
+    });
+  });
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseRouteDescription(t *testing.T) {
+	route, err := ParseRoute([]byte("get /products, name: 'get_products', description: 'Lists products: newest first, 20 per page', collection: true"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if route.Description != "Lists products: newest first, 20 per page" {
+		t.Errorf("Unexpected description: %v", route.Description)
+	}
+	if !route.Collection {
+		t.Error("Expected options after description to be parsed")
+	}
+}
+
+func TestParseRouteEscapedQuote(t *testing.T) {
+	route, err := ParseRoute([]byte("get /orders, name: 'get_orders', description: 'Returns user''s orders, newest first', collection: true"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if route.Description != "Returns user's orders, newest first" || !route.Collection {
+		t.Errorf("Unexpected route: %+v", route)
+	}
+	route, err = ParseRoute([]byte("get /orders, name: 'get_orders', description: 'Paid | shipped orders', collection: true | jwt"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if route.Description != "Paid | shipped orders" || len(route.PluginPipelines) != 1 {
+		t.Errorf("Unexpected description: %v", route.Description)
+	}
+	if !route.Collection {
+		t.Error("Expected options after description to be parsed")
+	}
+}
+
+func TestDocsPage(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	page := NewDocsPage(api, 5, OpenApiConfig{Title: "Users"}, "http://localhost:8080")
+	if len(page.Versions) != 3 || !page.Versions[0].Deprecated || page.Versions[2].Deprecated {
+		t.Errorf("Expected versions 3-5 with deprecated 3, but got %v", page.Versions)
+	}
+	createUser := page.Routes[1]
+	if createUser.Path != "/v5/users" || createUser.Description != "Create user" {
+		t.Errorf("Unexpected create_user docs: %+v", createUser)
+	}
+	if len(createUser.Params) != 2 || createUser.Params[0].Name != "email" || !createUser.Params[0].Required ||
+		createUser.Params[0].In != "body" || createUser.Params[0].Description != "User email" {
+		t.Errorf("Unexpected create_user params: %v", createUser.Params)
+	}
+	expected := `curl -X POST 'http://localhost:8080/v5/users' -H 'Content-Type: application/json' -d '{"email":"string","name":"string"}'`
+	if createUser.Example != expected {
+		t.Errorf("Expected example %v, but got %v", expected, createUser.Example)
+	}
+	updateUser := page.Routes[2]
+	if updateUser.Params[0].In != "path" || updateUser.Example != `curl -X PUT 'http://localhost:8080/v5/users/string' -H 'Content-Type: application/json' -d '{}'` {
+		t.Errorf("Unexpected update_user docs: %v %v", updateUser.Params, updateUser.Example)
+	}
+}
+
+func TestDocsHandler(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	h := docsHandler(api, OpenApiConfig{Title: "Users"})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/_docs?version=4", nil), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected to get 200 status code, but got %v", w.Code)
+	}
+	body := w.Body.String()
+	for _, part := range []string{"<title>Users</title>", "/v4/users", "<strong>v4</strong>", `href="?version=5"`, "Try it"} {
+		if !strings.Contains(body, part) {
+			t.Errorf("Expected docs page to contain %v", part)
+		}
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/_docs?version=9", nil), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected to get 400 status code for unknown version, but got %v", w.Code)
+	}
+}
@@ -0,0 +1,6 @@
+create table products(
+  id serial,
+  name text not null,
+  price integer not null,
+  status text
+);
@@ -0,0 +1,8 @@
+create extension if not exists pgcrypto;
+
+create table users(
+  id serial,
+  name text not null,
+  email text not null,
+  password text not null
+);
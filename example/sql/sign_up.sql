@@ -1,2 +1,3 @@
 INSERT INTO users (name, email, password) VALUES
-  ({{.params.name | quote}}, {{.params.email | quote}}, crypt({{.params.password | quote}}, gen_salt('bf', 10)));
+  ({{.params.name | quote}}, {{.params.email | quote}}, crypt({{.params.password | quote}}, gen_salt('bf', 10)))
+  RETURNING id, name, email
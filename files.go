@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type FileRule struct {
+	MaxSize   int64    `json:"maxSize"`
+	MimeTypes []string `json:"mimeTypes"`
+	MinCount  int      `json:"minCount"`
+	MaxCount  int      `json:"maxCount"`
+}
+
+func (self *FileRule) allowsMimeType(mimeType string) bool {
+	if len(self.MimeTypes) == 0 {
+		return true
+	}
+	for _, allowed := range self.MimeTypes {
+		if allowed == mimeType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func detectMimeType(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	buf := make([]byte, 512)
+	n, err := file.Read(buf)
+	if err != nil && n == 0 {
+		return "application/octet-stream", nil
+	}
+	mimeType := http.DetectContentType(buf[:n])
+	return strings.Split(mimeType, ";")[0], nil
+}
+
+func validateFiles(rules map[string]*FileRule, files map[string][]*multipart.FileHeader) (map[string]string, error) {
+	errors := make(map[string]string)
+	for name := range files {
+		if rules[name] == nil {
+			errors[name] = "File is not expected"
+		}
+	}
+	for name, rule := range rules {
+		headers := files[name]
+		if len(headers) < rule.MinCount {
+			errors[name] = fmt.Sprintf("At least %v file(s) required", rule.MinCount)
+			continue
+		}
+		if rule.MaxCount > 0 && len(headers) > rule.MaxCount {
+			errors[name] = fmt.Sprintf("At most %v file(s) allowed", rule.MaxCount)
+			continue
+		}
+		for _, header := range headers {
+			if rule.MaxSize > 0 && header.Size > rule.MaxSize {
+				errors[name] = fmt.Sprintf("File %v is larger than %v bytes", header.Filename, rule.MaxSize)
+				break
+			}
+			mimeType, err := detectMimeType(header)
+			if err != nil {
+				return nil, err
+			}
+			if !rule.allowsMimeType(mimeType) {
+				errors[name] = fmt.Sprintf("File %v has unsupported type %v", header.Filename, mimeType)
+				break
+			}
+		}
+	}
+	return errors, nil
+}
+
+// Uploads are validated files of request. They are stored only when request
+// is about to be executed, so rejected requests don't leave files behind.
+type Uploads struct {
+	Data    map[string]interface{}
+	storage Storage
+	files   []*upload
+}
+
+type upload struct {
+	key      string
+	mimeType string
+	header   *multipart.FileHeader
+	stored   bool
+}
+
+// PrepareFiles validates uploaded files against route rules and describes
+// them for sql template, nothing is stored yet. Validation errors are
+// returned as json string. Routes without file rules ignore uploaded files.
+func PrepareFiles(api *Api, route *Route, version int, r *http.Request) (*Uploads, string, error) {
+	var rules map[string]*FileRule
+	if routeVersion := route.Versions[route.GetAvailableVersion(version)]; routeVersion != nil {
+		rules = routeVersion.Files
+	}
+	if len(rules) == 0 {
+		return nil, "", nil
+	}
+	if api.Storage == nil {
+		return nil, "", errors.New("file storage is not configured")
+	}
+	var files map[string][]*multipart.FileHeader
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File
+	}
+	filesErrors, err := validateFiles(rules, files)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(filesErrors) > 0 {
+		errorsJson, err := json.Marshal(filesErrors)
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, string(errorsJson), nil
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	uploads := &Uploads{Data: make(map[string]interface{}), storage: api.Storage}
+	for _, name := range names {
+		described := make([]interface{}, 0, len(files[name]))
+		for _, header := range files[name] {
+			file, err := uploads.add(name, header)
+			if err != nil {
+				return nil, "", err
+			}
+			described = append(described, file)
+		}
+		if rules[name].MaxCount == 1 {
+			uploads.Data[name] = described[0]
+		} else {
+			uploads.Data[name] = described
+		}
+	}
+	return uploads, "", nil
+}
+
+func (self *Uploads) add(name string, header *multipart.FileHeader) (map[string]interface{}, error) {
+	mimeType, err := detectMimeType(header)
+	if err != nil {
+		return nil, err
+	}
+	key, err := storageKey(name, header.Filename)
+	if err != nil {
+		return nil, err
+	}
+	self.files = append(self.files, &upload{key: key, mimeType: mimeType, header: header})
+	return map[string]interface{}{
+		"key":       key,
+		"url":       self.storage.Url(key),
+		"name":      header.Filename,
+		"size":      header.Size,
+		"mime_type": mimeType,
+	}, nil
+}
+
+// Store stores files, if one of them fails, already stored ones are removed.
+func (self *Uploads) Store() error {
+	if self == nil {
+		return nil
+	}
+	for _, file := range self.files {
+		err := file.store(self.storage)
+		if err != nil {
+			self.Remove()
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes stored files, it's used when request fails after files
+// were stored.
+func (self *Uploads) Remove() {
+	if self == nil {
+		return
+	}
+	for _, file := range self.files {
+		if !file.stored {
+			continue
+		}
+		err := self.storage.Delete(file.key)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		file.stored = false
+	}
+}
+
+func (self *upload) store(storage Storage) error {
+	file, err := self.header.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = storage.Store(self.key, self.mimeType, file, self.header.Size)
+	if err != nil {
+		return err
+	}
+	self.stored = true
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func uploadRequest(t *testing.T, files map[string]string) *multipart.Form {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, content := range files {
+		part, err := writer.CreateFormFile(name, name+".bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	writer.WriteField("title", "Photo")
+	writer.Close()
+	r := httptest.NewRequest("POST", "/photos", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	params, err := getRequestParams(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["title"] != "Photo" {
+		t.Errorf("Expected to get title param from multipart body, but got: %v", params["title"])
+	}
+	return r.MultipartForm
+}
+
+func TestValidateFiles(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + string(make([]byte, 20))
+	rules, err := ParseFileRules([]byte(`{
+  "type": "object",
+  "files": {
+    "photo": {"maxSize": 100, "mimeTypes": ["image/*"], "minCount": 1, "maxCount": 1}
+  }
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := uploadRequest(t, map[string]string{"photo": png})
+	errors, err := validateFiles(rules, form.File)
+	if err != nil || len(errors) != 0 {
+		t.Errorf("Expected png photo to be valid, but got: %v %v", errors, err)
+	}
+	form = uploadRequest(t, map[string]string{"photo": "plain text"})
+	errors, _ = validateFiles(rules, form.File)
+	if errors["photo"] == "" {
+		t.Error("Expected text file to be rejected")
+	}
+	form = uploadRequest(t, map[string]string{"photo": png + string(make([]byte, 100))})
+	errors, _ = validateFiles(rules, form.File)
+	if errors["photo"] == "" {
+		t.Error("Expected large file to be rejected")
+	}
+	form = uploadRequest(t, map[string]string{"document": png})
+	errors, _ = validateFiles(rules, form.File)
+	if errors["photo"] == "" || errors["document"] == "" {
+		t.Errorf("Expected missing and unexpected files to be rejected, but got: %v", errors)
+	}
+}
+
+func TestPrepareFiles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	route := &Route{Versions: map[int]*RouteVersion{
+		0: {Files: map[string]*FileRule{"photo": {MaxCount: 1}, "attachments": {}}},
+	}}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, name := range []string{"photo", "attachments", "attachments"} {
+		part, _ := writer.CreateFormFile(name, "file.txt")
+		part.Write([]byte("hello"))
+	}
+	writer.Close()
+	r := httptest.NewRequest("POST", "/photos", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	_, err = getRequestParams(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, filesErrors, err := PrepareFiles(&Api{Storage: &LocalStorage{Directory: directory, UrlPrefix: "/uploads"}}, route, 0, r)
+	if err != nil || filesErrors != "" {
+		t.Fatalf("Not expected to get errors, but got: %v %v", filesErrors, err)
+	}
+	photo, ok := uploads.Data["photo"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected single photo file, but got: %v", uploads.Data["photo"])
+	}
+	if photo["mime_type"] != "text/plain" || photo["name"] != "file.txt" || photo["size"] != int64(5) || photo["url"] != "/uploads/"+photo["key"].(string) {
+		t.Errorf("Unexpected photo metadata: %v", photo)
+	}
+	if attachments, ok := uploads.Data["attachments"].([]interface{}); !ok || len(attachments) != 2 {
+		t.Errorf("Expected 2 attachments, but got: %v", uploads.Data["attachments"])
+	}
+	path := directory + "/" + photo["key"].(string)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected photo not to be stored before request is executed, but got: %v", err)
+	}
+	err = uploads.Store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected photo to be stored, but got: %v", err)
+	}
+	uploads.Remove()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected photo to be removed, but got: %v", err)
+	}
+	if _, _, err := PrepareFiles(&Api{}, route, 0, r); err == nil {
+		t.Error("Expected files to fail without storage")
+	}
+	uploads, filesErrors, err = PrepareFiles(&Api{}, &Route{Versions: map[int]*RouteVersion{0: {}}}, 0, r)
+	if uploads != nil || filesErrors != "" || err != nil {
+		t.Errorf("Expected route without file rules to ignore files, but got: %v %v %v", uploads, filesErrors, err)
+	}
+}
+
+func TestUploadsNotStoredForInvalidParams(t *testing.T) {
+	directory, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Storage = &LocalStorage{Directory: directory}
+	api.MaxBodySize = 1024
+	route := api.GetRoute("create_user")
+	routeVersion := route.Versions[route.GetAvailableVersion(5)]
+	routeVersion.Files = map[string]*FileRule{"avatar": {}}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("avatar", "avatar.txt")
+	part.Write([]byte("hello"))
+	writer.WriteField("name", "John")
+	writer.Close()
+	content := body.Bytes()
+	r := httptest.NewRequest("POST", "/v5/users", bytes.NewReader(content))
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	handler(api, route, 5)(w, r, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, but got %v", w.Code)
+	}
+	if files, _ := ioutil.ReadDir(directory); len(files) != 0 {
+		t.Errorf("Expected no files to be stored, but got: %v", files)
+	}
+	api.MaxBodySize = 16
+	r = httptest.NewRequest("POST", "/v5/users", bytes.NewReader(content))
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	w = httptest.NewRecorder()
+	handler(api, route, 5)(w, r, nil)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, but got %v", w.Code)
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const initConfig = `user = "postgres"
+password = ""
+database = "%v"
+host = "127.0.0.1"
+port = 5432
+sslmode = "disable"
+require_migrations = true
+`
+
+// InitProject creates config.toml, routes and the directories dbservice reads
+// from. Existing files are kept.
+func InitProject(path string) ([]string, error) {
+	created := make([]string, 0)
+	for _, dir := range []string{"", "sql", "schemas", "migrations"} {
+		dir = filepath.Join(path, dir)
+		if _, err := os.Stat(dir); err == nil {
+			continue
+		}
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return created, err
+		}
+		created = append(created, dir+string(filepath.Separator))
+	}
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return created, err
+	}
+	database := strings.Replace(filepath.Base(absolute), "-", "_", -1)
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"config.toml", fmt.Sprintf(initConfig, database)},
+		{"routes", ""},
+	}
+	for _, file := range files {
+		name := filepath.Join(path, file.name)
+		if _, err := os.Stat(name); err == nil {
+			continue
+		}
+		err = ioutil.WriteFile(name, []byte(file.content), 0644)
+		if err != nil {
+			return created, err
+		}
+		created = append(created, name)
+	}
+	return created, nil
+}
+
+type Column struct {
+	Name       string
+	DataType   string
+	Nullable   bool
+	HasDefault bool
+	PrimaryKey bool
+}
+
+func (self *Column) Integer() bool {
+	switch self.DataType {
+	case "smallint", "integer", "bigint":
+		return true
+	}
+	return false
+}
+
+func (self *Column) Schema() map[string]interface{} {
+	schema := map[string]interface{}{"type": "string"}
+	switch self.DataType {
+	case "smallint", "integer", "bigint":
+		schema["type"] = "integer"
+	case "numeric", "real", "double precision":
+		schema["type"] = "number"
+	case "boolean":
+		schema["type"] = "boolean"
+	case "uuid":
+		schema["format"] = "uuid"
+	case "date":
+		schema["format"] = "date"
+	case "timestamp with time zone", "timestamp without time zone":
+		schema["format"] = "date-time"
+	}
+	return schema
+}
+
+// Value is sql template expression that inserts parameter of the column.
+// Strings are quoted, numbers and booleans are validated by schema and
+// inserted as is.
+func (self *Column) Value() string {
+	param := templateParam(self.Name)
+	if self.Schema()["type"] == "string" {
+		return "{{" + param + " | quote}}"
+	}
+	return "{{" + param + "}}"
+}
+
+// Required columns are not null and have no default, so insert can't omit
+// them.
+func (self *Column) Required() bool {
+	return !self.Nullable && !self.HasDefault
+}
+
+var templateFieldRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func templateParam(name string) string {
+	if templateFieldRegexp.MatchString(name) {
+		return ".params." + name
+	}
+	return fmt.Sprintf("(index .params %q)", name)
+}
+
+var bareIdentifierRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+var reservedWords = map[string]bool{
+	"all": true, "and": true, "any": true, "array": true, "as": true, "asc": true, "case": true, "check": true,
+	"column": true, "constraint": true, "create": true, "default": true, "desc": true, "distinct": true, "do": true,
+	"else": true, "end": true, "except": true, "false": true, "for": true, "foreign": true, "from": true, "grant": true,
+	"group": true, "having": true, "in": true, "into": true, "limit": true, "not": true, "null": true, "offset": true,
+	"on": true, "only": true, "or": true, "order": true, "primary": true, "references": true, "select": true,
+	"table": true, "then": true, "to": true, "true": true, "union": true, "unique": true, "user": true, "using": true,
+	"when": true, "where": true, "with": true,
+}
+
+// sqlIdentifier quotes identifier when it can't be used as is. Schema
+// qualified names are quoted part by part.
+func sqlIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if !bareIdentifierRegexp.MatchString(part) || reservedWords[part] {
+			parts[i] = `"` + strings.Replace(part, `"`, `""`, -1) + `"`
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func singular(name string) string {
+	switch {
+	case strings.HasSuffix(name, "ies"):
+		return strings.TrimSuffix(name, "ies") + "y"
+	case strings.HasSuffix(name, "sses"), strings.HasSuffix(name, "xes"):
+		return strings.TrimSuffix(name, "es")
+	case strings.HasSuffix(name, "ss"):
+		return name
+	}
+	return strings.TrimSuffix(name, "s")
+}
+
+type Crud struct {
+	Resource string
+	Table    string
+	Columns  []*Column
+	Key      *Column
+}
+
+var resourceRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+func NewCrud(resource string, table string, columns []*Column) (*Crud, error) {
+	if !resourceRegexp.MatchString(resource) {
+		return nil, errors.New("resource name can only have lowercase letters, digits and underscores")
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %v not found", table)
+	}
+	crud := &Crud{Resource: resource, Table: table, Columns: columns}
+	for _, column := range columns {
+		if column.PrimaryKey {
+			if crud.Key != nil {
+				return nil, fmt.Errorf("table %v has composite primary key, which is not supported", table)
+			}
+			crud.Key = column
+		}
+	}
+	if crud.Key == nil {
+		for _, column := range columns {
+			if column.Name == "id" {
+				crud.Key = column
+			}
+		}
+	}
+	if crud.Key == nil {
+		return nil, fmt.Errorf("table %v has no primary key or id column", table)
+	}
+	if !resourceRegexp.MatchString(crud.Key.Name) {
+		return nil, fmt.Errorf("primary key %v can't be used as path parameter", crud.Key.Name)
+	}
+	return crud, nil
+}
+
+func (self *Crud) RouteNames() []string {
+	one := singular(self.Resource)
+	return []string{"get_" + self.Resource, "get_" + one, "create_" + one, "update_" + one, "delete_" + one}
+}
+
+func (self *Crud) Routes() string {
+	names := self.RouteNames()
+	collection := "/" + self.Resource
+	member := collection + "/:" + self.Key.Name
+	return fmt.Sprintf(`get %v, name: '%v', collection: true
+get %v, name: '%v'
+post %v, name: '%v'
+put %v, name: '%v'
+delete %v, name: '%v'
+`, collection, names[0], member, names[1], collection, names[2], member, names[3], member, names[4])
+}
+
+// writable columns can be set by create and update routes, columns with
+// defaults are optional. Key is set only on create when it has no default.
+func (self *Crud) writable(create bool) []*Column {
+	columns := make([]*Column, 0, len(self.Columns))
+	for _, column := range self.Columns {
+		if column == self.Key && (column.HasDefault || !create) {
+			continue
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+func (self *Crud) keyCondition() string {
+	value := "{{" + templateParam(self.Key.Name) + " | quote}}"
+	if self.Key.Integer() {
+		value = "{{" + templateParam(self.Key.Name) + "}}"
+	}
+	return sqlIdentifier(self.Key.Name) + "=" + value
+}
+
+func optional(column *Column, sql string) string {
+	return "{{if ne " + templateParam(column.Name) + " nil}}" + sql + "{{end}}"
+}
+
+func (self *Crud) insertSql() string {
+	names := make([]string, 0)
+	values := make([]string, 0)
+	var optionalNames, optionalValues string
+	for _, column := range self.writable(true) {
+		if column.Required() {
+			names = append(names, sqlIdentifier(column.Name))
+			values = append(values, column.Value())
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, sqlIdentifier(self.Key.Name))
+		values = append(values, "default")
+	}
+	for _, column := range self.writable(true) {
+		if !column.Required() {
+			optionalNames += optional(column, ", "+sqlIdentifier(column.Name))
+			optionalValues += optional(column, ", "+column.Value())
+		}
+	}
+	return fmt.Sprintf("insert into %v (%v%v) values (%v%v) returning *\n",
+		sqlIdentifier(self.Table), strings.Join(names, ", "), optionalNames, strings.Join(values, ", "), optionalValues)
+}
+
+func (self *Crud) updateSql() string {
+	assignments := make([]string, 0)
+	optionalAssignments := ""
+	for _, column := range self.writable(false) {
+		if column.Required() {
+			assignments = append(assignments, sqlIdentifier(column.Name)+"="+column.Value())
+		} else {
+			optionalAssignments += optional(column, ", "+sqlIdentifier(column.Name)+"="+column.Value())
+		}
+	}
+	if len(assignments) == 0 {
+		key := sqlIdentifier(self.Key.Name)
+		assignments = append(assignments, key+"="+key)
+	}
+	return fmt.Sprintf("update %v set %v%v where %v returning *\n",
+		sqlIdentifier(self.Table), strings.Join(assignments, ", "), optionalAssignments, self.keyCondition())
+}
+
+func (self *Crud) Sql() map[string]string {
+	names := self.RouteNames()
+	table := sqlIdentifier(self.Table)
+	return map[string]string{
+		names[0]: fmt.Sprintf("select * from %v order by %v\n", table, sqlIdentifier(self.Key.Name)),
+		names[1]: fmt.Sprintf("select * from %v where %v\n", table, self.keyCondition()),
+		names[2]: self.insertSql(),
+		names[3]: self.updateSql(),
+		names[4]: fmt.Sprintf("delete from %v where %v returning *\n", table, self.keyCondition()),
+	}
+}
+
+func humanize(name string) string {
+	name = strings.Replace(name, "_", " ", -1)
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func (self *Crud) keySchema() map[string]interface{} {
+	schema := self.Key.Schema()
+	if self.Key.Integer() {
+		schema = map[string]interface{}{"type": "string", "pattern": `^\d+$`}
+	}
+	schema["description"] = humanize(singular(self.Resource)) + " " + strings.Replace(self.Key.Name, "_", " ", -1)
+	return schema
+}
+
+func (self *Crud) schema(title string, withKey bool, withColumns bool) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	if withColumns {
+		for _, column := range self.writable(!withKey) {
+			schema := column.Schema()
+			schema["description"] = humanize(singular(self.Resource)) + " " + strings.Replace(column.Name, "_", " ", -1)
+			properties[column.Name] = schema
+			if column.Required() {
+				required = append(required, column.Name)
+			}
+		}
+	}
+	if withKey {
+		properties[self.Key.Name] = self.keySchema()
+		required = append([]string{self.Key.Name}, required...)
+	}
+	schema := map[string]interface{}{
+		"title":       title,
+		"description": title,
+		"type":        "object",
+		"properties":  properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Schemas are generated for every route except collection, which takes no
+// parameters.
+func (self *Crud) Schemas() map[string]string {
+	names := self.RouteNames()
+	one := strings.Replace(singular(self.Resource), "_", " ", -1)
+	schemas := map[string]map[string]interface{}{
+		names[1]: self.schema("Get "+one, true, false),
+		names[2]: self.schema("Create "+one, false, true),
+		names[3]: self.schema("Update "+one, true, true),
+		names[4]: self.schema("Delete "+one, true, false),
+	}
+	files := make(map[string]string)
+	for name, schema := range schemas {
+		content, _ := json.MarshalIndent(schema, "", "  ")
+		files[name] = string(content) + "\n"
+	}
+	return files
+}
+
+// Files returns generated sql templates and schemas by path relative to
+// project directory.
+func (self *Crud) Files() map[string]string {
+	files := make(map[string]string)
+	for name, content := range self.Sql() {
+		files[filepath.Join("sql", name+".sql")] = content
+	}
+	for name, content := range self.Schemas() {
+		files[filepath.Join("schemas", name+".schema")] = content
+	}
+	return files
+}
+
+// Write adds routes to routes file and creates sql templates and schemas.
+// Nothing is written if any of the routes or files already exists.
+func (self *Crud) Write(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(path, "routes"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	api := &Api{}
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if ok, _ := ParseApiSettings(api, line); ok {
+			continue
+		}
+		route, err := ParseRoute(line)
+		if err != nil {
+			return nil, err
+		}
+		existing[route.Name] = true
+	}
+	for _, name := range self.RouteNames() {
+		if existing[name] {
+			return nil, fmt.Errorf("route %v already exists", name)
+		}
+	}
+	files := self.Files()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			return nil, fmt.Errorf("%v already exists", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = os.MkdirAll(filepath.Join(path, filepath.Dir(name)), 0755)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(filepath.Join(path, name), []byte(files[name]), 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+	if len(bytes.TrimSpace(content)) > 0 {
+		content = append(content, '\n')
+	}
+	content = append(content, self.Routes()...)
+	err = ioutil.WriteFile(filepath.Join(path, "routes"), content, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return append(names, "routes"), nil
+}
+
+// TableColumns introspects table through information_schema. Table may be
+// schema qualified, otherwise it's looked up in current schema.
+func TableColumns(db *sql.DB, table string) ([]*Column, error) {
+	schema, name := "", table
+	if i := strings.Index(table, "."); i != -1 {
+		schema, name = table[:i], table[i+1:]
+	}
+	rows, err := db.Query(`select c.column_name, c.data_type, c.is_nullable = 'YES',
+  c.column_default is not null or c.is_identity = 'YES',
+  exists (
+    select 1 from information_schema.table_constraints tc
+    join information_schema.key_column_usage k
+      on k.constraint_schema = tc.constraint_schema and k.constraint_name = tc.constraint_name
+    where tc.constraint_type = 'PRIMARY KEY' and tc.table_schema = c.table_schema
+      and tc.table_name = c.table_name and k.column_name = c.column_name
+  )
+from information_schema.columns c
+where c.table_schema = coalesce(nullif($1, ''), current_schema()) and c.table_name = $2
+order by c.ordinal_position`, schema, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make([]*Column, 0)
+	for rows.Next() {
+		column := &Column{}
+		err = rows.Scan(&column.Name, &column.DataType, &column.Nullable, &column.HasDefault, &column.PrimaryKey)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+func initCommand(args []string) error {
+	path := "."
+	if len(args) > 1 {
+		return errors.New("usage: dbservice init [dir]")
+	}
+	if len(args) == 1 {
+		path = args[0]
+	}
+	created, err := InitProject(path)
+	for _, name := range created {
+		fmt.Printf("Created %v\n", name)
+	}
+	return err
+}
+
+func generateCommand(args []string) error {
+	usage := errors.New("usage: dbservice generate crud <resource> [-table name]")
+	if len(args) < 2 || args[0] != "crud" || strings.HasPrefix(args[1], "-") {
+		return usage
+	}
+	resource := args[1]
+	flags := flag.NewFlagSet("generate crud", flag.ExitOnError)
+	table := flags.String("table", resource, "table to generate routes for")
+	flags.Parse(args[2:])
+	if flags.NArg() != 0 {
+		return usage
+	}
+	db, err := GetDbConnection()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	columns, err := TableColumns(db, *table)
+	if err != nil {
+		return err
+	}
+	crud, err := NewCrud(resource, *table, columns)
+	if err != nil {
+		return err
+	}
+	written, err := crud.Write(".")
+	if err != nil {
+		return err
+	}
+	for _, name := range written {
+		fmt.Printf("Wrote %v\n", name)
+	}
+	return nil
+}
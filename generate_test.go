@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func productColumns() []*Column {
+	return []*Column{
+		{Name: "id", DataType: "integer", HasDefault: true, PrimaryKey: true},
+		{Name: "name", DataType: "text"},
+		{Name: "price", DataType: "integer"},
+		{Name: "status", DataType: "text", Nullable: true},
+		{Name: "order", DataType: "boolean", HasDefault: true},
+	}
+}
+
+func TestCrudSql(t *testing.T) {
+	crud, err := NewCrud("products", "products", productColumns())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"get_products":   "select * from products order by id\n",
+		"get_product":    "select * from products where id={{.params.id}}\n",
+		"create_product": `insert into products (name, price{{if ne .params.status nil}}, status{{end}}{{if ne .params.order nil}}, "order"{{end}}) values ({{.params.name | quote}}, {{.params.price}}{{if ne .params.status nil}}, {{.params.status | quote}}{{end}}{{if ne .params.order nil}}, {{.params.order}}{{end}}) returning *` + "\n",
+		"update_product": `update products set name={{.params.name | quote}}, price={{.params.price}}{{if ne .params.status nil}}, status={{.params.status | quote}}{{end}}{{if ne .params.order nil}}, "order"={{.params.order}}{{end}} where id={{.params.id}} returning *` + "\n",
+		"delete_product": "delete from products where id={{.params.id}} returning *\n",
+	}
+	for name, sql := range crud.Sql() {
+		if sql != expected[name] {
+			t.Errorf("Expected %v sql to be %v, but got %v", name, expected[name], sql)
+		}
+	}
+}
+
+func TestCrudKey(t *testing.T) {
+	columns := []*Column{
+		{Name: "code", DataType: "text", PrimaryKey: true},
+		{Name: "note", DataType: "text", Nullable: true},
+	}
+	crud, err := NewCrud("categories", "shop.categories", columns)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if names := strings.Join(crud.RouteNames(), " "); names != "get_categories get_category create_category update_category delete_category" {
+		t.Errorf("Unexpected route names: %v", names)
+	}
+	sql := crud.Sql()
+	if sql["create_category"] != "insert into shop.categories (code{{if ne .params.note nil}}, note{{end}}) values ({{.params.code | quote}}{{if ne .params.note nil}}, {{.params.note | quote}}{{end}}) returning *\n" {
+		t.Errorf("Unexpected create sql: %v", sql["create_category"])
+	}
+	if sql["update_category"] != "update shop.categories set code=code{{if ne .params.note nil}}, note={{.params.note | quote}}{{end}} where code={{.params.code | quote}} returning *\n" {
+		t.Errorf("Unexpected update sql: %v", sql["update_category"])
+	}
+	columns[0].PrimaryKey = false
+	_, err = NewCrud("categories", "categories", columns)
+	if err == nil {
+		t.Errorf("Expected to get error for table without primary key")
+	}
+	_, err = NewCrud("categories", "categories", nil)
+	if err == nil {
+		t.Errorf("Expected to get error for missing table")
+	}
+}
+
+func TestSqlIdentifier(t *testing.T) {
+	for name, expected := range map[string]string{
+		"products":       "products",
+		"user":           `"user"`,
+		"Products":       `"Products"`,
+		`we"ird`:         `"we""ird"`,
+		"app.line_items": "app.line_items",
+		"app.order":      `app."order"`,
+	} {
+		if identifier := sqlIdentifier(name); identifier != expected {
+			t.Errorf("Expected %v to be quoted as %v, but got %v", name, expected, identifier)
+		}
+	}
+}
+
+func TestInitAndGenerateCrud(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	created, err := InitProject(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(created) != 5 {
+		t.Errorf("Expected to create 5 files and directories, but got %v", created)
+	}
+	crud, err := NewCrud("products", "products", productColumns())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = crud.Write(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	api, err := ParseRoutes(dir)
+	if err != nil {
+		t.Fatalf("Expected generated routes to parse, but got: %v", err)
+	}
+	if len(api.Routes) != 5 {
+		t.Fatalf("Expected to get 5 routes, but got %v", len(api.Routes))
+	}
+	update := api.GetRoute("update_product")
+	if update.Method != "PUT" || update.Path != "/products/:id" || update.Versions[0].Schema == nil {
+		t.Errorf("Unexpected update route: %+v", update)
+	}
+	response, _ := update.validate(map[string]interface{}{"id": "1", "name": "Pen"}, 0)
+	if response == "" {
+		t.Errorf("Expected update without price to be invalid")
+	}
+	response, _ = update.validate(map[string]interface{}{"id": "1", "name": "Pen", "price": 5}, 0)
+	if response != "" {
+		t.Errorf("Expected update to be valid, but got %v", response)
+	}
+	params := map[string]interface{}{"id": "1", "name": "Pen's", "price": 5, "order": false}
+	query, err := update.Sql(map[string]interface{}{"params": params}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(query, `update products set name='Pen''s', price=5, "order"=false where id=1 returning *`) {
+		t.Errorf("Unexpected update query: %v", query)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "schemas", "create_product.schema"))
+	if !strings.Contains(string(content), `"required": [
+    "name",
+    "price"
+  ]`) {
+		t.Errorf("Unexpected create schema: %s", content)
+	}
+	_, err = crud.Write(dir)
+	if err == nil {
+		t.Errorf("Expected to get error when routes already exist")
+	}
+	created, err = InitProject(dir)
+	if err != nil || len(created) != 0 {
+		t.Errorf("Expected init to keep existing files, but got %v, %v", created, err)
+	}
+}
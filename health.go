@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"time"
+)
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Readiness checks whether server can serve requests. Health and readiness
+// handlers are registered outside of routes, so plugins (auth included) and
+// metrics don't apply to them.
+type Readiness struct {
+	Timeout time.Duration
+	checks  []*readinessCheck
+}
+
+func (self *Readiness) Add(name string, check func(ctx context.Context) error) {
+	self.checks = append(self.checks, &readinessCheck{name: name, check: check})
+}
+
+// Run runs checks one by one until timeout is reached, checks that didn't
+// finish in time fail.
+func (self *Readiness) Run() (bool, map[string]string) {
+	ctx, cancel := context.WithTimeout(context.Background(), self.Timeout)
+	defer cancel()
+	ready := true
+	results := make(map[string]string)
+	for _, check := range self.checks {
+		done := make(chan error, 1)
+		go func(check *readinessCheck) {
+			done <- check.check(ctx)
+		}(check)
+		select {
+		case err := <-done:
+			results[check.name] = "ok"
+			if err != nil {
+				results[check.name] = err.Error()
+				ready = false
+			}
+		case <-ctx.Done():
+			results[check.name] = "timeout"
+			ready = false
+		}
+	}
+	return ready, results
+}
+
+func NewReadiness(api *Api, db *sql.DB, timeout time.Duration) *Readiness {
+	readiness := &Readiness{Timeout: timeout}
+	readiness.Add("database", func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	})
+	migrator, migratorErr := NewMigrator(".", db)
+	readiness.Add("migrations", func(ctx context.Context) error {
+		if migratorErr != nil {
+			return migratorErr
+		}
+		if len(migrator.Migrations) == 0 {
+			return nil
+		}
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%v pending migrations", len(pending))
+		}
+		return nil
+	})
+	readiness.Add("routes", func(ctx context.Context) error {
+		if len(api.Routes) == 0 {
+			return errors.New("no routes loaded")
+		}
+		return nil
+	})
+	return readiness
+}
+
+func writeHealth(w http.ResponseWriter, status int, body map[string]interface{}) {
+	content, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeHealth(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+func readyHandler(readiness *Readiness) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ready, checks := readiness.Run()
+		if !ready {
+			writeHealth(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "checks": checks})
+			return
+		}
+		writeHealth(w, http.StatusOK, map[string]interface{}{"status": "ok", "checks": checks})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest("GET", "/_health", nil), nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"status":"ok"}` {
+		t.Errorf("Unexpected response: %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	readiness := &Readiness{Timeout: 50 * time.Millisecond}
+	readiness.Add("database", func(ctx context.Context) error {
+		return nil
+	})
+	w := httptest.NewRecorder()
+	readyHandler(readiness)(w, httptest.NewRequest("GET", "/_ready", nil), nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, but got %v", w.Code)
+	}
+	readiness.Add("migrations", func(ctx context.Context) error {
+		return errors.New("2 pending migrations")
+	})
+	readiness.Add("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	w = httptest.NewRecorder()
+	readyHandler(readiness)(w, httptest.NewRequest("GET", "/_ready", nil), nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503, but got %v", w.Code)
+	}
+	body := struct {
+		Status string
+		Checks map[string]string
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	expected := map[string]string{"database": "ok", "migrations": "2 pending migrations", "slow": "timeout"}
+	if body.Status != "unavailable" || !reflect.DeepEqual(body.Checks, expected) {
+		t.Errorf("Unexpected response: %v", w.Body.String())
+	}
+}
+
+func TestHealthConfig(t *testing.T) {
+	config, err := ParseConfig("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Health.HealthPath != "/_health" || config.Health.ReadyPath != "/_ready" || config.Health.Timeout.Duration != 2*time.Second {
+		t.Errorf("Unexpected health config: %+v", config.Health)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gophergala2016/dbserver/plugins"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const jobsTable = "dbservice_jobs"
+
+type Job struct {
+	*Route
+	Retries int
+	Backoff time.Duration
+}
+
+// RetryDelay returns delay before job is run again after it failed given
+// number of times.
+func (self *Job) RetryDelay(attempts int) time.Duration {
+	return plugins.Backoff(self.Backoff, attempts)
+}
+
+type JobQueue struct {
+	Jobs         []*Job
+	Workers      int
+	PollInterval time.Duration
+}
+
+type JobRequest struct {
+	Job    string                 `json:"job"`
+	Params map[string]interface{} `json:"params"`
+	Delay  string                 `json:"delay"`
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (self *JobQueue) GetJob(name string) *Job {
+	for _, job := range self.Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+func (self *JobQueue) Enqueue(e execer, request *JobRequest) error {
+	if self.GetJob(request.Job) == nil {
+		return fmt.Errorf("Unknown job: %v", request.Job)
+	}
+	var delay time.Duration
+	if request.Delay != "" {
+		var err error
+		delay, err = time.ParseDuration(request.Delay)
+		if err != nil {
+			return err
+		}
+	}
+	params := request.Params
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	paramsJson, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	_, err = e.Exec("insert into "+jobsTable+" (job, params, run_at) values ($1, $2, now() + $3 * interval '1 microsecond')",
+		request.Job, string(paramsJson), delay.Nanoseconds()/1000)
+	return err
+}
+
+// EnqueueResultJobs enqueues jobs listed in __jobs key of result object and
+// removes the key from result.
+func (self *JobQueue) EnqueueResultJobs(e execer, jsonValue string) (string, error) {
+	if !strings.Contains(jsonValue, `"__jobs"`) {
+		return jsonValue, nil
+	}
+	data := make(map[string]interface{})
+	if json.Unmarshal([]byte(jsonValue), &data) != nil || data["__jobs"] == nil {
+		return jsonValue, nil
+	}
+	requests, err := parseJobRequests(data["__jobs"])
+	if err != nil {
+		return "", err
+	}
+	for _, request := range requests {
+		err = self.Enqueue(e, request)
+		if err != nil {
+			return "", err
+		}
+	}
+	delete(data, "__jobs")
+	dataJson, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return string(dataJson), nil
+}
+
+// EnqueueRouteJobs enqueues jobs requested by route result: jobs listed in
+// __jobs key and jobs of enqueue plugins in route pipeline. It's called in
+// route transaction, so jobs are enqueued only if result is committed.
+func (self *JobQueue) EnqueueRouteJobs(e execer, route *Route, jsonValue string) (string, error) {
+	jsonValue, err := self.EnqueueResultJobs(e, jsonValue)
+	if err != nil {
+		return "", err
+	}
+	for _, pp := range route.PluginPipelines {
+		if pp.Name != "enqueue" {
+			continue
+		}
+		params := make(map[string]interface{})
+		// Only single objects are enqueued, same as they are passed to plugins.
+		if json.Unmarshal([]byte(jsonValue), &params) != nil {
+			return jsonValue, nil
+		}
+		request := &JobRequest{Params: params}
+		request.Job, _ = pp.Argument["job"].(string)
+		request.Delay, _ = pp.Argument["delay"].(string)
+		err = self.Enqueue(e, request)
+		if err != nil {
+			return "", err
+		}
+	}
+	return jsonValue, nil
+}
+
+// routeJobs returns hook that enqueues jobs of route result in its
+// transaction.
+func routeJobs(api *Api, route *Route) resultHook {
+	if api.JobQueue == nil || len(api.JobQueue.Jobs) == 0 {
+		return nil
+	}
+	return func(tx *sql.Tx, value string) (string, error) {
+		return api.JobQueue.EnqueueRouteJobs(tx, route, value)
+	}
+}
+
+func parseJobRequests(value interface{}) ([]*JobRequest, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	requests := make([]*JobRequest, 0)
+	err = json.Unmarshal(content, &requests)
+	if err != nil {
+		return nil, fmt.Errorf("__jobs should be array of jobs: %v", err)
+	}
+	return requests, nil
+}
+
+func (self *JobQueue) CreateTable(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists ` + jobsTable + ` (
+  id bigserial primary key,
+  job text not null,
+  params jsonb not null default '{}',
+  status text not null default 'pending',
+  attempts integer not null default 0,
+  last_error text,
+  run_at timestamptz not null default now(),
+  created_at timestamptz not null default now(),
+  updated_at timestamptz not null default now()
+)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`create index if not exists ` + jobsTable + `_pending_idx on ` + jobsTable + ` (run_at) where status = 'pending'`)
+	return err
+}
+
+func (self *JobQueue) Start(api *Api, db *sql.DB) {
+	for i := 0; i < self.Workers; i++ {
+		go func() {
+			for {
+				found, err := self.work(api, db)
+				if err != nil {
+					log.Printf("Job worker error: %v\n", err)
+				}
+				if !found || err != nil {
+					time.Sleep(self.PollInterval)
+				}
+			}
+		}()
+	}
+}
+
+// work runs single job. Job row stays locked until job is done, so other
+// workers (and other dbservice instances) skip it.
+func (self *JobQueue) work(api *Api, db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var id int64
+	var name string
+	var paramsJson string
+	var attempts int
+	err = tx.QueryRow(`select id, job, params, attempts from `+jobsTable+`
+where status = 'pending' and run_at <= now()
+order by run_at, id limit 1 for update skip locked`).Scan(&id, &name, &paramsJson, &attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	attempts++
+	start := time.Now()
+	job := self.GetJob(name)
+	if job == nil {
+		err = fmt.Errorf("Unknown job: %v", name)
+	} else {
+		_, err = tx.Exec("savepoint job")
+		if err != nil {
+			return true, err
+		}
+		err = self.run(api, tx, job, id, attempts, paramsJson)
+		if err != nil {
+			_, rollbackErr := tx.Exec("rollback to savepoint job")
+			if rollbackErr != nil {
+				return true, rollbackErr
+			}
+		}
+	}
+	if err == nil {
+		log.Printf("Job %v #%v took %s\n", name, id, time.Since(start))
+		_, err = tx.Exec("delete from "+jobsTable+" where id = $1", id)
+		if err != nil {
+			return true, err
+		}
+		return true, tx.Commit()
+	}
+	log.Printf("Job %v #%v failed (attempt %v): %v\n", name, id, attempts, err)
+	if job == nil || attempts >= job.Retries {
+		_, err = tx.Exec("update "+jobsTable+" set status = 'dead', attempts = $2, last_error = $3, updated_at = now() where id = $1",
+			id, attempts, err.Error())
+	} else {
+		_, err = tx.Exec("update "+jobsTable+" set attempts = $2, last_error = $3, run_at = now() + $4 * interval '1 microsecond', updated_at = now() where id = $1",
+			id, attempts, err.Error(), job.RetryDelay(attempts).Nanoseconds()/1000)
+	}
+	if err != nil {
+		return true, err
+	}
+	return true, tx.Commit()
+}
+
+func (self *JobQueue) run(api *Api, tx *sql.Tx, job *Job, id int64, attempt int, paramsJson string) error {
+	params := make(map[string]interface{})
+	err := json.Unmarshal([]byte(paramsJson), &params)
+	if err != nil {
+		return err
+	}
+	data := map[string]interface{}{
+		"params": params,
+		"job":    map[string]interface{}{"id": id, "attempt": attempt},
+	}
+	query, err := job.Sql(data, 0)
+	if err != nil && query != "" {
+		return fmt.Errorf("%v: %v", err, query)
+	}
+	if err != nil {
+		return err
+	}
+	value, _, err := queryJson(tx, query)
+	if err != nil {
+		return err
+	}
+	if !value.Valid {
+		return nil
+	}
+	jsonValue, err := self.EnqueueRouteJobs(tx, job.Route, value.String)
+	if err != nil {
+		return err
+	}
+	if len(job.PluginPipelines) == 0 {
+		return nil
+	}
+	_, response, err := runPipelines(context.Background(), api, jsonValue, job.PluginPipelines, make(http.Header))
+	if err != nil {
+		return err
+	}
+	if response != nil {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// enqueuePlugin marks routes that enqueue their result as job. Jobs are
+// enqueued by EnqueueRouteJobs in route transaction, plugin only passes
+// result through.
+type enqueuePlugin struct {
+	queue *JobQueue
+}
+
+func (self *enqueuePlugin) ParseConfig(path string) error {
+	return nil
+}
+
+func (self *enqueuePlugin) Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response {
+	return &plugins.Response{Data: data}
+}
+
+func (self *enqueuePlugin) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	return nil
+}
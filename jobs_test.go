@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeExecer struct {
+	args [][]interface{}
+}
+
+func (self *fakeExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	self.args = append(self.args, args)
+	return nil, nil
+}
+
+func TestParseJobs(t *testing.T) {
+	queue, err := ParseJobs("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if queue.Workers != 2 {
+		t.Errorf("Expected to get 2 workers, but got %v", queue.Workers)
+	}
+	if queue.PollInterval != 500*time.Millisecond {
+		t.Errorf("Expected to get 500ms poll interval, but got %v", queue.PollInterval)
+	}
+	if len(queue.Jobs) != 2 {
+		t.Fatalf("Expected to get 2 jobs, but got %v", len(queue.Jobs))
+	}
+	job := queue.GetJob("send_receipt")
+	if job == nil {
+		t.Fatal("Expected to get send_receipt job, but got nil")
+	}
+	if job.Retries != 3 || job.Backoff != time.Minute {
+		t.Errorf("Expected to get 3 retries with 1m backoff, but got %v with %v", job.Retries, job.Backoff)
+	}
+	query, err := job.Sql(map[string]interface{}{"params": map[string]interface{}{"id": 7}}, 0)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if query != "with response_table as (update orders set receipt_sent_at = now() where id = 7 returning id) select row_to_json(t) as value from (select * from response_table) t" {
+		t.Errorf("Unexpected job sql: %v", query)
+	}
+	cleanup := queue.GetJob("cleanup_sessions")
+	if cleanup.Retries != 5 || !cleanup.Collection || len(cleanup.PluginPipelines) != 1 {
+		t.Errorf("Unexpected cleanup_sessions job: %+v", cleanup)
+	}
+}
+
+func TestParseJobOptions(t *testing.T) {
+	job, err := ParseJob([]byte("job notify, backoff: '1m', retries: 2 | email {\"template\": \"notify\", \"to\": \"email\"}"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if job.Backoff != time.Minute || job.Retries != 2 || len(job.PluginPipelines) != 1 || job.PluginPipelines[0].Argument["to"] != "email" {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+	// Quoted value is kept whole, so it fails as duration.
+	_, err = ParseJob([]byte("job notify, backoff: '1m,|2m'"))
+	if err == nil || !strings.Contains(err.Error(), "1m,|2m") {
+		t.Errorf("Expected invalid backoff error, but got: %v", err)
+	}
+	for _, line := range []string{
+		"job notify, backoff: '0s'",
+		"job notify, retries: -1",
+	} {
+		if _, err := ParseJob([]byte(line)); err == nil {
+			t.Errorf("Expected %v to be invalid", line)
+		}
+	}
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, content := range []string{"workers: 0", "poll_interval: '0s'"} {
+		ioutil.WriteFile(filepath.Join(dir, "jobs"), []byte(content), 0644)
+		if _, err := ParseJobs(dir); err == nil {
+			t.Errorf("Expected %v to be invalid", content)
+		}
+	}
+}
+
+func TestJobRetryDelay(t *testing.T) {
+	job := &Job{Backoff: 10 * time.Second}
+	if job.RetryDelay(1) != 10*time.Second {
+		t.Errorf("Expected to get 10s delay, but got %v", job.RetryDelay(1))
+	}
+	if job.RetryDelay(4) != 80*time.Second {
+		t.Errorf("Expected to get 80s delay, but got %v", job.RetryDelay(4))
+	}
+}
+
+func TestEnqueueResultJobs(t *testing.T) {
+	queue, err := ParseJobs("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	execer := &fakeExecer{}
+	value, err := queue.EnqueueResultJobs(execer, `{"id": 1, "__jobs": [{"job": "send_receipt", "params": {"id": 1}, "delay": "1s"}]}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if value != `{"id":1}` {
+		t.Errorf("Expected __jobs to be removed from result, but got %v", value)
+	}
+	if len(execer.args) != 1 {
+		t.Fatalf("Expected to enqueue 1 job, but got %v", len(execer.args))
+	}
+	if execer.args[0][0] != "send_receipt" || execer.args[0][1] != `{"id":1}` || execer.args[0][2] != int64(1000000) {
+		t.Errorf("Unexpected enqueue arguments: %v", execer.args[0])
+	}
+	_, err = queue.EnqueueResultJobs(execer, `{"__jobs": [{"job": "unknown"}]}`)
+	if err == nil {
+		t.Error("Expected to get error for unknown job, but got nil")
+	}
+	value, err = queue.EnqueueResultJobs(execer, `[{"id": 1}]`)
+	if err != nil || value != `[{"id": 1}]` {
+		t.Errorf("Expected collection result to stay untouched, but got %v, %v", value, err)
+	}
+}
+
+func TestEnqueueRouteJobs(t *testing.T) {
+	queue, err := ParseJobs("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	route := &Route{PluginPipelines: []*PluginPipeline{
+		{Name: "jwt"},
+		{Name: "enqueue", Argument: map[string]interface{}{"job": "send_receipt", "delay": "1s"}},
+	}}
+	execer := &fakeExecer{}
+	value, err := queue.EnqueueRouteJobs(execer, route, `{"id": 1, "__jobs": [{"job": "send_receipt", "params": {"id": 2}}]}`)
+	if err != nil || value != `{"id":1}` {
+		t.Fatalf("Unexpected result: %v, %v", value, err)
+	}
+	if len(execer.args) != 2 || execer.args[0][1] != `{"id":2}` || execer.args[1][1] != `{"id":1}` {
+		t.Errorf("Expected result jobs and enqueue plugin job, but got %v", execer.args)
+	}
+	execer = &fakeExecer{}
+	_, err = queue.EnqueueRouteJobs(execer, route, `[{"id": 1}]`)
+	if err != nil || len(execer.args) != 0 {
+		t.Errorf("Expected collection not to be enqueued, but got %v, %v", execer.args, err)
+	}
+}
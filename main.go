@@ -1,30 +1,54 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gophergala2016/dbserver/plugins"
+	"github.com/gophergala2016/dbserver/plugins/apikey"
+	"github.com/gophergala2016/dbserver/plugins/cors"
+	"github.com/gophergala2016/dbserver/plugins/email"
+	"github.com/gophergala2016/dbserver/plugins/html"
 	"github.com/gophergala2016/dbserver/plugins/jwt"
+	"github.com/gophergala2016/dbserver/plugins/ratelimit"
+	"github.com/gophergala2016/dbserver/plugins/webhook"
 	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
-	"io/ioutil"
 )
 
+const maxMemory = 32 << 20
+
 func getRequestParams(r *http.Request, urlParams map[string]interface{}) (map[string]interface{}, error) {
 	params := make(map[string]interface{})
-	err := r.ParseForm()
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = r.ParseMultipartForm(maxMemory)
+	} else {
+		err = r.ParseForm()
+	}
 	if err != nil {
 		return nil, err
 	}
 	for k, v := range r.Form {
-		if len(v) >= 1 {
+		if len(v) == 1 {
 			params[k] = v[0]
+		} else if len(v) > 1 {
+			values := make([]interface{}, 0, len(v))
+			for _, value := range v {
+				values = append(values, value)
+			}
+			params[k] = values
 		}
 	}
 	if r.Header.Get("Content-Type") == "application/json" {
@@ -50,12 +74,20 @@ func handler(api *Api, route *Route, version int) func(http.ResponseWriter, *htt
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		var err error
 		apiVersion := version
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		w = recorder
+		r, span := startRequestSpan(r, route, version)
+		defer func() {
+			observeRequest(route, apiVersion, recorder, start)
+			endRequestSpan(span, apiVersion, recorder)
+		}()
 		headerVersion := r.Header.Get("api-version")
 		if apiVersion == 0 && headerVersion != "" {
 			apiVersion, err = strconv.Atoi(headerVersion)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
-				log.Println("Unknown api version: %v", r.Header.Get("api-version"))
+				log.Printf("Unknown api version: %v\n", r.Header.Get("api-version"))
 				return
 			}
 		}
@@ -65,7 +97,7 @@ func handler(api *Api, route *Route, version int) func(http.ResponseWriter, *htt
 				apiVersion, err = strconv.Atoi(matches[0][1])
 				if err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
-					log.Println("Unknown api version: %v", matches[0][1])
+					log.Printf("Unknown api version: %v\n", matches[0][1])
 				}
 			}
 		}
@@ -76,16 +108,41 @@ func handler(api *Api, route *Route, version int) func(http.ResponseWriter, *htt
 		for _, urlParam := range ps {
 			urlParams[urlParam.Key] = urlParam.Value
 		}
+		limitBody(api, w, r)
 		params, err := getRequestParams(r, urlParams)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			w.WriteHeader(bodyErrorStatus(err))
 			return
 		}
 		data := make(map[string]interface{})
 		data["params"] = params
 
-		runBeforeHooks(api, data, r, w)
-		sql, err := route.Sql(data, apiVersion)
+		if !runBeforeHooks(api, data, r, w) {
+			return
+		}
+		if !runRouteHooks(api, route, data, r, w) {
+			return
+		}
+		uploads, filesErrors, err := PrepareFiles(api, route, apiVersion, r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if filesErrors != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, filesErrors)
+			return
+		}
+		if uploads != nil {
+			data["files"] = uploads.Data
+		}
+		if modes := debugModes(api, r); modes != nil {
+			delete(params, debugParam)
+			serveDebug(api, route, apiVersion, data, modes, w)
+			return
+		}
+		sql, err := route.SqlContext(r.Context(), data, apiVersion)
 		if err != nil && sql != "" {
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprint(w, sql)
@@ -96,39 +153,101 @@ func handler(api *Api, route *Route, version int) func(http.ResponseWriter, *htt
 			log.Println(err)
 			return
 		}
-		start := time.Now()
-		rows, err := db.Query(sql)
+		sessions, err := getSessions(api, data)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		err = uploads.Store()
 		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		queryStart := time.Now()
+		value, found, err := ExecuteSqlContext(r.Context(), db, sql, sessions, routeJobs(api, route))
+		queryDuration.Observe(time.Since(queryStart).Seconds(), route.Name)
+		if err != nil {
+			uploads.Remove()
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Println(sql)
 			log.Println(err)
 			return
 		} else {
-			log.Printf(sql+" took %s\n", time.Since(start))
+			log.Printf(sql+" took %s\n", time.Since(queryStart))
 		}
-		defer rows.Close()
 		var jsonValue string
 		w.Header().Set("X-Api-Version", strconv.Itoa(apiVersion))
 		if api.IsDeprecated(apiVersion) {
 			w.Header().Set("X-Api-Deprecated", "true")
 		}
-		if rows.Next() {
-			err := rows.Scan(&jsonValue)
+		if found {
+			if value.Valid {
+				jsonValue = value.String
+			} else if route.Collection {
+				jsonValue = "[]"
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		}
+		pipelines := responsePipelines(api, route.PluginPipelines)
+		if len(pipelines) > 0 {
+			var ok bool
+			jsonValue, ok, err = goThroughPipelines(r.Context(), api, jsonValue, pipelines, w)
 			if err != nil {
-				if route.Collection {
-					jsonValue = "[]"
-				} else {
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			if !ok {
+				return
 			}
 		}
-		if len(route.PluginPipelines) > 0 {
-			goThroughPipelines(api, jsonValue, route.PluginPipelines, w)
-		} else {
-			fmt.Fprint(w, jsonValue)
+		writeResponse(api, route, data, jsonValue, r, w)
+	}
+}
+
+// limitBody limits size of request body, multipart bodies are read to memory
+// and temporary files.
+func limitBody(api *Api, w http.ResponseWriter, r *http.Request) {
+	if api.MaxBodySize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, api.MaxBodySize)
+	}
+}
+
+// bodyErrorStatus is status for request body that can't be read. Multipart
+// reader doesn't wrap errors, so error is matched by message.
+func bodyErrorStatus(err error) int {
+	if strings.Contains(err.Error(), "request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func writeResponse(api *Api, route *Route, data map[string]interface{}, jsonValue string, r *http.Request, w http.ResponseWriter) {
+	for _, name := range api.GetPlugins() {
+		plugin, ok := api.GetPlugin(name).(RenderPlugin)
+		if !ok {
+			continue
+		}
+		response := plugin.Render(route.Name, data, jsonValue, r)
+		if response == nil {
+			continue
+		}
+		writePluginHeaders(response, w)
+		if response.ResponseCode != 0 {
+			w.WriteHeader(response.ResponseCode)
+			if response.Error != "" {
+				fmt.Fprint(w, response.Error)
+			}
+			return
 		}
+		fmt.Fprint(w, response.Body)
+		return
 	}
+	fmt.Fprint(w, jsonValue)
 }
 
 var indexHtml []byte
@@ -147,24 +266,158 @@ func Index(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 var db *sql.DB
 
-func main() {
+// loadApi parses routes and registers plugins that have configuration.
+func loadApi() (*Api, error) {
 	api, err := ParseRoutes(".")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	//Plugins
-	api.RegisterPlugin("jwt", &jwt.JWT{})
-	//Plugins
+	err = api.RegisterPlugin("jwt", &jwt.JWT{})
+	if err != nil {
+		return nil, err
+	}
+	err = api.RegisterPlugin("apikey", &apikey.ApiKey{})
+	if err != nil {
+		return nil, err
+	}
+	err = api.RegisterPlugin("cors", &cors.Cors{})
+	if err != nil {
+		return nil, err
+	}
+	err = api.RegisterPlugin("ratelimit", &ratelimit.RateLimit{})
+	if err != nil {
+		return nil, err
+	}
+	err = api.RegisterPlugin("html", &html.Html{})
+	if err != nil {
+		return nil, err
+	}
+	err = api.RegisterPlugin("email", &email.Email{})
+	if err != nil {
+		return nil, err
+	}
+	err = api.RegisterPlugin("webhook", &webhook.Webhook{})
+	if err != nil {
+		return nil, err
+	}
+	if len(api.JobQueue.Jobs) > 0 {
+		api.AddPlugin("enqueue", &enqueuePlugin{queue: api.JobQueue})
+	}
+	err = api.ValidatePipelines()
+	if err != nil {
+		return nil, err
+	}
+	return api, nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if command := commands[os.Args[1]]; command != nil {
+			err := command(os.Args[2:])
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	serve()
+}
+
+func serve() {
+	api, err := loadApi()
+	if err != nil {
+		log.Fatal(err)
+	}
 	db, err = GetDbConnection()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	config, err := ParseConfig(".")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.RequireMigrations {
+		migrator, err := NewMigrator(".", db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pending, err := migrator.Pending(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(pending) > 0 {
+			log.Fatalf("There are %v pending migrations, run `dbservice migrate up` first\n", len(pending))
+		}
+	}
+	api.SetDb(db)
+	api.Debug = config.DebugEnabled()
+	api.MaxBodySize = config.MaxBodySize
+	if config.Debug.Enabled && !api.Debug {
+		log.Println("Debug requests are disabled in production mode")
+	}
+	if config.Tracing.Exporter != "" {
+		tracer, err = NewTracer(config.Tracing)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tracer.Start()
+	}
+	if len(api.JobQueue.Jobs) > 0 {
+		err = api.JobQueue.CreateTable(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.JobQueue.Start(api, db)
+	}
+	api.Storage, err = NewStorage(config.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
 	router := httprouter.New()
+	router.GET(config.Health.HealthPath, healthHandler)
+	router.GET(config.Health.ReadyPath, readyHandler(NewReadiness(api, db, config.Health.Timeout.Duration)))
+	if config.Metrics.Enabled || config.Metrics.Listen != "" {
+		registerDbMetrics(db)
+	}
+	if config.Metrics.Listen != "" {
+		metricsRouter := httprouter.New()
+		metricsRouter.GET("/metrics", metricsHandler)
+		go func() {
+			log.Fatal(http.ListenAndServe(config.Metrics.Listen, metricsRouter))
+		}()
+	} else if config.Metrics.Enabled {
+		router.GET("/metrics", metricsHandler)
+	}
+	if len(api.Schedule.Tasks) > 0 {
+		err = api.Schedule.CreateTable(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.Schedule.Start(db)
+		if config.Admin.Token != "" {
+			router.GET("/_admin/schedule", adminHandler(config.Admin.Token, scheduleStatusHandler(api.Schedule)))
+		}
+	}
 	if _, err := os.Stat("./index.html"); err == nil {
 		router.GET("/", Index)
 	}
+	broker := NewBroker()
+	if channels := streamChannels(api.Routes); len(channels) > 0 {
+		connectionString, err := GetDbConnectionString()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = broker.Listen(connectionString, channels)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	for _, route := range api.Routes {
+		if route.Stream != nil {
+			router.GET(route.Path, streamHandler(api, route, broker))
+		}
 		if route.Method == "GET" {
 			router.GET(route.Path, handler(api, route, 0))
 			if api.Version > 0 {
@@ -198,6 +451,26 @@ func main() {
 			}
 		}
 	}
+	router.POST("/_batch", batchHandler(api))
+	if config.OpenApiEnabled() {
+		router.GET("/_openapi.json", openApiHandler(api, api.Version, config.OpenApi))
+		router.GET("/_docs", docsHandler(api, config.OpenApi))
+		if api.Version > 0 {
+			for i := api.MinVersion; i <= api.Version; i++ {
+				router.GET("/v"+strconv.Itoa(i)+"/_openapi.json", openApiHandler(api, i, config.OpenApi))
+			}
+		}
+	}
+	if hasPreflightPlugins(api) {
+		for path, routes := range routesByPath(api.Routes) {
+			router.OPTIONS(path, preflightHandler(api, routes))
+			if api.Version > 0 {
+				for i := api.MinVersion; i <= api.Version; i++ {
+					router.OPTIONS("/v"+strconv.Itoa(i)+path, preflightHandler(api, routes))
+				}
+			}
+		}
+	}
 	port := "8080"
 	if len(os.Args) > 1 {
 		port = os.Args[1]
@@ -205,60 +478,249 @@ func main() {
 	if _, err := os.Stat("./static"); err == nil {
 		router.ServeFiles("/static/*filepath", http.Dir("static"))
 	}
-	log.Fatal(http.ListenAndServe(":"+port, router))
+	if config.Storage.Type == "local" && config.Storage.UrlPrefix != "" {
+		prefix := strings.TrimSuffix(config.Storage.UrlPrefix, "/")
+		router.ServeFiles(prefix+"/*filepath", http.Dir(config.Storage.Directory))
+	}
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown failed: %v\n", err)
+		}
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	tracer.Stop()
+}
+
+func goThroughPipelines(ctx context.Context,
+	api *Api,
+	jsonValue string,
+	pluginPipelines []*PluginPipeline,
+	w http.ResponseWriter) (string, bool, error) {
+
+	jsonValue, response, err := runPipelines(ctx, api, jsonValue, pluginPipelines, w.Header())
+	if err != nil {
+		return "", false, err
+	}
+	if response != nil {
+		w.WriteHeader(response.ResponseCode)
+		if response.Error != "" {
+			fmt.Fprint(w, response.Error)
+		}
+		return "", false, nil
+	}
+	return jsonValue, true, nil
 }
 
-func goThroughPipelines(api *Api,
+// runPipelines passes result through plugins. If one of plugins fails, its
+// response is returned instead of result.
+func runPipelines(ctx context.Context,
+	api *Api,
 	jsonValue string,
 	pluginPipelines []*PluginPipeline,
-	w http.ResponseWriter) error {
+	header http.Header) (string, *plugins.Response, error) {
 
+	// Plugins process single objects, empty results (no row) and
+	// collections are passed as they are.
+	if !strings.HasPrefix(strings.TrimSpace(jsonValue), "{") {
+		return jsonValue, nil, nil
+	}
 	data := make(map[string]interface{})
 	err := json.Unmarshal([]byte(jsonValue), &data)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 	for _, pp := range pluginPipelines {
 		plugin := api.GetPlugin(pp.Name)
 		if plugin == nil {
-			return errors.New(fmt.Sprintf("Plugin missing: %v", pp.Name))
+			return "", nil, errors.New(fmt.Sprintf("Plugin missing: %v", pp.Name))
 		}
+		_, span := startSpan(ctx, "pipeline "+pp.Name, spanKindInternal)
+		span.SetAttribute("dbservice.plugin", pp.Name)
 		response := plugin.Process(data, pp.Argument)
-		if response.Headers != nil {
-			for name, values := range response.Headers {
-				for _, value := range values {
-					w.Header().Set(name, value)
-				}
-			}
-		}
+		endPluginSpan(span, response)
+		countPluginError(pp.Name, response)
+		applyPluginHeaders(response, header)
 		if response.ResponseCode != 0 {
-			w.WriteHeader(response.ResponseCode)
-			if response.Error != "" {
-				fmt.Fprint(w, response.Error)
-			}
-			return nil
+			return "", response, nil
 		}
 		data = response.Data
 	}
 	dataJson, err := json.Marshal(data)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	fmt.Fprint(w, string(dataJson))
-	return nil
+	return string(dataJson), nil, nil
+}
+
+func runBeforeHooks(api *Api, data map[string]interface{}, r *http.Request, w http.ResponseWriter) bool {
+	return writeHookResponse(processBeforeHooks(api, data, r, w.Header()), w)
+}
+
+func runRouteHooks(api *Api, route *Route, data map[string]interface{}, r *http.Request, w http.ResponseWriter) bool {
+	return writeHookResponse(processRouteHooks(api, route, data, r, w.Header()), w)
 }
 
-func runBeforeHooks(api *Api, data map[string]interface{}, r *http.Request, w http.ResponseWriter) {
-	plugins := api.GetPlugins()
-	for _, name := range plugins {
+func writeHookResponse(response *plugins.Response, w http.ResponseWriter) bool {
+	if response == nil {
+		return true
+	}
+	w.WriteHeader(response.ResponseCode)
+	if response.Error != "" {
+		fmt.Fprint(w, response.Error)
+	}
+	return false
+}
+
+// processBeforeHooks returns response of plugin that stopped request.
+func processBeforeHooks(api *Api, data map[string]interface{}, r *http.Request, header http.Header) *plugins.Response {
+	_, span := startSpan(r.Context(), "before_hooks", spanKindInternal)
+	defer span.End()
+	for _, name := range api.GetPlugins() {
 		plugin := api.GetPlugin(name)
 		response := plugin.ProcessBeforeHook(data, r)
-		if response != nil && response.Headers != nil {
-			for name, values := range response.Headers {
-				for _, value := range values {
-					w.Header().Set(name, value)
+		if response == nil {
+			continue
+		}
+		countPluginError(name, response)
+		applyPluginHeaders(response, header)
+		if response.ResponseCode != 0 {
+			span.SetAttribute("dbservice.plugin", name)
+			endPluginSpan(span, response)
+			return response
+		}
+	}
+	return nil
+}
+
+func processRouteHooks(api *Api, route *Route, data map[string]interface{}, r *http.Request, header http.Header) *plugins.Response {
+	_, span := startSpan(r.Context(), "route_hooks", spanKindInternal)
+	defer span.End()
+	for _, pp := range route.PluginPipelines {
+		plugin, ok := api.GetPlugin(pp.Name).(RouteHookPlugin)
+		if !ok {
+			continue
+		}
+		response := plugin.ProcessRouteHook(route.Name, data, pp.Argument, r)
+		if response == nil {
+			continue
+		}
+		countPluginError(pp.Name, response)
+		applyPluginHeaders(response, header)
+		if response.ResponseCode != 0 {
+			span.SetAttribute("dbservice.plugin", pp.Name)
+			endPluginSpan(span, response)
+			return response
+		}
+	}
+	return nil
+}
+
+func responsePipelines(api *Api, pluginPipelines []*PluginPipeline) []*PluginPipeline {
+	pipelines := make([]*PluginPipeline, 0, len(pluginPipelines))
+	for _, pp := range pluginPipelines {
+		if _, ok := api.GetPlugin(pp.Name).(RouteHookPlugin); !ok {
+			pipelines = append(pipelines, pp)
+		}
+	}
+	return pipelines
+}
+
+func hasPreflightPlugins(api *Api) bool {
+	for _, name := range api.GetPlugins() {
+		if _, ok := api.GetPlugin(name).(PreflightPlugin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func routesByPath(routes []*Route) map[string][]*Route {
+	paths := make(map[string][]*Route)
+	for _, route := range routes {
+		paths[route.Path] = append(paths[route.Path], route)
+	}
+	return paths
+}
+
+func preflightHandler(api *Api, routes []*Route) httprouter.Handle {
+	methods := make([]string, 0, len(routes))
+	for _, route := range routes {
+		methods = append(methods, route.HttpMethod())
+	}
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		var route *Route
+		for _, rt := range routes {
+			if rt.HttpMethod() == strings.ToUpper(r.Header.Get("Access-Control-Request-Method")) {
+				route = rt
+			}
+		}
+		for _, name := range api.GetPlugins() {
+			plugin, ok := api.GetPlugin(name).(PreflightPlugin)
+			if !ok {
+				continue
+			}
+			var arg map[string]interface{}
+			if route != nil {
+				arg = route.PipelineArgument(name)
+			}
+			response := plugin.ProcessPreflight(arg, methods, r)
+			writePluginHeaders(response, w)
+			if response.ResponseCode != 0 {
+				w.WriteHeader(response.ResponseCode)
+				if response.Error != "" {
+					fmt.Fprint(w, response.Error)
 				}
+				return
 			}
 		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writePluginHeaders(response *plugins.Response, w http.ResponseWriter) {
+	applyPluginHeaders(response, w.Header())
+}
+
+func applyPluginHeaders(response *plugins.Response, header http.Header) {
+	if response.Headers != nil {
+		for name, values := range response.Headers {
+			if len(values) == 0 {
+				header.Del(name)
+			}
+			for _, value := range values {
+				header.Set(name, value)
+			}
+		}
+	}
+	for _, cookie := range response.Cookies {
+		if value := cookie.String(); value != "" {
+			header.Add("Set-Cookie", value)
+		}
+	}
+}
+
+func getSessions(api *Api, data map[string]interface{}) ([]*plugins.Session, error) {
+	sessions := make([]*plugins.Session, 0)
+	for _, name := range api.GetPlugins() {
+		plugin, ok := api.GetPlugin(name).(SessionPlugin)
+		if !ok {
+			continue
+		}
+		session, err := plugin.Session(data)
+		if err != nil {
+			return nil, err
+		}
+		if session != nil {
+			sessions = append(sessions, session)
+		}
 	}
+	return sessions, nil
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"github.com/gophergala2016/dbserver/plugins/cors"
+	"net/http"
+	"testing"
+)
+
+func TestRunPipelinesSkipsNonObjects(t *testing.T) {
+	api := &Api{}
+	pipelines := []*PluginPipeline{{Name: "missing"}}
+	for _, value := range []string{"", "[]", `[{"id": 1}]`} {
+		result, response, err := runPipelines(context.Background(), api, value, pipelines, make(http.Header))
+		if err != nil || response != nil || result != value {
+			t.Errorf("Expected %q to be passed through, but got %q %v %v", value, result, response, err)
+		}
+	}
+	_, _, err := runPipelines(context.Background(), api, `{"id": 1}`, pipelines, make(http.Header))
+	if err == nil {
+		t.Errorf("Expected missing plugin to fail")
+	}
+}
+
+func TestValidatePipelines(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.AddPlugin("cors", &cors.Cors{})
+	route := api.GetRoute("get_users")
+	route.PluginPipelines = append(route.PluginPipelines, &PluginPipeline{Name: "cors", Argument: map[string]interface{}{"max_age": float64(600)}})
+	if err := api.ValidatePipelines(); err != nil {
+		t.Errorf("Expected pipelines to be valid, but got: %v", err)
+	}
+	route.PluginPipelines = append(route.PluginPipelines, &PluginPipeline{Name: "cors", Argument: map[string]interface{}{"max_age": "soon"}})
+	if err := api.ValidatePipelines(); err == nil {
+		t.Error("Expected invalid cors argument to fail")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gophergala2016/dbserver/plugins"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	requestsTotal = plugins.NewCounter("dbservice_http_requests_total",
+		"Requests by route, api version and status code.", "route", "version", "status")
+	requestDuration = plugins.NewHistogram("dbservice_http_request_duration_seconds",
+		"Request duration by route, api version and status code.", plugins.DefaultBuckets, "route", "version", "status")
+	queryDuration = plugins.NewHistogram("dbservice_db_query_duration_seconds",
+		"Duration of route sql queries.", plugins.DefaultBuckets, "route")
+	validationFailures = plugins.NewCounter("dbservice_schema_validation_failures_total",
+		"Requests rejected by schema validation.", "route", "version")
+	pluginErrors = plugins.NewCounter("dbservice_plugin_errors_total",
+		"Plugin failures (responses with 5xx status code).", "plugin")
+)
+
+// statusRecorder remembers response status for metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (self *statusRecorder) WriteHeader(status int) {
+	if self.status == 0 {
+		self.status = status
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *statusRecorder) Write(content []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	return self.ResponseWriter.Write(content)
+}
+
+// versionLabel is empty for unversioned api.
+func versionLabel(version int) string {
+	if version == 0 {
+		return ""
+	}
+	return strconv.Itoa(version)
+}
+
+func observeRequest(route *Route, version int, recorder *statusRecorder, start time.Time) {
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	labels := []string{route.Name, versionLabel(version), strconv.Itoa(status)}
+	requestsTotal.Inc(labels...)
+	requestDuration.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func countPluginError(name string, response *plugins.Response) {
+	if response != nil && response.ResponseCode >= 500 {
+		pluginErrors.Inc(name)
+	}
+}
+
+// registerDbMetrics exposes connection pool stats.
+func registerDbMetrics(db *sql.DB) {
+	stats := func(value func(sql.DBStats) float64) func() float64 {
+		return func() float64 {
+			return value(db.Stats())
+		}
+	}
+	plugins.NewGaugeFunc("dbservice_db_max_open_connections", "Maximum number of open connections.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	plugins.NewGaugeFunc("dbservice_db_open_connections", "Open connections, both in use and idle.",
+		stats(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	plugins.NewGaugeFunc("dbservice_db_in_use_connections", "Connections that are in use.",
+		stats(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	plugins.NewGaugeFunc("dbservice_db_idle_connections", "Idle connections.",
+		stats(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	plugins.NewCounterFunc("dbservice_db_wait_count_total", "Times connection had to be waited for.",
+		stats(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	plugins.NewCounterFunc("dbservice_db_wait_duration_seconds_total", "Time spent waiting for connections.",
+		stats(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	plugins.NewCounterFunc("dbservice_db_max_idle_closed_total", "Connections closed because of max idle connections limit.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	plugins.NewCounterFunc("dbservice_db_max_lifetime_closed_total", "Connections closed because of max lifetime.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	plugins.Metrics.Write(w)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	route := api.GetRoute("create_user")
+	requests := requestsTotal.Value("create_user", "5", "400")
+	failures := validationFailures.Value("create_user", "5")
+	r := httptest.NewRequest("POST", "/v5/users", strings.NewReader(`{"name": "John"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler(api, route, 5)(w, r, httprouter.Params{})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, but got %v", w.Code)
+	}
+	if value := requestsTotal.Value("create_user", "5", "400"); value != requests+1 {
+		t.Errorf("Expected request to be counted, but got %v", value)
+	}
+	if requestDuration.Count("create_user", "5", "400") == 0 {
+		t.Errorf("Expected request duration to be observed")
+	}
+	if value := validationFailures.Value("create_user", "5"); value != failures+1 {
+		t.Errorf("Expected validation failure to be counted, but got %v", value)
+	}
+	w = httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil), nil)
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE dbservice_http_requests_total counter",
+		`dbservice_http_request_duration_seconds_bucket{route="create_user",version="5",status="400",le="+Inf"}`,
+		"dbservice_jwt_rotations_total ",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %v, but got:\n%v", line, body)
+		}
+	}
+}
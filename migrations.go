@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const migrationsTable = "dbservice_migrations"
+
+var migrationRegexp = regexp.MustCompile(`^([0-9]+)_(.+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	*Migration
+	AppliedAt *time.Time
+}
+
+func ParseMigrations(path string) ([]*Migration, error) {
+	files, err := filepath.Glob(filepath.Join(path, "migrations", "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, file := range files {
+		match := migrationRegexp.FindStringSubmatch(filepath.Base(file))
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name: %v", file)
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migrations %v_%v and %v_%v have the same version", match[1], migration.Name, match[1], match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = file
+		} else {
+			migration.Down = file
+		}
+	}
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %v_%v is missing up file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// NewMigration creates empty up and down files with next version number.
+func NewMigration(path string, name string) (*Migration, error) {
+	if !regexp.MustCompile(`^[a-z0-9_]+$`).MatchString(name) {
+		return nil, errors.New("migration name can only have lowercase letters, digits and underscores")
+	}
+	migrations, err := ParseMigrations(path)
+	if err != nil {
+		return nil, err
+	}
+	var version int64 = 1
+	if len(migrations) > 0 {
+		version = migrations[len(migrations)-1].Version + 1
+	}
+	err = os.MkdirAll(filepath.Join(path, "migrations"), 0755)
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Join(path, "migrations", fmt.Sprintf("%04d_%v", version, name))
+	migration := &Migration{Version: version, Name: name, Up: prefix + ".up.sql", Down: prefix + ".down.sql"}
+	for _, file := range []string{migration.Up, migration.Down} {
+		err = ioutil.WriteFile(file, []byte{}, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return migration, nil
+}
+
+type Migrator struct {
+	db         *sql.DB
+	Migrations []*Migration
+}
+
+func (self *Migrator) createTable() error {
+	_, err := self.db.Exec(`create table if not exists ` + migrationsTable + ` (
+  version bigint primary key,
+  name text not null,
+  applied_at timestamptz not null default now()
+)`)
+	return err
+}
+
+type contextQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func appliedMigrations(ctx context.Context, q contextQueryer) (map[int64]time.Time, error) {
+	rows, err := q.QueryContext(ctx, "select version, applied_at from "+migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func pendingMigrations(migrations []*Migration, applied map[int64]time.Time) []*Migration {
+	pending := make([]*Migration, 0)
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+func (self *Migrator) Status() ([]*MigrationStatus, error) {
+	err := self.createTable()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(context.Background(), self.db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]*MigrationStatus, 0, len(self.Migrations))
+	for _, migration := range self.Migrations {
+		status := &MigrationStatus{Migration: migration}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Pending only reads from database, so readiness probe can use it: missing
+// migrations table means that nothing is applied yet.
+func (self *Migrator) Pending(ctx context.Context) ([]*Migration, error) {
+	var table sql.NullString
+	err := self.db.QueryRowContext(ctx, "select to_regclass($1)::text", migrationsTable).Scan(&table)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]time.Time)
+	if table.Valid {
+		applied, err = appliedMigrations(ctx, self.db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pendingMigrations(self.Migrations, applied), nil
+}
+
+// step runs single migration in transaction. Advisory lock makes concurrent
+// runs (e.g. several instances deploying at once) wait for each other, list
+// of applied migrations is read after lock is taken.
+func (self *Migrator) step(up bool) (*Migration, error) {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("select pg_advisory_xact_lock(hashtext($1))", migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(context.Background(), tx)
+	if err != nil {
+		return nil, err
+	}
+	var migration *Migration
+	if up {
+		pending := pendingMigrations(self.Migrations, applied)
+		if len(pending) == 0 {
+			return nil, nil
+		}
+		migration = pending[0]
+	} else {
+		for i := len(self.Migrations) - 1; i >= 0 && migration == nil; i-- {
+			if _, ok := applied[self.Migrations[i].Version]; ok {
+				migration = self.Migrations[i]
+			}
+		}
+		if migration == nil {
+			return nil, nil
+		}
+		if migration.Down == "" {
+			return nil, fmt.Errorf("migration %v_%v is missing down file", migration.Version, migration.Name)
+		}
+	}
+	file := migration.Up
+	if !up {
+		file = migration.Down
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(content))) > 0 {
+		_, err = tx.Exec(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+	}
+	if up {
+		_, err = tx.Exec("insert into "+migrationsTable+" (version, name) values ($1, $2)", migration.Version, migration.Name)
+	} else {
+		_, err = tx.Exec("delete from "+migrationsTable+" where version = $1", migration.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return migration, tx.Commit()
+}
+
+// Up applies all pending migrations, Down rolls back given number of last
+// applied migrations. Done migrations are passed to callback.
+func (self *Migrator) Up(done func(*Migration)) error {
+	return self.run(true, -1, done)
+}
+
+func (self *Migrator) Down(steps int, done func(*Migration)) error {
+	return self.run(false, steps, done)
+}
+
+func (self *Migrator) run(up bool, steps int, done func(*Migration)) error {
+	err := self.createTable()
+	if err != nil {
+		return err
+	}
+	for i := 0; steps == -1 || i < steps; i++ {
+		migration, err := self.step(up)
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			return nil
+		}
+		done(migration)
+	}
+	return nil
+}
+
+func NewMigrator(path string, db *sql.DB) (*Migrator, error) {
+	migrations, err := ParseMigrations(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, Migrations: migrations}, nil
+}
+
+func migrateCommand(args []string) error {
+	usage := errors.New("usage: dbservice migrate up|down [steps]|status|new <name>")
+	if len(args) == 0 {
+		return usage
+	}
+	if args[0] == "new" {
+		if len(args) != 2 {
+			return usage
+		}
+		migration, err := NewMigration(".", args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created %v\nCreated %v\n", migration.Up, migration.Down)
+		return nil
+	}
+	db, err := GetDbConnection()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	migrator, err := NewMigrator(".", db)
+	if err != nil {
+		return err
+	}
+	printMigration := func(direction string) func(*Migration) {
+		return func(migration *Migration) {
+			fmt.Printf("%v %04d_%v\n", direction, migration.Version, migration.Name)
+		}
+	}
+	switch args[0] {
+	case "up":
+		return migrator.Up(printMigration("Applied"))
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return usage
+			}
+		}
+		return migrator.Down(steps, printMigration("Rolled back"))
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%v %v\n", status.Version, status.Name, appliedAt)
+		}
+		return nil
+	}
+	return usage
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMigrations(t *testing.T) {
+	migrations, err := ParseMigrations("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("Expected to get 2 migrations, but got %v", len(migrations))
+	}
+	if migrations[0].Version != 1 || migrations[0].Name != "create_users" || migrations[0].Down == "" {
+		t.Errorf("Unexpected first migration: %+v", migrations[0])
+	}
+	if migrations[1].Version != 2 || migrations[1].Down != "" {
+		t.Errorf("Unexpected second migration: %+v", migrations[1])
+	}
+	pending := pendingMigrations(migrations, map[int64]time.Time{1: time.Now()})
+	if len(pending) != 1 || pending[0].Version != 2 {
+		t.Errorf("Expected second migration to be pending, but got %v", pending)
+	}
+}
+
+func TestParseMigrationsErrors(t *testing.T) {
+	for _, files := range [][]string{
+		{"0001_create_users.down.sql"},
+		{"0001_create_users.up.sql", "0001_create_products.up.sql"},
+		{"create_users.up.sql"},
+	} {
+		dir, err := ioutil.TempDir("", "migrations")
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Mkdir(filepath.Join(dir, "migrations"), 0755)
+		for _, file := range files {
+			ioutil.WriteFile(filepath.Join(dir, "migrations", file), []byte{}, 0644)
+		}
+		_, err = ParseMigrations(dir)
+		if err == nil {
+			t.Errorf("Expected to get error for %v, but got nil", files)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	migration, err := NewMigration(dir, "create_products")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if migration.Up != filepath.Join(dir, "migrations", "0001_create_products.up.sql") {
+		t.Errorf("Unexpected up file: %v", migration.Up)
+	}
+	migration, err = NewMigration(dir, "add_price")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if migration.Version != 2 {
+		t.Errorf("Expected to get version 2, but got %v", migration.Version)
+	}
+	if _, err := os.Stat(migration.Down); err != nil {
+		t.Errorf("Expected down file to be created, but got %v", err)
+	}
+	_, err = NewMigration(dir, "Add Price")
+	if err == nil {
+		t.Error("Expected to get error for invalid name, but got nil")
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	connector := &fakeConnector{}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	migrator, err := NewMigrator("testapp", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := migrator.Pending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Errorf("Expected all migrations to be pending without migrations table, but got %v", pending)
+	}
+	for _, query := range connector.queries {
+		if !strings.HasPrefix(query, "select") {
+			t.Errorf("Expected pending migrations to only read, but got %v", query)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := migrator.Pending(ctx); err != context.Canceled {
+		t.Errorf("Expected canceled context error, but got %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gophergala2016/dbserver/plugins/apikey"
+	"github.com/gophergala2016/dbserver/plugins/jwt"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var pathParamRegexp = regexp.MustCompile(`[:*]([^/]+)`)
+
+// OpenApiDocument describes api version as OpenAPI 3.1 document.
+func OpenApiDocument(api *Api, version int, config OpenApiConfig) map[string]interface{} {
+	info := map[string]interface{}{"title": config.Title, "version": "1"}
+	if config.Description != "" {
+		info["description"] = config.Description
+	}
+	server := "/"
+	if version > 0 {
+		info["version"] = strconv.Itoa(version)
+		server = "/v" + strconv.Itoa(version)
+	}
+	paths := make(map[string]interface{})
+	for _, route := range api.Routes {
+		path, params := openApiPath(route.Path)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		operation := openApiOperation(api, route, version, params)
+		if api.IsDeprecated(version) {
+			operation["deprecated"] = true
+		}
+		item[strings.ToLower(route.HttpMethod())] = operation
+	}
+	document := map[string]interface{}{
+		"openapi": "3.1.0",
+		"info":    info,
+		"servers": []interface{}{map[string]interface{}{"url": server}},
+		"paths":   paths,
+	}
+	schemes, security := openApiSecurity(api)
+	if len(schemes) > 0 {
+		document["components"] = map[string]interface{}{"securitySchemes": schemes}
+	}
+	if len(security) > 0 {
+		document["security"] = security
+	}
+	return document
+}
+
+func openApiPath(path string) (string, []string) {
+	params := make([]string, 0)
+	for _, match := range pathParamRegexp.FindAllStringSubmatch(path, -1) {
+		params = append(params, match[1])
+	}
+	return pathParamRegexp.ReplaceAllString(path, "{$1}"), params
+}
+
+// openApiSecurity returns security schemes of enabled auth plugins. Jwt is
+// optional for every route as routes decide themselves what to do without
+// token.
+func openApiSecurity(api *Api) (map[string]interface{}, []interface{}) {
+	schemes := make(map[string]interface{})
+	security := make([]interface{}, 0)
+	if plugin, ok := api.GetPlugin("jwt").(*jwt.JWT); ok {
+		schemes["bearerAuth"] = map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+		security = append(security, map[string]interface{}{"bearerAuth": []interface{}{}})
+		if plugin.CookieName != "" {
+			schemes["cookieAuth"] = map[string]interface{}{"type": "apiKey", "in": "cookie", "name": plugin.CookieName}
+			security = append(security, map[string]interface{}{"cookieAuth": []interface{}{}})
+		}
+		security = append(security, map[string]interface{}{})
+	}
+	if plugin, ok := api.GetPlugin("apikey").(*apikey.ApiKey); ok {
+		schemes["apiKey"] = map[string]interface{}{"type": "apiKey", "in": "header", "name": plugin.Header}
+	}
+	return schemes, security
+}
+
+func copySchema(schema map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range schema {
+		if key != "$schema" && key != "files" {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func openApiOperation(api *Api, route *Route, version int, pathParams []string) map[string]interface{} {
+	operation := map[string]interface{}{"operationId": route.Name}
+	var schema map[string]interface{}
+	routeVersion := route.Versions[route.GetAvailableVersion(version)]
+	if routeVersion != nil && routeVersion.SchemaJson != nil {
+		schema = copySchema(routeVersion.SchemaJson)
+	}
+	if description := route.GetDescription(version); description != "" {
+		operation["description"] = description
+	}
+	properties := make(map[string]interface{})
+	required := make(map[string]bool)
+	if schema != nil {
+		if value, ok := schema["properties"].(map[string]interface{}); ok {
+			for name, property := range value {
+				properties[name] = property
+			}
+		}
+		if value, ok := schema["required"].([]interface{}); ok {
+			for _, name := range value {
+				required[fmt.Sprint(name)] = true
+			}
+		}
+	}
+	parameters := make([]interface{}, 0)
+	for _, name := range pathParams {
+		parameters = append(parameters, openApiParameter(name, "path", properties[name], true))
+		delete(properties, name)
+		delete(required, name)
+	}
+	method := route.HttpMethod()
+	if method == "GET" || method == "DELETE" {
+		for _, name := range sortedKeys(properties) {
+			parameters = append(parameters, openApiParameter(name, "query", properties[name], required[name]))
+		}
+	} else if schema != nil {
+		schema["properties"] = properties
+		requiredList := make([]string, 0)
+		for _, name := range sortedKeys(properties) {
+			if required[name] {
+				requiredList = append(requiredList, name)
+			}
+		}
+		if len(requiredList) > 0 {
+			schema["required"] = requiredList
+		} else {
+			delete(schema, "required")
+		}
+		content := map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schema},
+		}
+		if len(routeVersion.Files) > 0 {
+			content["multipart/form-data"] = map[string]interface{}{"schema": openApiMultipartSchema(schema, routeVersion.Files)}
+		}
+		operation["requestBody"] = map[string]interface{}{"required": len(requiredList) > 0, "content": content}
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+	operation["responses"] = openApiResponses(route, schema != nil)
+	if route.HasPipeline("apikey") {
+		operation["security"] = []interface{}{map[string]interface{}{"apiKey": []interface{}{}}}
+	}
+	return operation
+}
+
+func openApiParameter(name string, in string, schema interface{}, required bool) map[string]interface{} {
+	parameter := map[string]interface{}{"name": name, "in": in, "required": required}
+	if schema == nil {
+		schema = map[string]interface{}{"type": "string"}
+	}
+	if property, ok := schema.(map[string]interface{}); ok && property["description"] != nil {
+		parameter["description"] = property["description"]
+	}
+	parameter["schema"] = schema
+	return parameter
+}
+
+func openApiMultipartSchema(schema map[string]interface{}, files map[string]*FileRule) map[string]interface{} {
+	multipart := copySchema(schema)
+	properties := make(map[string]interface{})
+	for name, property := range schema["properties"].(map[string]interface{}) {
+		properties[name] = property
+	}
+	for name, rule := range files {
+		file := map[string]interface{}{"type": "string", "contentMediaType": "application/octet-stream"}
+		if rule.MaxCount == 1 {
+			properties[name] = file
+		} else {
+			properties[name] = map[string]interface{}{"type": "array", "items": file}
+		}
+	}
+	multipart["properties"] = properties
+	return multipart
+}
+
+func openApiResponses(route *Route, hasSchema bool) map[string]interface{} {
+	responses := make(map[string]interface{})
+	if route.Stream != nil {
+		responses["200"] = map[string]interface{}{
+			"description": "Stream of events",
+			"content": map[string]interface{}{
+				"text/event-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			},
+		}
+	} else {
+		schema := route.ResponseSchema
+		if schema == nil && route.Collection {
+			schema = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}}
+		} else if schema == nil {
+			schema = map[string]interface{}{"type": "object"}
+		}
+		responses["200"] = map[string]interface{}{
+			"description": "Successful response",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": copySchema(schema)},
+			},
+		}
+		if !route.Collection {
+			responses["404"] = map[string]interface{}{"description": "Not found"}
+		}
+	}
+	if hasSchema {
+		responses["400"] = map[string]interface{}{
+			"description": "Validation errors",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{
+					"type":                 "object",
+					"additionalProperties": map[string]interface{}{"type": "string"},
+				}},
+			},
+		}
+	}
+	return responses
+}
+
+func sortedKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func openApiHandler(api *Api, version int, config OpenApiConfig) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		content, err := json.Marshal(OpenApiDocument(api, version, config))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(content)
+	}
+}
+
+func openApiCommand(args []string) error {
+	flags := flag.NewFlagSet("openapi", flag.ExitOnError)
+	version := flags.Int("version", -1, "api version (latest by default)")
+	flags.Parse(args)
+	api, err := loadApi()
+	if err != nil {
+		return err
+	}
+	config, err := ParseConfig(".")
+	if err != nil {
+		return err
+	}
+	if *version == -1 {
+		*version = api.Version
+	}
+	content, err := json.MarshalIndent(OpenApiDocument(api, *version, config.OpenApi), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(content))
+	return err
+}
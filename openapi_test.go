@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gophergala2016/dbserver/plugins/jwt"
+	"reflect"
+	"testing"
+)
+
+func openApiJson(t *testing.T, document map[string]interface{}) map[string]interface{} {
+	content, err := json.Marshal(document)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	result := make(map[string]interface{})
+	json.Unmarshal(content, &result)
+	return result
+}
+
+func TestOpenApiPath(t *testing.T) {
+	path, params := openApiPath("/users/:id/files/*path")
+	if path != "/users/{id}/files/{path}" {
+		t.Errorf("Unexpected path: %v", path)
+	}
+	if !reflect.DeepEqual(params, []string{"id", "path"}) {
+		t.Errorf("Unexpected path params: %v", params)
+	}
+}
+
+func TestOpenApiDocument(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	document := openApiJson(t, OpenApiDocument(api, 5, OpenApiConfig{Title: "Users"}))
+	if document["openapi"] != "3.1.0" {
+		t.Errorf("Unexpected openapi version: %v", document["openapi"])
+	}
+	info := document["info"].(map[string]interface{})
+	if info["title"] != "Users" || info["version"] != "5" {
+		t.Errorf("Unexpected info: %v", info)
+	}
+	server := document["servers"].([]interface{})[0].(map[string]interface{})
+	if server["url"] != "/v5" {
+		t.Errorf("Expected server url /v5, but got %v", server["url"])
+	}
+	paths := document["paths"].(map[string]interface{})
+	users := paths["/users"].(map[string]interface{})
+	getUsers := users["get"].(map[string]interface{})
+	if getUsers["operationId"] != "get_users" || getUsers["deprecated"] != nil {
+		t.Errorf("Unexpected get_users operation: %v", getUsers)
+	}
+	okResponse := getUsers["responses"].(map[string]interface{})["200"].(map[string]interface{})
+	schema := okResponse["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+	if schema["type"] != "array" {
+		t.Errorf("Expected collection response to be array, but got %v", schema)
+	}
+	createUser := users["post"].(map[string]interface{})
+	body := createUser["requestBody"].(map[string]interface{})
+	bodySchema := body["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+	if body["required"] != true || !reflect.DeepEqual(bodySchema["required"], []interface{}{"email", "name"}) {
+		t.Errorf("Unexpected create_user request body: %v", body)
+	}
+	if createUser["responses"].(map[string]interface{})["400"] == nil {
+		t.Error("Expected create_user to document validation errors")
+	}
+	updateUser := paths["/users/{id}"].(map[string]interface{})["put"].(map[string]interface{})
+	parameter := updateUser["parameters"].([]interface{})[0].(map[string]interface{})
+	if parameter["name"] != "id" || parameter["in"] != "path" || parameter["required"] != true {
+		t.Errorf("Unexpected path parameter: %v", parameter)
+	}
+	if document["components"] != nil {
+		t.Errorf("Expected no security schemes without auth plugins, but got %v", document["components"])
+	}
+}
+
+func TestOpenApiDeprecatedVersion(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	document := openApiJson(t, OpenApiDocument(api, 3, OpenApiConfig{Title: "Users"}))
+	getUsers := document["paths"].(map[string]interface{})["/users"].(map[string]interface{})["get"].(map[string]interface{})
+	if getUsers["deprecated"] != true {
+		t.Errorf("Expected version 3 operations to be deprecated, but got %v", getUsers["deprecated"])
+	}
+}
+
+func TestOpenApiSecurity(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	api.AddPlugin("jwt", &jwt.JWT{CookieName: "token"})
+	document := openApiJson(t, OpenApiDocument(api, 5, OpenApiConfig{Title: "Users"}))
+	schemes := document["components"].(map[string]interface{})["securitySchemes"].(map[string]interface{})
+	if schemes["bearerAuth"] == nil || schemes["cookieAuth"] == nil {
+		t.Errorf("Expected bearer and cookie security schemes, but got %v", schemes)
+	}
+	if len(document["security"].([]interface{})) != 3 {
+		t.Errorf("Expected optional jwt security, but got %v", document["security"])
+	}
+}
+
+func TestOpenApiApiKeySecurity(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, line := range []string{
+		"get /reports, name: 'get_reports' | apikey",
+		`get /reports, name: 'get_reports' | apikey {"scopes": ["reports:read"]}`,
+	} {
+		route, err := ParseRoute([]byte(line))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		operation := openApiJson(t, openApiOperation(api, route, 5, nil))
+		if operation["security"] == nil {
+			t.Errorf("Expected %v to require api key, but got %v", line, operation)
+		}
+	}
+}
+
+func TestOpenApiConfig(t *testing.T) {
+	config := &Config{}
+	if config.OpenApiEnabled() {
+		t.Errorf("Expected openapi to be disabled by default")
+	}
+	config.OpenApi.Enabled = true
+	if !config.OpenApiEnabled() {
+		t.Errorf("Expected openapi to be enabled")
+	}
+	config.Mode = "production"
+	if config.OpenApiEnabled() {
+		t.Errorf("Expected openapi to be disabled in production mode")
+	}
+}
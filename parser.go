@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/gophergala2016/dbserver/plugins"
 	"github.com/xeipuuv/gojsonschema"
 	"io/ioutil"
 	"os"
@@ -14,6 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func ParseRoutes(path string) (*Api, error) {
@@ -41,14 +43,24 @@ func ParseRoutes(path string) (*Api, error) {
 			if err != nil {
 				return nil, err
 			}
-			err = ParseSqlTemplate(path, route)
-			if err != nil {
-				return nil, err
+			if route.Stream == nil {
+				err = ParseSqlTemplate(path, route)
+				if err != nil {
+					return nil, err
+				}
 			}
 			PropagateSchemas(route)
 			api.Routes = append(api.Routes, route)
 		}
 	}
+	api.JobQueue, err = ParseJobs(path)
+	if err != nil {
+		return nil, err
+	}
+	api.Schedule, err = ParseSchedule(path)
+	if err != nil {
+		return nil, err
+	}
 	return api, nil
 }
 
@@ -120,22 +132,23 @@ func ParseRoute(line []byte) (*Route, error) {
 		Versions:        make(map[int]*RouteVersion),
 		PluginPipelines: make([]*PluginPipeline, 0),
 	}
-	pipelines := bytes.Split(line, []byte("|"))
-	chunks := bytes.Split(pipelines[0], []byte(","))
+	pipelines := splitPipelines(line)
+	chunks := splitOptions(pipelines[0])
 	urlParams := bytes.Split(chunks[0], []byte(" "))
 	route.Method = strings.ToUpper(string(urlParams[0]))
 	route.Path = string(urlParams[1])
+	if route.Method == "STREAM" {
+		route.Stream = &Stream{
+			Filter:    make(map[string]string),
+			Heartbeat: 15 * time.Second,
+		}
+	}
 	for i, chunk := range chunks {
 		if i != 0 {
-			chunkParts := bytes.Split(chunk, []byte(":"))
-			if len(chunkParts) != 2 {
+			name, value, ok := parseOption(chunk)
+			if !ok {
 				return nil, fmt.Errorf("unexpected route parameters: %v", string(line))
 			}
-			name := string(bytes.TrimSpace(chunkParts[0]))
-			value := string(bytes.TrimSpace(chunkParts[1]))
-			if value[0] == '\'' && value[len(value)-1] == '\'' {
-				value = value[1 : len(value)-1]
-			}
 			if name == "name" {
 				route.Name = value
 			}
@@ -145,8 +158,20 @@ func ParseRoute(line []byte) (*Route, error) {
 			if name == "custom" && value == "true" {
 				route.Custom = true
 			}
+			if name == "description" {
+				route.Description = value
+			}
+			if route.Stream != nil {
+				err := ParseStreamOption(route.Stream, name, value)
+				if err != nil {
+					return nil, fmt.Errorf("%v: %v", string(line), err)
+				}
+			}
 		}
 	}
+	if route.Stream != nil && route.Stream.Channel == "" {
+		route.Stream.Channel = route.Name
+	}
 	if len(pipelines) > 0 {
 		for i := 1; i < len(pipelines); i++ {
 			pipeline := pipelines[i]
@@ -160,6 +185,198 @@ func ParseRoute(line []byte) (*Route, error) {
 	return route, nil
 }
 
+// splitOptions splits route definition by commas that are not inside of
+// quoted values. Quotes inside of quoted values are escaped by doubling them.
+func splitOptions(line []byte) [][]byte {
+	chunks := make([][]byte, 0)
+	for {
+		i := indexUnquoted(line, ',')
+		if i == -1 {
+			return append(chunks, line)
+		}
+		chunks = append(chunks, line[:i])
+		line = line[i+1:]
+	}
+}
+
+// splitPipelines splits definition into options and plugin pipelines. Pipes
+// inside of quoted option values don't start pipeline.
+func splitPipelines(line []byte) [][]byte {
+	i := indexUnquoted(line, '|')
+	if i == -1 {
+		return [][]byte{line}
+	}
+	return append([][]byte{line[:i]}, bytes.Split(line[i+1:], []byte("|"))...)
+}
+
+// indexUnquoted returns index of the first c that is not inside of quoted
+// value or -1.
+func indexUnquoted(line []byte, c byte) int {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\'' {
+			if quoted && i+1 < len(line) && line[i+1] == '\'' {
+				i++
+				continue
+			}
+			quoted = !quoted
+		}
+		if line[i] == c && !quoted {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseOption splits "name: 'value'" option into name and unquoted value.
+func parseOption(chunk []byte) (string, string, bool) {
+	parts := bytes.SplitN(chunk, []byte(":"), 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	name := string(bytes.TrimSpace(parts[0]))
+	value := string(bytes.TrimSpace(parts[1]))
+	if len(value) > 1 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		value = strings.Replace(value[1:len(value)-1], "''", "'", -1)
+	}
+	return name, value, true
+}
+
+func ParseStreamOption(stream *Stream, name string, value string) error {
+	var err error
+	switch name {
+	case "channel":
+		stream.Channel = value
+	case "heartbeat":
+		stream.Heartbeat, err = time.ParseDuration(value)
+		if err == nil && stream.Heartbeat <= 0 {
+			return fmt.Errorf("heartbeat has to be positive, but got: %v", value)
+		}
+	case "filter":
+		for _, condition := range strings.Fields(value) {
+			parts := strings.SplitN(condition, "=", 2)
+			if len(parts) != 2 || !strings.Contains(parts[1], ".") {
+				return fmt.Errorf("expected filter condition like 'field=jwt.claim', but got: %v", condition)
+			}
+			stream.Filter[parts[0]] = parts[1]
+		}
+	}
+	return err
+}
+
+func ParseJobs(path string) (*JobQueue, error) {
+	queue := &JobQueue{
+		Jobs:         make([]*Job, 0),
+		Workers:      1,
+		PollInterval: time.Second,
+	}
+	content, err := ioutil.ReadFile(path + "/jobs")
+	if os.IsNotExist(err) {
+		return queue, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(content, []byte("\n"))
+	for _, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("workers:")) {
+			_, value, _ := parseOption(line)
+			queue.Workers, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, err
+			}
+			if queue.Workers <= 0 {
+				return nil, fmt.Errorf("workers has to be positive, but got: %v", value)
+			}
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("poll_interval:")) {
+			_, value, _ := parseOption(line)
+			queue.PollInterval, err = time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			if queue.PollInterval <= 0 {
+				return nil, fmt.Errorf("poll_interval has to be positive, but got: %v", value)
+			}
+			continue
+		}
+		job, err := ParseJob(line)
+		if err != nil {
+			return nil, err
+		}
+		err = ParseSchema(path, job.Route)
+		if err != nil {
+			return nil, err
+		}
+		err = ParseSqlTemplate(path, job.Route)
+		if err != nil {
+			return nil, err
+		}
+		queue.Jobs = append(queue.Jobs, job)
+	}
+	return queue, nil
+}
+
+func ParseJob(line []byte) (*Job, error) {
+	job := &Job{
+		Route: &Route{
+			Method:          "JOB",
+			Versions:        make(map[int]*RouteVersion),
+			PluginPipelines: make([]*PluginPipeline, 0),
+		},
+		Retries: 5,
+		Backoff: 10 * time.Second,
+	}
+	pipelines := splitPipelines(line)
+	chunks := splitOptions(pipelines[0])
+	header := bytes.Fields(chunks[0])
+	if len(header) != 2 || string(header[0]) != "job" {
+		return nil, fmt.Errorf("expected job definition, but got: %v", string(line))
+	}
+	job.Name = string(header[1])
+	for _, chunk := range chunks[1:] {
+		name, value, ok := parseOption(chunk)
+		if !ok {
+			return nil, fmt.Errorf("unexpected job parameters: %v", string(line))
+		}
+		var err error
+		switch name {
+		case "retries":
+			job.Retries, err = strconv.Atoi(value)
+			if err == nil && job.Retries < 0 {
+				err = fmt.Errorf("retries can't be negative, but got: %v", value)
+			}
+		case "backoff":
+			job.Backoff, err = time.ParseDuration(value)
+			if err == nil && job.Backoff <= 0 {
+				err = fmt.Errorf("backoff has to be positive, but got: %v", value)
+			}
+		case "collection":
+			job.Collection = value == "true"
+		case "custom":
+			job.Custom = value == "true"
+		default:
+			err = fmt.Errorf("unknown job parameter %v", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v job: %v", job.Name, err)
+		}
+	}
+	for _, pipeline := range pipelines[1:] {
+		pluginPipeline, err := ParsePluginPipeline(pipeline)
+		if err != nil {
+			return nil, err
+		}
+		job.PluginPipelines = append(job.PluginPipelines, pluginPipeline)
+	}
+	return job, nil
+}
+
 func ParsePluginPipeline(content []byte) (*PluginPipeline, error) {
 	content = bytes.TrimSpace(content)
 	chunks := bytes.Split(content, []byte(" "))
@@ -179,6 +396,81 @@ func ParsePluginPipeline(content []byte) (*PluginPipeline, error) {
 	pp.Argument = arg
 	return pp, nil
 }
+
+func ParseSchedule(path string) (*Schedule, error) {
+	schedule := &Schedule{
+		Tasks:    make([]*Task, 0),
+		Location: time.Local,
+	}
+	content, err := ioutil.ReadFile(path + "/schedule")
+	if os.IsNotExist(err) {
+		return schedule, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(content, []byte("\n"))
+	for _, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("timezone:")) {
+			value := bytes.Trim(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("timezone:"))), "'")
+			schedule.Location, err = time.LoadLocation(string(value))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		task, err := ParseTask(line)
+		if err != nil {
+			return nil, err
+		}
+		err = ParseSqlTemplate(path, task.Route)
+		if err != nil {
+			return nil, err
+		}
+		schedule.Tasks = append(schedule.Tasks, task)
+	}
+	return schedule, nil
+}
+
+func ParseTask(line []byte) (*Task, error) {
+	task := &Task{
+		Route: &Route{
+			Method:          "TASK",
+			Custom:          true,
+			Versions:        make(map[int]*RouteVersion),
+			PluginPipelines: make([]*PluginPipeline, 0),
+		},
+	}
+	var name []byte
+	if line[0] == '\'' {
+		end := bytes.IndexByte(line[1:], '\'')
+		if end == -1 {
+			return nil, fmt.Errorf("unterminated cron expression: %v", string(line))
+		}
+		task.Cron = string(line[1 : end+1])
+		name = line[end+2:]
+	} else {
+		fields := bytes.Fields(line)
+		task.Cron = string(fields[0])
+		name = line[len(fields[0]):]
+	}
+	fields := bytes.Fields(name)
+	if len(fields) != 1 {
+		return nil, fmt.Errorf("expected cron expression and task name, but got: %v", string(line))
+	}
+	task.Name = string(fields[0])
+	var err error
+	task.Schedule, err = ParseCron(task.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("%v task: %v", task.Name, err)
+	}
+	return task, nil
+}
+
 func ParseSchema(path string, route *Route) error {
 	files, err := filepath.Glob(path + "/schemas/" + route.Name + ".v[0-9]*.schema")
 	if err != nil {
@@ -204,6 +496,24 @@ func ParseSchema(path string, route *Route) error {
 			return err
 		}
 	}
+	return ParseResponseSchema(path, route)
+}
+
+// ParseResponseSchema reads optional response schema that is used only for
+// documentation.
+func ParseResponseSchema(path string, route *Route) error {
+	content, err := ioutil.ReadFile(path + "/schemas/" + route.Name + ".response.schema")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	route.ResponseSchema = make(map[string]interface{})
+	err = json.Unmarshal(content, &route.ResponseSchema)
+	if err != nil {
+		return fmt.Errorf("%v response schema: %v", route.Name, err)
+	}
 	return nil
 }
 
@@ -216,13 +526,36 @@ func ParseSchemaVersion(route *Route, path string, version int) error {
 	if err != nil {
 		return err
 	}
+	files, err := ParseFileRules(content)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
 	if route.Versions[version] == nil {
 		route.Versions[version] = &RouteVersion{Version: version}
 	}
+	schemaJson := make(map[string]interface{})
+	err = json.Unmarshal(content, &schemaJson)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
 	route.Versions[version].Schema = schema
+	route.Versions[version].SchemaJson = schemaJson
+	route.Versions[version].SchemaFile = filepath.Clean(path)
+	route.Versions[version].Files = files
 	return nil
 }
 
+func ParseFileRules(schemaContent []byte) (map[string]*FileRule, error) {
+	schema := struct {
+		Files map[string]*FileRule
+	}{}
+	err := json.Unmarshal(schemaContent, &schema)
+	if err != nil {
+		return nil, err
+	}
+	return schema.Files, nil
+}
+
 var versionRegexp = regexp.MustCompile(".v([0-9]*).(sql|schema)$")
 
 func ParseSqlTemplate(path string, route *Route) error {
@@ -259,7 +592,7 @@ func ParseSqlTemplate(path string, route *Route) error {
 func ParseSqlTemplateVersion(route *Route, path string, version int) error {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("missing sql template", path)
+		return fmt.Errorf("missing sql template: %v", path)
 	}
 	tmpl, err := makeTemplate(string(bytes.TrimSpace(content)))
 	if err != nil {
@@ -269,6 +602,7 @@ func ParseSqlTemplateVersion(route *Route, path string, version int) error {
 		route.Versions[version] = &RouteVersion{Version: version}
 	}
 	route.Versions[version].SqlTemplate = tmpl
+	route.Versions[version].SqlFile = filepath.Clean(path)
 	return nil
 }
 
@@ -281,14 +615,26 @@ func PropagateSchemas(route *Route) {
 	}
 	sort.Ints(versions)
 	var schema *gojsonschema.Schema
+	var schemaJson map[string]interface{}
+	var schemaFile string
+	var files map[string]*FileRule
 	if route.Versions[0] != nil {
 		schema = route.Versions[0].Schema
+		schemaJson = route.Versions[0].SchemaJson
+		schemaFile = route.Versions[0].SchemaFile
+		files = route.Versions[0].Files
 	}
 	for i := len(versions) - 1; i >= 0; i-- {
 		if route.Versions[versions[i]].Schema == nil {
 			route.Versions[versions[i]].Schema = schema
+			route.Versions[versions[i]].SchemaJson = schemaJson
+			route.Versions[versions[i]].SchemaFile = schemaFile
+			route.Versions[versions[i]].Files = files
 		} else {
 			schema = route.Versions[versions[i]].Schema
+			schemaJson = route.Versions[versions[i]].SchemaJson
+			schemaFile = route.Versions[versions[i]].SchemaFile
+			files = route.Versions[versions[i]].Files
 		}
 	}
 }
@@ -327,3 +673,118 @@ func ParseDbConfig(path string) (*DbConfig, error) {
 	return conf, nil
 
 }
+
+type Config struct {
+	Mode              string
+	RequireMigrations bool  `toml:"require_migrations"`
+	MaxBodySize       int64 `toml:"max_body_size"`
+	Storage           StorageConfig
+	Admin             AdminConfig
+	OpenApi           OpenApiConfig `toml:"openapi"`
+	Debug             DebugConfig
+	Metrics           MetricsConfig
+	Health            HealthConfig
+	Tracing           TracingConfig
+}
+
+// DebugEnabled reports whether requests can ask for debug information. It's
+// never enabled in production mode.
+func (self *Config) DebugEnabled() bool {
+	return self.Debug.Enabled && self.Mode != "production"
+}
+
+// OpenApiEnabled reports whether OpenAPI documents are served. Like debug,
+// they're never served in production mode.
+func (self *Config) OpenApiEnabled() bool {
+	return self.OpenApi.Enabled && self.Mode != "production"
+}
+
+type DebugConfig struct {
+	Enabled bool
+}
+
+type MetricsConfig struct {
+	Enabled bool
+	Listen  string
+}
+
+type HealthConfig struct {
+	HealthPath string `toml:"health_path"`
+	ReadyPath  string `toml:"ready_path"`
+	Timeout    plugins.Duration
+}
+
+// TracingConfig configures span export, exporter is "otlp", "stdout" or
+// "file". Tracing is disabled when exporter is empty.
+type TracingConfig struct {
+	Exporter    string
+	Endpoint    string
+	Headers     map[string]string
+	File        string
+	ServiceName string `toml:"service_name"`
+}
+
+type OpenApiConfig struct {
+	Enabled     bool
+	Title       string
+	Description string
+}
+
+type AdminConfig struct {
+	Token string
+}
+
+type StorageConfig struct {
+	Type      string
+	Directory string
+	UrlPrefix string `toml:"url_prefix"`
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	PublicUrl string `toml:"public_url"`
+}
+
+func ParseConfig(path string) (*Config, error) {
+	conf := &Config{}
+	content, err := ioutil.ReadFile(path + "/config.toml")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error while reading config.toml configuration: %v", err))
+	}
+	_, err = toml.Decode(string(content), conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.MaxBodySize == 0 {
+		conf.MaxBodySize = 64 << 20
+	}
+	if conf.Storage.Type == "" {
+		conf.Storage.Type = "local"
+	}
+	if conf.Storage.Directory == "" {
+		conf.Storage.Directory = "uploads"
+	}
+	if conf.Storage.Region == "" {
+		conf.Storage.Region = "us-east-1"
+	}
+	if conf.OpenApi.Title == "" {
+		conf.OpenApi.Title = "API"
+	}
+	if conf.Health.HealthPath == "" {
+		conf.Health.HealthPath = "/_health"
+	}
+	if conf.Health.ReadyPath == "" {
+		conf.Health.ReadyPath = "/_ready"
+	}
+	if conf.Health.Timeout.Duration == 0 {
+		conf.Health.Timeout.Duration = 2 * time.Second
+	}
+	if conf.Tracing.Endpoint == "" {
+		conf.Tracing.Endpoint = "http://localhost:4318"
+	}
+	if conf.Tracing.ServiceName == "" {
+		conf.Tracing.ServiceName = "dbservice"
+	}
+	return conf, nil
+}
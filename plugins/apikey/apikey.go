@@ -0,0 +1,217 @@
+package apikey
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gophergala2016/dbserver/plugins"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cacheHits   = plugins.NewCounter("dbservice_cache_hits_total", "Lookups served from cache.", "cache")
+	cacheMisses = plugins.NewCounter("dbservice_cache_misses_total", "Lookups that weren't in cache.", "cache")
+)
+
+type ApiKey struct {
+	Header        string
+	QueryParam    string `toml:"query_param"`
+	Table         string
+	HashColumn    string           `toml:"hash_column"`
+	OwnerColumn   string           `toml:"owner_column"`
+	ScopesColumn  string           `toml:"scopes_column"`
+	ExpiresColumn string           `toml:"expires_column"`
+	CacheTtl      plugins.Duration `toml:"cache_ttl"`
+	CacheSize     int              `toml:"cache_size"`
+	db            *sql.DB
+	cache         map[string]*cacheEntry
+	mutex         sync.Mutex
+}
+
+type Key struct {
+	Owner     string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+type cacheEntry struct {
+	key      *Key
+	cachedAt time.Time
+}
+
+func (self *ApiKey) ParseConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error while reading plugin config: %v", err))
+	}
+	self.Header = "X-Api-Key"
+	self.QueryParam = "api_key"
+	self.Table = "api_keys"
+	self.HashColumn = "key_hash"
+	self.OwnerColumn = "owner"
+	self.ScopesColumn = "scopes"
+	self.ExpiresColumn = "expires_at"
+	self.CacheTtl.Duration = time.Minute
+	self.CacheSize = 10000
+	_, err = toml.Decode(string(content), self)
+	return err
+}
+
+func (self *ApiKey) SetDb(db *sql.DB) {
+	self.db = db
+}
+
+func (self *ApiKey) Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response {
+	return &plugins.Response{Data: data}
+}
+
+func (self *ApiKey) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	value := r.Header.Get(self.Header)
+	if value == "" && self.QueryParam != "" {
+		value = r.URL.Query().Get(self.QueryParam)
+		if params, ok := data["params"].(map[string]interface{}); ok {
+			delete(params, self.QueryParam)
+		}
+	}
+	if value == "" {
+		return nil
+	}
+	var key *Key
+	var err error
+	if tx := plugins.TxFromContext(r.Context()); tx != nil {
+		// Keys from transaction aren't cached, it's going to be rolled back.
+		key, err = self.query(tx, HashKey(value))
+	} else {
+		key, err = self.find(HashKey(value))
+	}
+	if err != nil {
+		return &plugins.Response{ResponseCode: http.StatusInternalServerError, Error: err.Error()}
+	}
+	if key == nil || (!key.ExpiresAt.IsZero() && key.ExpiresAt.Before(time.Now())) {
+		return &plugins.Response{ResponseCode: http.StatusUnauthorized, Error: "Invalid API key"}
+	}
+	data["apikey"] = map[string]interface{}{
+		"owner":  key.Owner,
+		"scopes": key.Scopes,
+	}
+	return nil
+}
+
+func (self *ApiKey) ProcessRouteHook(route string, data map[string]interface{}, arg map[string]interface{}, r *http.Request) *plugins.Response {
+	apiKey, ok := data["apikey"].(map[string]interface{})
+	if !ok {
+		return &plugins.Response{ResponseCode: http.StatusUnauthorized, Error: "API key required"}
+	}
+	scopes, _ := apiKey["scopes"].([]string)
+	requiredScopes, _ := arg["scopes"].([]interface{})
+	for _, requiredScope := range requiredScopes {
+		if !hasScope(scopes, fmt.Sprintf("%v", requiredScope)) {
+			return &plugins.Response{
+				ResponseCode: http.StatusForbidden,
+				Error:        fmt.Sprintf("API key is missing %v scope", requiredScope),
+			}
+		}
+	}
+	return nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func HashKey(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+func (self *ApiKey) find(hash string) (*Key, error) {
+	self.mutex.Lock()
+	if self.cache == nil {
+		self.cache = make(map[string]*cacheEntry)
+	}
+	entry := self.cache[hash]
+	self.mutex.Unlock()
+	if entry != nil && time.Since(entry.cachedAt) < self.CacheTtl.Duration {
+		cacheHits.Inc("apikey")
+		return entry.key, nil
+	}
+	cacheMisses.Inc("apikey")
+	if self.db == nil {
+		return nil, errors.New("apikey plugin doesn't have database connection")
+	}
+	key, err := self.query(self.db, hash)
+	if err != nil {
+		return nil, err
+	}
+	// Unknown keys aren't cached, otherwise random keys would fill the cache.
+	if key != nil {
+		self.store(hash, key)
+	}
+	return key, nil
+}
+
+// store caches key, expired entries are purged when cache is full and if
+// that isn't enough, the oldest entry is evicted.
+func (self *ApiKey) store(hash string, key *Key) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if _, ok := self.cache[hash]; !ok && self.CacheSize > 0 && len(self.cache) >= self.CacheSize {
+		var oldest string
+		for cached, entry := range self.cache {
+			if time.Since(entry.cachedAt) >= self.CacheTtl.Duration {
+				delete(self.cache, cached)
+			} else if oldest == "" || entry.cachedAt.Before(self.cache[oldest].cachedAt) {
+				oldest = cached
+			}
+		}
+		if len(self.cache) >= self.CacheSize {
+			delete(self.cache, oldest)
+		}
+	}
+	self.cache[hash] = &cacheEntry{key: key, cachedAt: time.Now()}
+}
+
+func (self *ApiKey) query(q plugins.QueryRower, hash string) (*Key, error) {
+	query := fmt.Sprintf("select %v, %v, %v from %v where %v = $1",
+		quoteIdentifier(self.OwnerColumn),
+		quoteIdentifier(self.ScopesColumn),
+		quoteIdentifier(self.ExpiresColumn),
+		quoteIdentifier(self.Table),
+		quoteIdentifier(self.HashColumn))
+	var owner string
+	var scopes pq.StringArray
+	var expiresAt pq.NullTime
+	err := q.QueryRow(query, hash).Scan(&owner, &scopes, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{Owner: owner, Scopes: []string(scopes)}
+	if expiresAt.Valid {
+		key.ExpiresAt = expiresAt.Time
+	}
+	return key, nil
+}
+
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,107 @@
+package apikey
+
+import (
+	"github.com/gophergala2016/dbserver/plugins"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	apiKey := &ApiKey{}
+	err := apiKey.ParseConfig("test_config/apikey.toml")
+	if err != nil {
+		t.Error(err)
+	}
+	if apiKey.Header != "Authorization-Key" {
+		t.Errorf("Expected header to be 'Authorization-Key', but got: '%v'", apiKey.Header)
+	}
+	if apiKey.QueryParam != "api_key" {
+		t.Errorf("Expected default query param 'api_key', but got: '%v'", apiKey.QueryParam)
+	}
+	if apiKey.CacheTtl.Duration != 5*time.Minute {
+		t.Errorf("Expected 5 minute cache ttl, but got: %v", apiKey.CacheTtl.Duration)
+	}
+	if quoteIdentifier(apiKey.Table) != `"auth"."keys"` {
+		t.Errorf("Expected table to be quoted as schema and table, but got: %v", quoteIdentifier(apiKey.Table))
+	}
+}
+
+func newApiKey(keys map[string]*Key) *ApiKey {
+	apiKey := &ApiKey{Header: "X-Api-Key", QueryParam: "api_key", CacheTtl: plugins.Duration{Duration: time.Hour}}
+	apiKey.cache = make(map[string]*cacheEntry)
+	for value, key := range keys {
+		apiKey.cache[HashKey(value)] = &cacheEntry{key: key, cachedAt: time.Now()}
+	}
+	return apiKey
+}
+
+func TestProcessBeforeHook(t *testing.T) {
+	apiKey := newApiKey(map[string]*Key{
+		"valid":   {Owner: "partner", Scopes: []string{"products:read"}},
+		"expired": {Owner: "partner", ExpiresAt: time.Now().Add(-time.Hour)},
+		"unknown": nil,
+	})
+
+	data := map[string]interface{}{"params": map[string]interface{}{"api_key": "valid"}}
+	r := httptest.NewRequest("GET", "/products?api_key=valid", nil)
+	response := apiKey.ProcessBeforeHook(data, r)
+	if response != nil {
+		t.Errorf("Not expected to get response for valid key, but got: %v", response)
+	}
+	key, ok := data["apikey"].(map[string]interface{})
+	if !ok || key["owner"] != "partner" {
+		t.Errorf("Expected apikey owner to be set, but got: %v", data["apikey"])
+	}
+	if _, ok := data["params"].(map[string]interface{})["api_key"]; ok {
+		t.Error("Expected api_key to be removed from params")
+	}
+
+	for _, value := range []string{"expired", "unknown"} {
+		r = httptest.NewRequest("GET", "/products", nil)
+		r.Header.Set("X-Api-Key", value)
+		response = apiKey.ProcessBeforeHook(make(map[string]interface{}), r)
+		if response == nil || response.ResponseCode != http.StatusUnauthorized {
+			t.Errorf("Expected unauthorized response for %v key, but got: %v", value, response)
+		}
+	}
+
+	r = httptest.NewRequest("GET", "/products", nil)
+	if response := apiKey.ProcessBeforeHook(make(map[string]interface{}), r); response != nil {
+		t.Errorf("Not expected to get response without key, but got: %v", response)
+	}
+}
+
+func TestProcessRouteHook(t *testing.T) {
+	apiKey := newApiKey(nil)
+	arg := map[string]interface{}{"scopes": []interface{}{"products:write"}}
+	r := httptest.NewRequest("POST", "/products", nil)
+	response := apiKey.ProcessRouteHook("create_product", make(map[string]interface{}), arg, r)
+	if response == nil || response.ResponseCode != http.StatusUnauthorized {
+		t.Errorf("Expected unauthorized response without key, but got: %v", response)
+	}
+	data := map[string]interface{}{"apikey": map[string]interface{}{"owner": "partner", "scopes": []string{"products:read"}}}
+	response = apiKey.ProcessRouteHook("create_product", data, arg, r)
+	if response == nil || response.ResponseCode != http.StatusForbidden {
+		t.Errorf("Expected forbidden response without scope, but got: %v", response)
+	}
+	data["apikey"].(map[string]interface{})["scopes"] = []string{"products:read", "products:write"}
+	if response = apiKey.ProcessRouteHook("create_product", data, arg, r); response != nil {
+		t.Errorf("Not expected to get response with required scope, but got: %v", response)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	apiKey := newApiKey(map[string]*Key{"first": {Owner: "first"}})
+	apiKey.CacheSize = 2
+	apiKey.cache[HashKey("expired")] = &cacheEntry{key: &Key{Owner: "expired"}, cachedAt: time.Now().Add(-2 * time.Hour)}
+	apiKey.store(HashKey("second"), &Key{Owner: "second"})
+	if len(apiKey.cache) != 2 || apiKey.cache[HashKey("expired")] != nil {
+		t.Errorf("Expected expired entry to be purged, but got: %v", apiKey.cache)
+	}
+	apiKey.store(HashKey("third"), &Key{Owner: "third"})
+	if len(apiKey.cache) != 2 || apiKey.cache[HashKey("first")] != nil || apiKey.cache[HashKey("third")] == nil {
+		t.Errorf("Expected oldest entry to be evicted, but got: %v", apiKey.cache)
+	}
+}
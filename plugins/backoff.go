@@ -0,0 +1,12 @@
+package plugins
+
+import (
+	"math"
+	"time"
+)
+
+// Backoff returns exponential retry delay: base after first failed attempt,
+// doubled after every next one. Jobs and webhook deliveries use it.
+func Backoff(base time.Duration, attempt int) time.Duration {
+	return base * time.Duration(math.Pow(2, float64(attempt-1)))
+}
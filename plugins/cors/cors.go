@@ -0,0 +1,172 @@
+package cors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gophergala2016/dbserver/plugins"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type Cors struct {
+	AllowedOrigins   []string         `toml:"allowed_origins" json:"allowed_origins"`
+	AllowedMethods   []string         `toml:"allowed_methods" json:"allowed_methods"`
+	AllowedHeaders   []string         `toml:"allowed_headers" json:"allowed_headers"`
+	ExposedHeaders   []string         `toml:"exposed_headers" json:"exposed_headers"`
+	AllowCredentials bool             `toml:"allow_credentials" json:"allow_credentials"`
+	MaxAge           plugins.Duration `toml:"max_age" json:"max_age"`
+}
+
+var corsHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Expose-Headers",
+}
+
+func (self *Cors) ParseConfig(configPath string) error {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error while reading plugin config: %v", err))
+	}
+	self.AllowedMethods = []string{"GET", "POST", "PUT", "DELETE"}
+	self.AllowedHeaders = []string{"Accept", "Content-Type", "Authorization", "Api-Version", "X-CSRF-Token"}
+	_, err = toml.Decode(string(content), self)
+	if err != nil {
+		return err
+	}
+	for _, origin := range self.AllowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil {
+			return fmt.Errorf("Invalid allowed origin pattern %v: %v", origin, err)
+		}
+	}
+	return nil
+}
+
+func (self *Cors) Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response {
+	return &plugins.Response{Data: data}
+}
+
+func (self *Cors) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	return &plugins.Response{Headers: self.headers(r)}
+}
+
+func (self *Cors) ProcessRouteHook(route string, data map[string]interface{}, arg map[string]interface{}, r *http.Request) *plugins.Response {
+	policy, err := self.policy(arg)
+	if err != nil {
+		return &plugins.Response{ResponseCode: http.StatusInternalServerError, Error: err.Error()}
+	}
+	return &plugins.Response{Headers: policy.headers(r)}
+}
+
+func (self *Cors) ProcessPreflight(arg map[string]interface{}, methods []string, r *http.Request) *plugins.Response {
+	policy, err := self.policy(arg)
+	if err != nil {
+		return &plugins.Response{ResponseCode: http.StatusInternalServerError, Error: err.Error()}
+	}
+	if r.Header.Get("Origin") == "" {
+		return &plugins.Response{Headers: map[string][]string{"Allow": {strings.Join(methods, ", ")}}}
+	}
+	headers := policy.headers(r)
+	if len(headers["Access-Control-Allow-Origin"]) == 0 {
+		return &plugins.Response{ResponseCode: http.StatusForbidden, Error: "Origin is not allowed"}
+	}
+	allowedMethods := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if contains(policy.AllowedMethods, method) {
+			allowedMethods = append(allowedMethods, method)
+		}
+	}
+	requestMethod := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	if !contains(allowedMethods, requestMethod) {
+		return &plugins.Response{ResponseCode: http.StatusForbidden, Error: "Method is not allowed"}
+	}
+	headers["Access-Control-Allow-Methods"] = []string{strings.Join(allowedMethods, ", ")}
+	if len(policy.AllowedHeaders) > 0 {
+		headers["Access-Control-Allow-Headers"] = []string{strings.Join(policy.AllowedHeaders, ", ")}
+	}
+	if policy.MaxAge.Duration > 0 {
+		headers["Access-Control-Max-Age"] = []string{strconv.Itoa(int(policy.MaxAge.Seconds()))}
+	}
+	return &plugins.Response{Headers: headers}
+}
+
+func (self *Cors) ValidateArgument(arg map[string]interface{}) error {
+	policy, err := self.policy(arg)
+	if err != nil {
+		return err
+	}
+	for _, origin := range policy.AllowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil {
+			return fmt.Errorf("Invalid allowed origin pattern %v: %v", origin, err)
+		}
+	}
+	return nil
+}
+
+func (self *Cors) policy(arg map[string]interface{}) (*Cors, error) {
+	policy := *self
+	if len(arg) == 0 {
+		return &policy, nil
+	}
+	content, err := json.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cors route policy: %v", err)
+	}
+	return &policy, nil
+}
+
+// headers returns values for all cors response headers. Empty values remove
+// headers that could have been set by less specific policy.
+func (self *Cors) headers(r *http.Request) map[string][]string {
+	headers := make(map[string][]string)
+	for _, name := range corsHeaders {
+		headers[name] = []string{}
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" || !self.allowedOrigin(origin) {
+		return headers
+	}
+	if contains(self.AllowedOrigins, "*") && !self.AllowCredentials {
+		headers["Access-Control-Allow-Origin"] = []string{"*"}
+	} else {
+		headers["Access-Control-Allow-Origin"] = []string{origin}
+		headers["Vary"] = []string{"Origin"}
+	}
+	if self.AllowCredentials {
+		headers["Access-Control-Allow-Credentials"] = []string{"true"}
+	}
+	if len(self.ExposedHeaders) > 0 {
+		headers["Access-Control-Expose-Headers"] = []string{strings.Join(self.ExposedHeaders, ", ")}
+	}
+	return headers
+}
+
+func (self *Cors) allowedOrigin(origin string) bool {
+	for _, pattern := range self.AllowedOrigins {
+		if pattern == "*" {
+			return true
+		}
+		if matched, _ := path.Match(pattern, origin); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
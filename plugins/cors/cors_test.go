@@ -0,0 +1,111 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cors := &Cors{}
+	err := cors.ParseConfig("test_config/cors.toml")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(cors.AllowedOrigins) != 2 {
+		t.Errorf("Expected to get 2 allowed origins, but got: %v", cors.AllowedOrigins)
+	}
+	if len(cors.AllowedHeaders) == 0 {
+		t.Error("Expected to get default allowed headers, but got none")
+	}
+	if cors.MaxAge.Duration != 10*time.Minute {
+		t.Errorf("Expected 10 minute max age, but got: %v", cors.MaxAge.Duration)
+	}
+}
+
+func request(method string, origin string) *http.Request {
+	r := httptest.NewRequest(method, "/products", nil)
+	r.Header.Set("Origin", origin)
+	return r
+}
+
+func TestProcessBeforeHook(t *testing.T) {
+	cors := &Cors{AllowedOrigins: []string{"https://*.example.org"}, AllowCredentials: true}
+	response := cors.ProcessBeforeHook(nil, request("GET", "https://app.example.org"))
+	if origin := response.Headers["Access-Control-Allow-Origin"]; len(origin) != 1 || origin[0] != "https://app.example.org" {
+		t.Errorf("Expected origin to be allowed by pattern, but got: %v", origin)
+	}
+	if len(response.Headers["Access-Control-Allow-Credentials"]) != 1 {
+		t.Error("Expected to get allow credentials header, but got none")
+	}
+	response = cors.ProcessBeforeHook(nil, request("GET", "https://example.com"))
+	if len(response.Headers["Access-Control-Allow-Origin"]) != 0 {
+		t.Errorf("Not expected origin to be allowed, but got: %v", response.Headers["Access-Control-Allow-Origin"])
+	}
+	cors = &Cors{AllowedOrigins: []string{"*"}}
+	response = cors.ProcessBeforeHook(nil, request("GET", "https://example.com"))
+	if origin := response.Headers["Access-Control-Allow-Origin"]; len(origin) != 1 || origin[0] != "*" {
+		t.Errorf("Expected any origin to be allowed, but got: %v", origin)
+	}
+}
+
+func TestProcessRouteHook(t *testing.T) {
+	cors := &Cors{AllowedOrigins: []string{"https://app.example.com"}}
+	arg := map[string]interface{}{"allowed_origins": []interface{}{"https://partner.example.com"}}
+	response := cors.ProcessRouteHook("get_products", nil, arg, request("GET", "https://app.example.com"))
+	if len(response.Headers["Access-Control-Allow-Origin"]) != 0 {
+		t.Errorf("Expected route policy to override allowed origins, but got: %v", response.Headers["Access-Control-Allow-Origin"])
+	}
+	response = cors.ProcessRouteHook("get_products", nil, arg, request("GET", "https://partner.example.com"))
+	if len(response.Headers["Access-Control-Allow-Origin"]) != 1 {
+		t.Error("Expected origin to be allowed by route policy, but it wasn't")
+	}
+}
+
+func TestValidateArgument(t *testing.T) {
+	cors := &Cors{}
+	for _, arg := range []map[string]interface{}{
+		{"max_age": "soon"},
+		{"allowed_origins": []interface{}{"https://[example.com"}},
+		{"allow_credentials": "yes"},
+	} {
+		if err := cors.ValidateArgument(arg); err == nil {
+			t.Errorf("Expected %v to be invalid", arg)
+		}
+	}
+	if err := cors.ValidateArgument(map[string]interface{}{"max_age": float64(600)}); err != nil {
+		t.Errorf("Expected numeric max age to be valid, but got: %v", err)
+	}
+}
+
+func TestProcessPreflight(t *testing.T) {
+	cors := &Cors{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"Content-Type"},
+	}
+	r := request("OPTIONS", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	arg := map[string]interface{}{"max_age": "1h"}
+	response := cors.ProcessPreflight(arg, []string{"GET", "POST", "DELETE"}, r)
+	if response.ResponseCode != 0 {
+		t.Errorf("Expected preflight to succeed, but got: %v %v", response.ResponseCode, response.Error)
+	}
+	if methods := response.Headers["Access-Control-Allow-Methods"]; len(methods) != 1 || methods[0] != "GET, POST" {
+		t.Errorf("Expected to get 'GET, POST' allowed methods, but got: %v", methods)
+	}
+	if maxAge := response.Headers["Access-Control-Max-Age"]; len(maxAge) != 1 || maxAge[0] != "3600" {
+		t.Errorf("Expected to get max age from route policy, but got: %v", maxAge)
+	}
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	response = cors.ProcessPreflight(map[string]interface{}{"max_age": float64(600)}, []string{"GET"}, r)
+	if maxAge := response.Headers["Access-Control-Max-Age"]; len(maxAge) != 1 || maxAge[0] != "600" {
+		t.Errorf("Expected to get max age in seconds, but got: %v %v", maxAge, response.Error)
+	}
+	r.Header.Set("Access-Control-Request-Method", "DELETE")
+	response = cors.ProcessPreflight(nil, []string{"GET", "POST", "DELETE"}, r)
+	if response.ResponseCode != http.StatusForbidden {
+		t.Errorf("Expected preflight for not allowed method to be forbidden, but got: %v", response.ResponseCode)
+	}
+}
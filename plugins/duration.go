@@ -0,0 +1,31 @@
+package plugins
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// UnmarshalJSON accepts duration strings like "1m" and numbers of seconds.
+func (d *Duration) UnmarshalJSON(content []byte) error {
+	var seconds float64
+	if json.Unmarshal(content, &seconds) == nil {
+		d.Duration = time.Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var text string
+	err := json.Unmarshal(content, &text)
+	if err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(text))
+}
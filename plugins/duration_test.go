@@ -0,0 +1,24 @@
+package plugins
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDurationJson(t *testing.T) {
+	var value struct {
+		Text    Duration
+		Seconds Duration
+	}
+	err := json.Unmarshal([]byte(`{"text": "1m", "seconds": 600}`), &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.Text.Duration != time.Minute || value.Seconds.Duration != 10*time.Minute {
+		t.Errorf("Unexpected durations: %v %v", value.Text, value.Seconds)
+	}
+	if err := json.Unmarshal([]byte(`{"text": "soon"}`), &value); err == nil {
+		t.Error("Expected invalid duration to fail")
+	}
+}
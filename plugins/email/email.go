@@ -0,0 +1,179 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gophergala2016/dbserver/plugins"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type Email struct {
+	Transport     string
+	From          string
+	Host          string
+	Port          int
+	Username      string
+	Password      string
+	Directory     string
+	RetryAttempts int              `toml:"retry_attempts"`
+	RetryInterval plugins.Duration `toml:"retry_interval"`
+	EmailsDir     string           `toml:"emails_dir"`
+	templates     map[string]*emailTemplate
+	queue         *queue
+}
+
+type emailTemplate struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+func (self *Email) ParseConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error while reading plugin config: %v", err))
+	}
+	self.Transport = "smtp"
+	self.Host = "127.0.0.1"
+	self.Port = 25
+	self.Directory = "emails/sent"
+	self.RetryAttempts = 5
+	self.RetryInterval.Duration = time.Minute
+	_, err = toml.Decode(string(content), self)
+	if err != nil {
+		return err
+	}
+	if self.From == "" {
+		return errors.New("email plugin requires from address")
+	}
+	if self.EmailsDir == "" {
+		self.EmailsDir = filepath.Join(filepath.Dir(filepath.Dir(path)), "emails")
+	}
+	var transport Transport
+	switch self.Transport {
+	case "smtp":
+		transport = &SmtpTransport{Host: self.Host, Port: self.Port, Username: self.Username, Password: self.Password}
+	case "file":
+		transport = &FileTransport{Directory: self.Directory}
+	case "log":
+		transport = &LogTransport{}
+	default:
+		return fmt.Errorf("Unknown email transport: %v", self.Transport)
+	}
+	self.queue = newQueue(transport, self.RetryAttempts, self.RetryInterval.Duration)
+	return self.parseTemplates()
+}
+
+func (self *Email) parseTemplates() error {
+	self.templates = make(map[string]*emailTemplate)
+	files, err := filepath.Glob(filepath.Join(self.EmailsDir, "*.subject"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".subject")
+		t := &emailTemplate{}
+		t.subject, err = template.ParseFiles(file)
+		if err != nil {
+			return err
+		}
+		textPath := filepath.Join(self.EmailsDir, name+".txt")
+		if _, err := os.Stat(textPath); err == nil {
+			t.text, err = template.ParseFiles(textPath)
+			if err != nil {
+				return err
+			}
+		}
+		htmlPath := filepath.Join(self.EmailsDir, name+".html")
+		if _, err := os.Stat(htmlPath); err == nil {
+			t.html, err = htmltemplate.ParseFiles(htmlPath)
+			if err != nil {
+				return err
+			}
+		}
+		if t.text == nil && t.html == nil {
+			return fmt.Errorf("%v email is missing .txt or .html body template", name)
+		}
+		self.templates[name] = t
+	}
+	return nil
+}
+
+func (self *Email) Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response {
+	response := &plugins.Response{Data: data}
+	message, err := self.message(data, arg)
+	if err != nil {
+		response.ResponseCode = http.StatusInternalServerError
+		response.Error = err.Error()
+		return response
+	}
+	if message == nil {
+		return response
+	}
+	self.queue.push(message)
+	return response
+}
+
+func (self *Email) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	return nil
+}
+
+// message renders email for the route result. No email is sent if result
+// doesn't have recipient field.
+func (self *Email) message(data map[string]interface{}, arg map[string]interface{}) (*Message, error) {
+	name, _ := arg["template"].(string)
+	t := self.templates[name]
+	if t == nil {
+		return nil, fmt.Errorf("Email template missing: %v", name)
+	}
+	toField, _ := arg["to"].(string)
+	if toField == "" {
+		toField = "email"
+	}
+	to, _ := data[toField].(string)
+	if to == "" {
+		log.Printf("%v email is not sent: result doesn't have %v field\n", name, toField)
+		return nil, nil
+	}
+	address, err := mail.ParseAddress(to)
+	if err != nil {
+		log.Printf("%v email is not sent: invalid %v field: %v\n", name, toField, err)
+		return nil, nil
+	}
+	message := &Message{From: self.From, To: []string{address.Address}}
+	var out bytes.Buffer
+	err = t.subject.Execute(&out, data)
+	if err != nil {
+		return nil, err
+	}
+	// Subject goes into header, so line breaks from result can't be kept.
+	message.Subject = strings.TrimSpace(strings.NewReplacer("\r", " ", "\n", " ").Replace(out.String()))
+	if t.text != nil {
+		out.Reset()
+		err = t.text.Execute(&out, data)
+		if err != nil {
+			return nil, err
+		}
+		message.Text = out.String()
+	}
+	if t.html != nil {
+		out.Reset()
+		err = t.html.Execute(&out, data)
+		if err != nil {
+			return nil, err
+		}
+		message.Html = out.String()
+	}
+	return message, nil
+}
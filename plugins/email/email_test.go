@@ -0,0 +1,169 @@
+package email
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	email := &Email{}
+	err := email.ParseConfig("test_app/plugins/email.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := email.queue.transport.(*FileTransport); !ok {
+		t.Errorf("Expected file transport, but got: %T", email.queue.transport)
+	}
+	if email.RetryInterval.Duration != 10*time.Millisecond {
+		t.Errorf("Expected 10ms retry interval, but got: %v", email.RetryInterval.Duration)
+	}
+	if email.templates["welcome"] == nil {
+		t.Error("Expected to parse welcome email template, but got nil")
+	}
+}
+
+func TestProcess(t *testing.T) {
+	directory, err := ioutil.TempDir("", "emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	email := &Email{}
+	err = email.ParseConfig("test_app/plugins/email.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email.queue.transport = &FileTransport{Directory: directory}
+	data := map[string]interface{}{"name": "Gopher", "email": "gopher@example.com"}
+	arg := map[string]interface{}{"template": "welcome", "to": "email"}
+	response := email.Process(data, arg)
+	if response.ResponseCode != 0 {
+		t.Errorf("Not expected to get error, but got: %v", response.Error)
+	}
+	if response.Data["email"] != "gopher@example.com" {
+		t.Error("Expected email plugin to keep response data")
+	}
+	email.queue.wait()
+	files, _ := ioutil.ReadDir(directory)
+	if len(files) != 1 {
+		t.Fatalf("Expected to write 1 email, but got: %v", len(files))
+	}
+	content, _ := ioutil.ReadFile(directory + "/" + files[0].Name())
+	for _, expected := range []string{"To: gopher@example.com", "Subject: Welcome, Gopher!", "multipart/alternative", "<p>Hi Gopher,</p>"} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("Expected email to contain '%v', but got:\n%s", expected, content)
+		}
+	}
+	for _, to := range []string{"gopher@example.com\r\nBcc: victim@example.com", "not an email"} {
+		message, err := email.message(map[string]interface{}{"name": "Gopher", "email": to}, arg)
+		if message != nil || err != nil {
+			t.Errorf("Expected invalid recipient %q to be skipped, but got: %v %v", to, message, err)
+		}
+	}
+	message, err := email.message(map[string]interface{}{"name": "Gopher\r\nBcc: victim@example.com", "email": "gopher@example.com"}, arg)
+	if err != nil || strings.ContainsAny(message.Subject, "\r\n") {
+		t.Errorf("Expected line breaks to be removed from subject, but got: %q %v", message.Subject, err)
+	}
+	response = email.Process(data, map[string]interface{}{"template": "missing"})
+	if response.ResponseCode == 0 {
+		t.Error("Expected to get error for missing template")
+	}
+}
+
+type failingTransport struct {
+	failures int
+	sent     int
+}
+
+func (self *failingTransport) Send(message *Message) error {
+	if self.failures > 0 {
+		self.failures--
+		return errors.New("connection refused")
+	}
+	self.sent++
+	return nil
+}
+
+func TestQueueRetry(t *testing.T) {
+	transport := &failingTransport{failures: 2}
+	q := newQueue(transport, 3, time.Millisecond)
+	q.push(&Message{To: []string{"gopher@example.com"}})
+	q.wait()
+	if transport.sent != 1 {
+		t.Errorf("Expected email to be sent on 3rd attempt, but got %v sent", transport.sent)
+	}
+	transport = &failingTransport{failures: 3}
+	q = newQueue(transport, 3, time.Millisecond)
+	q.push(&Message{To: []string{"gopher@example.com"}})
+	q.wait()
+	if transport.sent != 0 {
+		t.Errorf("Expected email to be dropped after 3 attempts, but got %v sent", transport.sent)
+	}
+}
+
+func TestSmtpTransport(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go serveSmtp(listener, received)
+	addr := listener.Addr().(*net.TCPAddr)
+	transport := &SmtpTransport{Host: "127.0.0.1", Port: addr.Port}
+	err = transport.Send(&Message{From: "noreply@example.com", To: []string{"gopher@example.com"}, Subject: "Hello", Text: "Hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := <-received
+	if !strings.Contains(content, "Subject: Hello") {
+		t.Errorf("Expected smtp server to receive email, but got:\n%v", content)
+	}
+}
+
+// serveSmtp accepts single email, just enough for net/smtp client.
+func serveSmtp(listener net.Listener, received chan string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("220 localhost\r\n"))
+	var data []string
+	inData := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if inData {
+			if line == ".\r\n" {
+				inData = false
+				received <- strings.Join(data, "")
+				conn.Write([]byte("250 OK\r\n"))
+				continue
+			}
+			data = append(data, line)
+			continue
+		}
+		switch strings.ToUpper(strings.Fields(line)[0]) {
+		case "EHLO", "HELO":
+			conn.Write([]byte("250 localhost\r\n"))
+		case "DATA":
+			inData = true
+			conn.Write([]byte("354 go ahead\r\n"))
+		case "QUIT":
+			conn.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 OK\r\n"))
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Text    string
+	Html    string
+}
+
+func (self *Message) Bytes() ([]byte, error) {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "From: %v\r\n", self.From)
+	fmt.Fprintf(&out, "To: %v\r\n", strings.Join(self.To, ", "))
+	fmt.Fprintf(&out, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", self.Subject))
+	fmt.Fprintf(&out, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprint(&out, "MIME-Version: 1.0\r\n")
+	if self.Text == "" || self.Html == "" {
+		contentType, body := "text/plain", self.Text
+		if self.Html != "" {
+			contentType, body = "text/html", self.Html
+		}
+		fmt.Fprintf(&out, "Content-Type: %v; charset=utf-8\r\n\r\n", contentType)
+		fmt.Fprint(&out, body)
+		return out.Bytes(), nil
+	}
+	writer := multipart.NewWriter(&out)
+	fmt.Fprintf(&out, "Content-Type: multipart/alternative; boundary=%v\r\n\r\n", writer.Boundary())
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", self.Text},
+		{"text/html", self.Html},
+	} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType+"; charset=utf-8")
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprint(w, part.body)
+	}
+	err := writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
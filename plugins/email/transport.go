@@ -0,0 +1,114 @@
+package email
+
+import (
+	"fmt"
+	"github.com/gophergala2016/dbserver/plugins"
+	"io/ioutil"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Transport interface {
+	Send(message *Message) error
+}
+
+type SmtpTransport struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+func (self *SmtpTransport) Send(message *Message) error {
+	content, err := message.Bytes()
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if self.Username != "" {
+		auth = smtp.PlainAuth("", self.Username, self.Password, self.Host)
+	}
+	addr := fmt.Sprintf("%v:%v", self.Host, self.Port)
+	return smtp.SendMail(addr, auth, message.From, message.To, content)
+}
+
+// FileTransport writes every email into separate .eml file instead of
+// sending it. Useful for development and tests.
+type FileTransport struct {
+	Directory string
+	mutex     sync.Mutex
+	count     int
+}
+
+func (self *FileTransport) Send(message *Message) error {
+	content, err := message.Bytes()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(self.Directory, 0755)
+	if err != nil {
+		return err
+	}
+	self.mutex.Lock()
+	self.count++
+	name := fmt.Sprintf("%v-%v-%v.eml", time.Now().UnixNano(), self.count, strings.Join(message.To, ","))
+	self.mutex.Unlock()
+	return ioutil.WriteFile(filepath.Join(self.Directory, name), content, 0644)
+}
+
+type LogTransport struct{}
+
+func (self *LogTransport) Send(message *Message) error {
+	content, err := message.Bytes()
+	if err != nil {
+		return err
+	}
+	log.Printf("email:\n%s\n", content)
+	return nil
+}
+
+// queue sends emails in background. Failed sends are retried with
+// exponential backoff until attempts run out. Delivery is best effort:
+// queue is kept in memory, so emails waiting for retry are lost on restart.
+// Use route jobs for emails that have to survive restarts.
+type queue struct {
+	transport Transport
+	attempts  int
+	interval  time.Duration
+	wg        sync.WaitGroup
+}
+
+func newQueue(transport Transport, attempts int, interval time.Duration) *queue {
+	return &queue{transport: transport, attempts: attempts, interval: interval}
+}
+
+func (self *queue) push(message *Message) {
+	self.wg.Add(1)
+	go self.deliver(message, 1)
+}
+
+func (self *queue) deliver(message *Message, attempt int) {
+	err := self.transport.Send(message)
+	if err == nil {
+		self.wg.Done()
+		return
+	}
+	if attempt >= self.attempts {
+		log.Printf("Failed to send email to %v after %v attempts: %v\n", message.To, attempt, err)
+		self.wg.Done()
+		return
+	}
+	log.Printf("Failed to send email to %v (attempt %v), retrying: %v\n", message.To, attempt, err)
+	time.AfterFunc(plugins.Backoff(self.interval, attempt), func() {
+		self.deliver(message, attempt+1)
+	})
+}
+
+func (self *queue) wait() {
+	self.wg.Wait()
+}
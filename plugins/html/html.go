@@ -0,0 +1,187 @@
+package html
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gophergala2016/dbserver/plugins"
+	"html/template"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+type Html struct {
+	Sections     map[string]*Section
+	TemplatesDir string
+	routes       map[string]*Section
+	templates    map[string]*template.Template
+}
+
+type Section struct {
+	Template string
+	Layout   string
+	Paths    []string
+	Variants []*Variant
+	name     string
+}
+
+type Variant struct {
+	Template string
+	Weight   int
+}
+
+const cookieMaxAge = 30 * 24 * 60 * 60
+
+func (self *Html) ParseConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error while reading plugin config: %v", err))
+	}
+	_, err = toml.Decode(string(content), &self.Sections)
+	if err != nil {
+		return err
+	}
+	if self.TemplatesDir == "" {
+		self.TemplatesDir = filepath.Join(filepath.Dir(filepath.Dir(path)), "templates")
+	}
+	self.routes = make(map[string]*Section)
+	self.templates = make(map[string]*template.Template)
+	for name, section := range self.Sections {
+		section.name = name
+		if section.Layout == "" && self.Sections["default"] != nil {
+			section.Layout = self.Sections["default"].Layout
+		}
+		if len(section.Variants) == 0 {
+			section.Variants = []*Variant{{Template: section.Template, Weight: 1}}
+		}
+		for _, variant := range section.Variants {
+			if variant.Template == "" {
+				return fmt.Errorf("html section %v is missing template", name)
+			}
+			if variant.Weight <= 0 {
+				variant.Weight = 1
+			}
+			err = self.parseTemplate(variant.Template, section.Layout)
+			if err != nil {
+				return err
+			}
+		}
+		for _, route := range section.Paths {
+			self.routes[route] = section
+		}
+	}
+	return nil
+}
+
+func (self *Html) parseTemplate(name string, layout string) error {
+	key := layout + "/" + name
+	if self.templates[key] != nil {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(self.TemplatesDir, "partials", "*.html"))
+	if err != nil {
+		return err
+	}
+	entry := name + ".html"
+	if layout != "" {
+		files = append(files, filepath.Join(self.TemplatesDir, "layouts", layout+".html"))
+		entry = layout + ".html"
+	}
+	files = append(files, filepath.Join(self.TemplatesDir, name+".html"))
+	tmpl, err := template.New(entry).ParseFiles(files...)
+	if err != nil {
+		return err
+	}
+	self.templates[key] = tmpl
+	return nil
+}
+
+func (self *Html) Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response {
+	return &plugins.Response{Data: data}
+}
+
+func (self *Html) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	return nil
+}
+
+func (self *Html) Render(route string, data map[string]interface{}, jsonValue string, r *http.Request) *plugins.Response {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return nil
+	}
+	section := self.routes[route]
+	if section == nil {
+		section = self.Sections["default"]
+	}
+	if section == nil {
+		return nil
+	}
+	response := &plugins.Response{
+		Headers: map[string][]string{"Content-Type": {"text/html; charset=utf-8"}},
+	}
+	variant, cookie := self.variant(section, r)
+	if cookie != nil {
+		response.Cookies = []*http.Cookie{cookie}
+	}
+	templateData := make(map[string]interface{})
+	for key, value := range data {
+		templateData[key] = value
+	}
+	var value interface{}
+	if jsonValue != "" {
+		err := json.Unmarshal([]byte(jsonValue), &value)
+		if err != nil {
+			return &plugins.Response{ResponseCode: http.StatusInternalServerError, Error: err.Error()}
+		}
+	}
+	templateData["data"] = value
+	templateData["route"] = route
+	templateData["variant"] = variant.Template
+	var out bytes.Buffer
+	err := self.templates[section.Layout+"/"+variant.Template].Execute(&out, templateData)
+	if err != nil {
+		return &plugins.Response{ResponseCode: http.StatusInternalServerError, Error: err.Error()}
+	}
+	response.Body = out.String()
+	return response
+}
+
+// variant picks A/B variant for section. Choice is kept in cookie so client
+// sees the same variant on next requests.
+func (self *Html) variant(section *Section, r *http.Request) (*Variant, *http.Cookie) {
+	if len(section.Variants) == 1 {
+		return section.Variants[0], nil
+	}
+	cookieName := "html_variant_" + section.name
+	if cookie, err := r.Cookie(cookieName); err == nil {
+		for _, variant := range section.Variants {
+			if variant.Template == cookie.Value {
+				return variant, nil
+			}
+		}
+	}
+	total := 0
+	for _, variant := range section.Variants {
+		total += variant.Weight
+	}
+	n := rand.Intn(total)
+	variant := section.Variants[len(section.Variants)-1]
+	for _, v := range section.Variants {
+		if n < v.Weight {
+			variant = v
+			break
+		}
+		n -= v.Weight
+	}
+	cookie := &http.Cookie{
+		Name:   cookieName,
+		Value:  variant.Template,
+		Path:   "/",
+		MaxAge: cookieMaxAge,
+	}
+	return variant, cookie
+}
@@ -0,0 +1,75 @@
+package html
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	html := &Html{}
+	err := html.ParseConfig("test_app/plugins/html.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if html.routes["get_products"] != html.Sections["products"] {
+		t.Error("Expected get_products route to use products section")
+	}
+	if html.Sections["products"].Layout != "application" {
+		t.Errorf("Expected products section to inherit default layout, but got: '%v'", html.Sections["products"].Layout)
+	}
+	if len(html.templates) != 3 {
+		t.Errorf("Expected to parse 3 templates, but got: %v", len(html.templates))
+	}
+}
+
+func TestRender(t *testing.T) {
+	html := &Html{}
+	err := html.ParseConfig("test_app/plugins/html.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/products", nil)
+	if response := html.Render("get_products", nil, "[]", r); response != nil {
+		t.Errorf("Not expected to render html for json request, but got: %v", response)
+	}
+	r.Header.Set("Accept", "text/html,application/xhtml+xml")
+	r.AddCookie(&http.Cookie{Name: "html_variant_products", Value: "products_grid"})
+	response := html.Render("get_products", nil, `[{"name": "Brush"}]`, r)
+	expected := "<html><body><div><li>Brush</li></div></body></html>\n"
+	if response.Body != expected {
+		t.Errorf("Expected body:\n%v, but got:\n%v", expected, response.Body)
+	}
+	if len(response.Cookies) != 0 {
+		t.Error("Not expected to set variant cookie when it's already present")
+	}
+	response = html.Render("current_user", nil, `{}`, httptest.NewRequest("GET", "/current_user", nil))
+	if response != nil {
+		t.Error("Not expected to render without text/html accept header")
+	}
+	r = httptest.NewRequest("GET", "/current_user", nil)
+	r.Header.Set("Accept", "text/html")
+	response = html.Render("current_user", nil, `{}`, r)
+	if response.Body != "<html><body><h1>current_user</h1></body></html>\n" {
+		t.Errorf("Expected to render default template, but got: %v", response.Body)
+	}
+}
+
+func TestVariant(t *testing.T) {
+	html := &Html{}
+	err := html.ParseConfig("test_app/plugins/html.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		variant, cookie := html.variant(html.Sections["products"], httptest.NewRequest("GET", "/products", nil))
+		if cookie == nil || cookie.Value != variant.Template {
+			t.Fatalf("Expected to get sticky cookie for variant, but got: %v", cookie)
+		}
+		counts[variant.Template]++
+	}
+	if counts["products"] < 700 || counts["products_grid"] < 100 {
+		t.Errorf("Expected variants to be picked by weight, but got: %v", counts)
+	}
+}
@@ -1,6 +1,10 @@
 package jwt
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
@@ -13,21 +17,24 @@ import (
 	"time"
 )
 
-type duration struct {
-	time.Duration
-}
-
-func (d *duration) UnmarshalText(text []byte) error {
-	var err error
-	d.Duration, err = time.ParseDuration(string(text))
-	return err
-}
+var rotations = plugins.NewCounter("dbservice_jwt_rotations_total", "Tokens that were replaced with new ones before expiration.")
 
 type JWT struct {
 	Secret           string
 	Issuer           string
-	ExpirationTime   duration `toml:"expiration"`
-	RotationDeadline duration `toml:"rotation_deadline"`
+	ExpirationTime   plugins.Duration `toml:"expiration"`
+	RotationDeadline plugins.Duration `toml:"rotation_deadline"`
+	CookieName       string           `toml:"cookie_name"`
+	CookieDomain     string           `toml:"cookie_domain"`
+	CookiePath       string           `toml:"cookie_path"`
+	CookieSecure     bool             `toml:"cookie_secure"`
+	CookieHttpOnly   bool             `toml:"cookie_http_only"`
+	CookieSameSite   string           `toml:"cookie_same_site"`
+	CsrfCookieName   string           `toml:"csrf_cookie_name"`
+	CsrfHeader       string           `toml:"csrf_header"`
+	DbSession        bool             `toml:"db_session"`
+	RoleClaim        string           `toml:"role_claim"`
+	AnonymousRole    string           `toml:"anonymous_role"`
 }
 
 func (self *JWT) ParseConfig(path string) error {
@@ -35,8 +42,25 @@ func (self *JWT) ParseConfig(path string) error {
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error while reading plugin config: %v", err))
 	}
+	self.CookiePath = "/"
+	self.CookieSecure = true
+	self.CookieHttpOnly = true
+	self.CookieSameSite = "strict"
+	self.CsrfCookieName = "csrf_token"
+	self.CsrfHeader = "X-CSRF-Token"
 	_, err = toml.Decode(string(content), self)
-	return err
+	if err != nil {
+		return err
+	}
+	if self.sameSite() == http.SameSiteDefaultMode {
+		return fmt.Errorf("Unknown cookie_same_site value: %v", self.CookieSameSite)
+	}
+	// Without role queries would run as connection user, bypassing row level
+	// security.
+	if self.DbSession && self.AnonymousRole == "" {
+		return errors.New("db_session requires anonymous_role")
+	}
+	return nil
 }
 
 func (self *JWT) Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response {
@@ -59,9 +83,10 @@ func (self *JWT) Process(data map[string]interface{}, arg map[string]interface{}
 		response.Error = err.Error()
 		return response
 	}
-	if len(token) > 0 {
-		response.Headers = make(map[string][]string)
-		response.Headers["Authorization"] = []string{"Bearer " + string(token)}
+	err = self.setToken(response, token, "")
+	if err != nil {
+		response.ResponseCode = 500
+		response.Error = err.Error()
 	}
 	return response
 }
@@ -85,16 +110,112 @@ func (self *JWT) GenerateToken(payload map[string]interface{}) ([]byte, error) {
 	return serializedToken, nil
 }
 
-func (self *JWT) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
-	headerValue := r.Header.Get("Authorization")
-	if headerValue == "" {
+// setToken hands the token to the client: as HttpOnly cookie (together with
+// csrf cookie for double submit check) when cookie_name is configured,
+// otherwise in Authorization header.
+func (self *JWT) setToken(response *plugins.Response, token []byte, csrfToken string) error {
+	if len(token) == 0 {
+		return nil
+	}
+	if self.CookieName == "" {
+		response.Headers = make(map[string][]string)
+		response.Headers["Authorization"] = []string{"Bearer " + string(token)}
 		return nil
 	}
-	if !strings.HasPrefix(headerValue, "Bearer ") {
+	if csrfToken == "" {
+		var err error
+		csrfToken, err = generateCsrfToken()
+		if err != nil {
+			return err
+		}
+	}
+	tokenCookie := self.cookie(self.CookieName, string(token))
+	tokenCookie.HttpOnly = self.CookieHttpOnly
+	csrfCookie := self.cookie(self.CsrfCookieName, csrfToken)
+	response.Cookies = append(response.Cookies, tokenCookie, csrfCookie)
+	return nil
+}
+
+func (self *JWT) cookie(name string, value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   self.CookieDomain,
+		Path:     self.CookiePath,
+		Secure:   self.CookieSecure,
+		SameSite: self.sameSite(),
+	}
+	if self.ExpirationTime.Duration > 0 {
+		cookie.MaxAge = int(self.ExpirationTime.Duration.Seconds())
+	}
+	return cookie
+}
+
+func (self *JWT) sameSite() http.SameSite {
+	switch strings.ToLower(self.CookieSameSite) {
+	case "", "strict":
+		return http.SameSiteStrictMode
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteDefaultMode
+}
+
+func generateCsrfToken() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// readToken returns token from Authorization header or, if it's missing,
+// from token cookie. Second value reports whether cookie was used.
+func (self *JWT) readToken(r *http.Request) (string, bool) {
+	headerValue := r.Header.Get("Authorization")
+	if strings.HasPrefix(headerValue, "Bearer ") {
+		return strings.Replace(headerValue, "Bearer ", "", 1), false
+	}
+	if self.CookieName == "" {
+		return "", false
+	}
+	cookie, err := r.Cookie(self.CookieName)
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+func (self *JWT) csrfToken(r *http.Request) string {
+	cookie, err := r.Cookie(self.CsrfCookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func (self *JWT) validCsrf(r *http.Request) bool {
+	cookieValue := self.csrfToken(r)
+	headerValue := r.Header.Get(self.CsrfHeader)
+	if cookieValue == "" || headerValue == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookieValue), []byte(headerValue)) == 1
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+func (self *JWT) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	tokenValue, fromCookie := self.readToken(r)
+	if tokenValue == "" {
 		return nil
 	}
-	headerValue = strings.Replace(headerValue, "Bearer ", "", 1)
-	token, err := jws.ParseJWT([]byte(headerValue))
+	token, err := jws.ParseJWT([]byte(tokenValue))
 	if err != nil {
 		return nil
 	}
@@ -109,19 +230,65 @@ func (self *JWT) ProcessBeforeHook(data map[string]interface{}, r *http.Request)
 	if expiration.Unix() < time.Now().Unix() {
 		return nil
 	}
+	// Invalid or expired cookie is ignored above, so that client can still
+	// call public routes (e.g. login) to get new one.
+	if fromCookie && !isSafeMethod(r.Method) && !self.validCsrf(r) {
+		return &plugins.Response{
+			ResponseCode: http.StatusForbidden,
+			Error:        "CSRF token is missing or invalid",
+		}
+	}
+	var response *plugins.Response
 	if time.Now().Add(self.RotationDeadline.Duration).Unix() > expiration.Unix() {
-		token, err := self.GenerateToken(token.Claims())
-		response := &plugins.Response{}
+		newToken, err := self.GenerateToken(token.Claims())
+		response = &plugins.Response{}
+		if err == nil {
+			err = self.setToken(response, newToken, self.csrfToken(r))
+		}
 		if err != nil {
 			response.ResponseCode = 500
 			response.Error = err.Error()
 			return response
 		}
-		if len(token) > 0 {
-			response.Headers = make(map[string][]string)
-			response.Headers["Authorization"] = []string{"Bearer " + string(token)}
+		rotations.Inc()
+	}
+	data["jwt"] = map[string]interface{}(token.Claims())
+	return response
+}
+
+func (self *JWT) Session(data map[string]interface{}) (*plugins.Session, error) {
+	if !self.DbSession {
+		return nil, nil
+	}
+	session := &plugins.Session{
+		Role:     self.AnonymousRole,
+		Settings: make(map[string]string),
+	}
+	claims, _ := data["jwt"].(map[string]interface{})
+	if role, ok := claims[self.RoleClaim].(string); self.RoleClaim != "" && ok && role != "" {
+		session.Role = role
+	}
+	if session.Role == "" {
+		return nil, errors.New("jwt session doesn't have role and anonymous_role is not set")
+	}
+	if claims == nil {
+		return session, nil
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	session.Settings["request.jwt.claims"] = string(claimsJson)
+	for name, value := range claims {
+		if stringValue, ok := value.(string); ok {
+			session.Settings["request.jwt.claim."+name] = stringValue
+			continue
+		}
+		valueJson, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
 		}
+		session.Settings["request.jwt.claim."+name] = string(valueJson)
 	}
-	data["jwt"] = token.Claims()
-	return nil
+	return session, nil
 }
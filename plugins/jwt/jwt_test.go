@@ -1,6 +1,9 @@
 package jwt
 
 import (
+	"github.com/gophergala2016/dbserver/plugins"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -55,3 +58,152 @@ func TestProcess(t *testing.T) {
 		t.Error("__jwt token was supposed to be removed from data after jwt processing")
 	}
 }
+
+func TestParseCookieConfig(t *testing.T) {
+	jwtPlugin := &JWT{}
+	err := jwtPlugin.ParseConfig("test_config/jwt_cookie.toml")
+	if err != nil {
+		t.Error(err)
+	}
+	if jwtPlugin.CookieName != "session" {
+		t.Errorf("Expected cookie name to be 'session', but got: '%v'", jwtPlugin.CookieName)
+	}
+	if jwtPlugin.CookiePath != "/" {
+		t.Errorf("Expected default cookie path to be '/', but got: '%v'", jwtPlugin.CookiePath)
+	}
+	if !jwtPlugin.CookieSecure || !jwtPlugin.CookieHttpOnly {
+		t.Error("Expected cookie to be secure and http only by default")
+	}
+	if jwtPlugin.sameSite() != http.SameSiteLaxMode {
+		t.Errorf("Expected lax same site mode, but got: %v", jwtPlugin.sameSite())
+	}
+}
+
+func TestProcessCookie(t *testing.T) {
+	jwt := &JWT{Secret: "secret", CookieName: "session", CsrfCookieName: "csrf_token", CookieHttpOnly: true}
+	data := make(map[string]interface{})
+	data["__jwt"] = map[string]interface{}{"user_id": 1}
+	response := jwt.Process(data, nil)
+	if len(response.Headers["Authorization"]) != 0 {
+		t.Error("Not expected to get authorization header when cookie is configured")
+	}
+	if len(response.Cookies) != 2 {
+		t.Fatalf("Expected to get token and csrf cookies, but got: %v", response.Cookies)
+	}
+	if response.Cookies[0].Name != "session" || !response.Cookies[0].HttpOnly {
+		t.Errorf("Expected http only session cookie, but got: %v", response.Cookies[0])
+	}
+	if response.Cookies[1].Name != "csrf_token" || response.Cookies[1].HttpOnly {
+		t.Errorf("Expected csrf cookie readable by scripts, but got: %v", response.Cookies[1])
+	}
+}
+
+func TestProcessBeforeHookCookie(t *testing.T) {
+	jwt := &JWT{
+		Secret:         "secret",
+		ExpirationTime: plugins.Duration{Duration: time.Hour},
+		CookieName:     "session",
+		CsrfCookieName: "csrf_token",
+		CsrfHeader:     "X-CSRF-Token",
+	}
+	token, err := jwt.GenerateToken(map[string]interface{}{"user_id": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method string, csrfHeader string) *http.Request {
+		r := httptest.NewRequest(method, "/products", nil)
+		r.AddCookie(&http.Cookie{Name: "session", Value: string(token)})
+		r.AddCookie(&http.Cookie{Name: "csrf_token", Value: "csrf123"})
+		if csrfHeader != "" {
+			r.Header.Set("X-CSRF-Token", csrfHeader)
+		}
+		return r
+	}
+
+	data := make(map[string]interface{})
+	response := jwt.ProcessBeforeHook(data, request("GET", ""))
+	if response != nil {
+		t.Errorf("Not expected to get response for safe method, but got: %v", response)
+	}
+	if data["jwt"] == nil {
+		t.Error("Expected to read jwt payload from cookie, but got none")
+	}
+
+	data = make(map[string]interface{})
+	response = jwt.ProcessBeforeHook(data, request("POST", "wrong"))
+	if response == nil || response.ResponseCode != http.StatusForbidden {
+		t.Errorf("Expected to get forbidden response on csrf mismatch, but got: %v", response)
+	}
+	if data["jwt"] != nil {
+		t.Error("Not expected to get jwt payload on csrf mismatch")
+	}
+
+	data = make(map[string]interface{})
+	response = jwt.ProcessBeforeHook(data, request("POST", "csrf123"))
+	if response != nil {
+		t.Errorf("Not expected to get response on csrf match, but got: %v", response)
+	}
+	if data["jwt"] == nil {
+		t.Error("Expected to read jwt payload from cookie, but got none")
+	}
+
+	jwt.ExpirationTime.Duration = 0
+	token, err = jwt.GenerateToken(map[string]interface{}{"user_id": 1, "exp": time.Now().Add(-time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = make(map[string]interface{})
+	response = jwt.ProcessBeforeHook(data, request("POST", ""))
+	if response != nil {
+		t.Errorf("Expected expired cookie to be ignored without csrf check, but got: %v", response)
+	}
+	if data["jwt"] != nil {
+		t.Error("Not expected to get jwt payload from expired cookie")
+	}
+}
+
+func TestSession(t *testing.T) {
+	jwt := &JWT{DbSession: true, RoleClaim: "role", AnonymousRole: "web_anon"}
+	session, err := jwt.Session(make(map[string]interface{}))
+	if err != nil {
+		t.Error(err)
+	}
+	if session.Role != "web_anon" {
+		t.Errorf("Expected anonymous role 'web_anon', but got: '%v'", session.Role)
+	}
+	if len(session.Settings) != 0 {
+		t.Errorf("Not expected to get settings without jwt payload, but got: %v", session.Settings)
+	}
+	data := make(map[string]interface{})
+	data["jwt"] = map[string]interface{}{"role": "web_user", "user_id": float64(5)}
+	session, err = jwt.Session(data)
+	if err != nil {
+		t.Error(err)
+	}
+	if session.Role != "web_user" {
+		t.Errorf("Expected role from claim 'web_user', but got: '%v'", session.Role)
+	}
+	if session.Settings["request.jwt.claim.user_id"] != "5" {
+		t.Errorf("Expected user_id claim setting to be '5', but got: '%v'", session.Settings["request.jwt.claim.user_id"])
+	}
+	if session.Settings["request.jwt.claims"] != `{"role":"web_user","user_id":5}` {
+		t.Errorf("Unexpected claims setting: %v", session.Settings["request.jwt.claims"])
+	}
+	data["jwt"] = map[string]interface{}{"role": ""}
+	session, err = jwt.Session(data)
+	if err != nil || session.Role != "web_anon" {
+		t.Errorf("Expected empty role claim to fall back to anonymous role, but got: %v %v", session, err)
+	}
+	jwt.AnonymousRole = ""
+	if _, err := jwt.Session(make(map[string]interface{})); err == nil {
+		t.Error("Expected session without role to fail")
+	}
+}
+
+func TestParseSessionConfig(t *testing.T) {
+	jwt := &JWT{}
+	err := jwt.ParseConfig("test_config/jwt_session.toml")
+	if err == nil {
+		t.Error("Expected db_session without anonymous_role to fail")
+	}
+}
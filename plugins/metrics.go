@@ -0,0 +1,242 @@
+package plugins
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics is registry that is exposed in Prometheus text format. Plugins
+// register their metrics in it too.
+var Metrics = &Registry{}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+func (self *Registry) register(m metric) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.metrics = append(self.metrics, m)
+}
+
+// Write writes all metrics in Prometheus text exposition format.
+func (self *Registry) Write(w io.Writer) {
+	self.mutex.Lock()
+	metrics := append([]metric{}, self.metrics...)
+	self.mutex.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// series keeps values of metric by label values.
+type series struct {
+	mutex  sync.Mutex
+	labels []string
+	values map[string][]string
+}
+
+func (self *series) key(labelValues []string) string {
+	if len(labelValues) != len(self.labels) {
+		panic(fmt.Sprintf("expected %v label values, got %v", len(self.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	if self.values == nil {
+		self.values = make(map[string][]string)
+	}
+	if _, ok := self.values[key]; !ok {
+		self.values[key] = append([]string{}, labelValues...)
+	}
+	return key
+}
+
+func (self *series) sortedKeys() []string {
+	keys := make([]string, 0, len(self.values))
+	for key := range self.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type Counter struct {
+	series
+	name   string
+	help   string
+	counts map[string]float64
+}
+
+// NewCounter creates counter with given label names and registers it.
+func NewCounter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{name: name, help: help, series: series{labels: labels}, counts: make(map[string]float64)}
+	Metrics.register(counter)
+	return counter
+}
+
+func (self *Counter) Inc(labelValues ...string) {
+	self.Add(1, labelValues...)
+}
+
+func (self *Counter) Add(value float64, labelValues ...string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.counts[self.key(labelValues)] += value
+}
+
+func (self *Counter) Value(labelValues ...string) float64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.counts[strings.Join(labelValues, "\xff")]
+}
+
+func (self *Counter) write(w io.Writer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	writeHeader(w, self.name, self.help, "counter")
+	if len(self.labels) == 0 && len(self.counts) == 0 {
+		fmt.Fprintf(w, "%v 0\n", self.name)
+	}
+	for _, key := range self.sortedKeys() {
+		fmt.Fprintf(w, "%v%v %v\n", self.name, formatLabels(self.labels, self.values[key]), formatFloat(self.counts[key]))
+	}
+}
+
+type histogramValue struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type Histogram struct {
+	series
+	name      string
+	help      string
+	bounds    []float64
+	histogram map[string]*histogramValue
+}
+
+// NewHistogram creates histogram with given bucket upper bounds and label
+// names and registers it.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{
+		name:      name,
+		help:      help,
+		series:    series{labels: labels},
+		bounds:    buckets,
+		histogram: make(map[string]*histogramValue),
+	}
+	Metrics.register(histogram)
+	return histogram
+}
+
+func (self *Histogram) Observe(value float64, labelValues ...string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	key := self.key(labelValues)
+	current := self.histogram[key]
+	if current == nil {
+		current = &histogramValue{buckets: make([]uint64, len(self.bounds))}
+		self.histogram[key] = current
+	}
+	for i, bound := range self.bounds {
+		if value <= bound {
+			current.buckets[i]++
+		}
+	}
+	current.count++
+	current.sum += value
+}
+
+func (self *Histogram) Count(labelValues ...string) uint64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if current := self.histogram[strings.Join(labelValues, "\xff")]; current != nil {
+		return current.count
+	}
+	return 0
+}
+
+func (self *Histogram) write(w io.Writer) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	writeHeader(w, self.name, self.help, "histogram")
+	for _, key := range self.sortedKeys() {
+		values := self.values[key]
+		current := self.histogram[key]
+		for i, bound := range self.bounds {
+			fmt.Fprintf(w, "%v_bucket%v %v\n", self.name, formatLabels(self.labels, values, "le", formatFloat(bound)), current.buckets[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", self.name, formatLabels(self.labels, values, "le", "+Inf"), current.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", self.name, formatLabels(self.labels, values), formatFloat(current.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", self.name, formatLabels(self.labels, values), current.count)
+	}
+}
+
+// Func is metric without labels whose value is read when metrics are
+// written, e.g. database pool stats.
+type Func struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+func NewGaugeFunc(name string, help string, value func() float64) *Func {
+	gauge := &Func{name: name, help: help, kind: "gauge", value: value}
+	Metrics.register(gauge)
+	return gauge
+}
+
+func NewCounterFunc(name string, help string, value func() float64) *Func {
+	counter := &Func{name: name, help: help, kind: "counter", value: value}
+	Metrics.register(counter)
+	return counter
+}
+
+func (self *Func) write(w io.Writer) {
+	writeHeader(w, self.name, self.help, self.kind)
+	fmt.Fprintf(w, "%v %v\n", self.name, formatFloat(self.value()))
+}
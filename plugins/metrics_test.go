@@ -0,0 +1,56 @@
+package plugins
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	registry := Metrics
+	Metrics = &Registry{}
+	defer func() {
+		Metrics = registry
+	}()
+	counter := NewCounter("test_requests_total", "Requests.", "route", "status")
+	counter.Inc("get_users", "200")
+	counter.Add(2, "get_users", "200")
+	counter.Inc(`say "hi"`, "500")
+	NewCounter("test_rotations_total", "Rotations.")
+	histogram := NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "route")
+	histogram.Observe(0.05, "get_users")
+	histogram.Observe(0.5, "get_users")
+	histogram.Observe(2, "get_users")
+	NewGaugeFunc("test_connections", "Connections.", func() float64 { return 3 })
+	var out bytes.Buffer
+	Metrics.Write(&out)
+	expected := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{route="get_users",status="200"} 3
+test_requests_total{route="say \"hi\"",status="500"} 1
+# HELP test_rotations_total Rotations.
+# TYPE test_rotations_total counter
+test_rotations_total 0
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="get_users",le="0.1"} 1
+test_duration_seconds_bucket{route="get_users",le="1"} 2
+test_duration_seconds_bucket{route="get_users",le="+Inf"} 3
+test_duration_seconds_sum{route="get_users"} 2.55
+test_duration_seconds_count{route="get_users"} 3
+# HELP test_connections Connections.
+# TYPE test_connections gauge
+test_connections 3
+`
+	if out.String() != expected {
+		t.Errorf("Expected metrics:\n%v\nbut got:\n%v", expected, out.String())
+	}
+	if counter.Value("get_users", "200") != 3 || histogram.Count("get_users") != 3 {
+		t.Errorf("Unexpected values: %v %v", counter.Value("get_users", "200"), histogram.Count("get_users"))
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected wrong number of labels to panic")
+		}
+	}()
+	counter.Inc("get_users")
+}
@@ -0,0 +1,192 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gophergala2016/dbserver/plugins"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RateLimit struct {
+	Store          string
+	Table          string
+	TrustedProxies int  `toml:"trusted_proxies"`
+	FailOpen       bool `toml:"fail_open"`
+	store          Store
+}
+
+type limit struct {
+	Per    string           `json:"per"`
+	Key    string           `json:"key"`
+	Limit  int              `json:"limit"`
+	Window plugins.Duration `json:"window"`
+	// proxies is number of trusted proxies in front of server.
+	proxies int
+}
+
+func (self *RateLimit) ParseConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error while reading plugin config: %v", err))
+	}
+	self.Store = "memory"
+	self.Table = "ratelimit_buckets"
+	self.TrustedProxies = 1
+	_, err = toml.Decode(string(content), self)
+	if err != nil {
+		return err
+	}
+	switch self.Store {
+	case "memory":
+		self.store = NewMemoryStore()
+	case "postgres":
+	default:
+		return fmt.Errorf("Unknown ratelimit store: %v", self.Store)
+	}
+	return nil
+}
+
+func (self *RateLimit) SetDb(db *sql.DB) {
+	if self.Store == "postgres" {
+		self.store = NewPostgresStore(db, self.Table)
+	}
+}
+
+func (self *RateLimit) Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response {
+	return &plugins.Response{Data: data}
+}
+
+func (self *RateLimit) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	return nil
+}
+
+func (self *RateLimit) ProcessRouteHook(route string, data map[string]interface{}, arg map[string]interface{}, r *http.Request) *plugins.Response {
+	l, err := parseLimit(arg)
+	if err != nil {
+		return &plugins.Response{ResponseCode: http.StatusInternalServerError, Error: err.Error()}
+	}
+	l.proxies = self.TrustedProxies
+	key := route + ":" + l.requestKey(data, r)
+	store := self.store
+	if tx := plugins.TxFromContext(r.Context()); tx != nil && self.Store == "postgres" {
+		store = NewPostgresStore(tx, self.Table)
+	}
+	if store == nil {
+		return self.storeError(errors.New("postgres store doesn't have database connection"))
+	}
+	result, err := store.Take(key, l.Limit, l.Window.Duration)
+	if err != nil {
+		return self.storeError(err)
+	}
+	response := &plugins.Response{Headers: map[string][]string{
+		"RateLimit-Limit":     {strconv.Itoa(l.Limit)},
+		"RateLimit-Remaining": {strconv.Itoa(result.Remaining)},
+		"RateLimit-Reset":     {seconds(result.Reset)},
+	}}
+	if !result.Allowed {
+		response.Headers["Retry-After"] = []string{seconds(result.RetryAfter)}
+		response.ResponseCode = http.StatusTooManyRequests
+		response.Error = "Rate limit exceeded"
+	}
+	return response
+}
+
+// storeError lets request through only if fail_open is set, otherwise
+// limits of shared store would be silently off while database is down.
+func (self *RateLimit) storeError(err error) *plugins.Response {
+	log.Printf("ratelimit store error: %v\n", err)
+	if self.FailOpen {
+		return nil
+	}
+	return &plugins.Response{ResponseCode: http.StatusServiceUnavailable, Error: "Rate limit is unavailable"}
+}
+
+func parseLimit(arg map[string]interface{}) (*limit, error) {
+	l := &limit{Per: "ip"}
+	content, err := json.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, l)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ratelimit arguments: %v", err)
+	}
+	if l.Limit <= 0 || l.Window.Duration <= 0 {
+		return nil, errors.New("ratelimit requires positive limit and window")
+	}
+	if (l.Per == "jwt" || l.Per == "param") && l.Key == "" {
+		return nil, fmt.Errorf("ratelimit per %v requires key", l.Per)
+	}
+	return l, nil
+}
+
+// requestKey identifies client. Requests that don't have jwt claim, param or
+// api key are limited by ip.
+func (self *limit) requestKey(data map[string]interface{}, r *http.Request) string {
+	switch self.Per {
+	case "forwarded_ip":
+		return "ip:" + forwardedIp(r, self.proxies)
+	case "jwt":
+		if claims, ok := data["jwt"].(map[string]interface{}); ok && claims[self.Key] != nil {
+			return fmt.Sprintf("jwt:%v", claims[self.Key])
+		}
+	case "param":
+		if params, ok := data["params"].(map[string]interface{}); ok && params[self.Key] != nil {
+			return fmt.Sprintf("param:%v", params[self.Key])
+		}
+	case "apikey":
+		if apiKey, ok := data["apikey"].(map[string]interface{}); ok {
+			return fmt.Sprintf("apikey:%v", apiKey["owner"])
+		}
+	}
+	return "ip:" + remoteIp(r)
+}
+
+func remoteIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedIp returns address that was appended to X-Forwarded-For by the
+// outermost of trusted proxies. Addresses before it are set by client and
+// can't be trusted.
+func forwardedIp(r *http.Request, proxies int) string {
+	addresses := make([]string, 0)
+	for _, header := range r.Header["X-Forwarded-For"] {
+		for _, address := range strings.Split(header, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	if len(addresses) > 0 {
+		if proxies < 1 {
+			proxies = 1
+		}
+		if proxies > len(addresses) {
+			proxies = len(addresses)
+		}
+		return addresses[len(addresses)-proxies]
+	}
+	if realIp := r.Header.Get("X-Real-Ip"); realIp != "" {
+		return realIp
+	}
+	return remoteIp(r)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	rateLimit := &RateLimit{}
+	err := rateLimit.ParseConfig("test_config/ratelimit.toml")
+	if err != nil {
+		t.Error(err)
+	}
+	if rateLimit.Store != "postgres" {
+		t.Errorf("Expected postgres store, but got: '%v'", rateLimit.Store)
+	}
+	if rateLimit.Table != "request_limits" {
+		t.Errorf("Expected table to be 'request_limits', but got: '%v'", rateLimit.Table)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		result, _ := store.Take("login:ip:127.0.0.1", 5, time.Minute)
+		if !result.Allowed {
+			t.Errorf("Expected request %v to be allowed", i+1)
+		}
+		if result.Remaining != 4-i {
+			t.Errorf("Expected to have %v remaining requests, but got: %v", 4-i, result.Remaining)
+		}
+	}
+	result, _ := store.Take("login:ip:127.0.0.1", 5, time.Minute)
+	if result.Allowed {
+		t.Error("Expected 6th request to be limited")
+	}
+	if result.RetryAfter != 12*time.Second {
+		t.Errorf("Expected to retry after 12s, but got: %v", result.RetryAfter)
+	}
+	result, _ = store.Take("login:ip:127.0.0.2", 5, time.Minute)
+	if !result.Allowed {
+		t.Error("Expected request from another ip to be allowed")
+	}
+	now = now.Add(12 * time.Second)
+	result, _ = store.Take("login:ip:127.0.0.1", 5, time.Minute)
+	if !result.Allowed {
+		t.Error("Expected request to be allowed after bucket refill")
+	}
+}
+
+func TestProcessRouteHook(t *testing.T) {
+	rateLimit := &RateLimit{store: NewMemoryStore()}
+	arg := map[string]interface{}{"per": "jwt", "key": "user_id", "limit": 1, "window": "1m"}
+	data := map[string]interface{}{"jwt": map[string]interface{}{"user_id": 5}}
+	r := httptest.NewRequest("POST", "/login", nil)
+	response := rateLimit.ProcessRouteHook("login", data, arg, r)
+	if response.ResponseCode != 0 {
+		t.Errorf("Expected first request to be allowed, but got: %v", response.ResponseCode)
+	}
+	if remaining := response.Headers["RateLimit-Remaining"]; len(remaining) != 1 || remaining[0] != "0" {
+		t.Errorf("Expected no remaining requests, but got: %v", remaining)
+	}
+	response = rateLimit.ProcessRouteHook("login", data, arg, r)
+	if response.ResponseCode != http.StatusTooManyRequests {
+		t.Errorf("Expected second request to be limited, but got: %v", response.ResponseCode)
+	}
+	if retryAfter := response.Headers["Retry-After"]; len(retryAfter) != 1 || retryAfter[0] != "60" {
+		t.Errorf("Expected to retry after 60 seconds, but got: %v", retryAfter)
+	}
+	response = rateLimit.ProcessRouteHook("sign_up", data, arg, r)
+	if response.ResponseCode != 0 {
+		t.Errorf("Expected limits to be separate for each route, but got: %v", response.ResponseCode)
+	}
+	response = rateLimit.ProcessRouteHook("login", data, map[string]interface{}{"per": "ip"}, r)
+	if response.ResponseCode != http.StatusInternalServerError {
+		t.Errorf("Expected error for missing limit, but got: %v", response.ResponseCode)
+	}
+}
+
+func TestProcessRouteHookStoreError(t *testing.T) {
+	rateLimit := &RateLimit{Store: "postgres"}
+	arg := map[string]interface{}{"per": "ip", "limit": 1, "window": "1m"}
+	r := httptest.NewRequest("POST", "/login", nil)
+	response := rateLimit.ProcessRouteHook("login", make(map[string]interface{}), arg, r)
+	if response == nil || response.ResponseCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected store error to fail closed, but got: %v", response)
+	}
+	rateLimit.FailOpen = true
+	if response := rateLimit.ProcessRouteHook("login", make(map[string]interface{}), arg, r); response != nil {
+		t.Errorf("Expected store error to let request through with fail_open, but got: %v", response)
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/products", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.2")
+	if key := (&limit{Per: "ip"}).requestKey(nil, r); key != "ip:10.0.0.1" {
+		t.Errorf("Expected ip key, but got: %v", key)
+	}
+	if key := (&limit{Per: "forwarded_ip", proxies: 1}).requestKey(nil, r); key != "ip:10.0.0.2" {
+		t.Errorf("Expected address appended by proxy, but got: %v", key)
+	}
+	if key := (&limit{Per: "forwarded_ip", proxies: 2}).requestKey(nil, r); key != "ip:203.0.113.7" {
+		t.Errorf("Expected address appended by outer proxy, but got: %v", key)
+	}
+	r.Header.Add("X-Forwarded-For", "198.51.100.1")
+	if key := (&limit{Per: "forwarded_ip", proxies: 1}).requestKey(nil, r); key != "ip:198.51.100.1" {
+		t.Errorf("Expected spoofed addresses to be skipped, but got: %v", key)
+	}
+	data := map[string]interface{}{"params": map[string]interface{}{"email": "a@example.com"}}
+	if key := (&limit{Per: "param", Key: "email"}).requestKey(data, r); key != "param:a@example.com" {
+		t.Errorf("Expected param key, but got: %v", key)
+	}
+	if key := (&limit{Per: "jwt", Key: "user_id"}).requestKey(data, r); key != "ip:10.0.0.1" {
+		t.Errorf("Expected to fall back to ip key, but got: %v", key)
+	}
+}
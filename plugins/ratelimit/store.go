@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"fmt"
+	"github.com/gophergala2016/dbserver/plugins"
+	"github.com/lib/pq"
+	"math"
+	"sync"
+	"time"
+)
+
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+type Store interface {
+	Take(key string, limit int, window time.Duration) (*Result, error)
+}
+
+// result converts token bucket state into headers data. Bucket refills
+// limit tokens per window.
+func result(allowed bool, tokens float64, limit int, window time.Duration) *Result {
+	rate := float64(limit) / window.Seconds()
+	res := &Result{
+		Allowed:   allowed,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     time.Duration((float64(limit) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return res
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	window    time.Duration
+}
+
+type MemoryStore struct {
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+	mutex     sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (self *MemoryStore) Take(key string, limit int, window time.Duration) (*Result, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	now := self.now()
+	self.sweep(now)
+	b := self.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(limit), updatedAt: now, window: window}
+		self.buckets[key] = b
+	}
+	rate := float64(limit) / window.Seconds()
+	b.tokens = math.Min(float64(limit), b.tokens+now.Sub(b.updatedAt).Seconds()*rate)
+	b.updatedAt = now
+	if b.tokens < 1 {
+		return result(false, b.tokens, limit, window), nil
+	}
+	b.tokens--
+	return result(true, b.tokens, limit, window), nil
+}
+
+// sweep removes buckets that had enough time to refill completely.
+func (self *MemoryStore) sweep(now time.Time) {
+	if now.Sub(self.lastSweep) < time.Minute {
+		return
+	}
+	for key, b := range self.buckets {
+		if now.Sub(b.updatedAt) > b.window {
+			delete(self.buckets, key)
+		}
+	}
+	self.lastSweep = now
+}
+
+type PostgresStore struct {
+	db    plugins.QueryRower
+	query string
+}
+
+func NewPostgresStore(db plugins.QueryRower, table string) *PostgresStore {
+	refilled := "least($2::float8, b.tokens + extract(epoch from now() - b.updated_at) * $3::float8)"
+	query := fmt.Sprintf(`insert into %[1]v as b (key, tokens, allowed, updated_at) values ($1, $2::float8 - 1, true, now())
+on conflict (key) do update set
+  tokens = case when %[2]v >= 1 then %[2]v - 1 else %[2]v end,
+  allowed = %[2]v >= 1,
+  updated_at = now()
+returning tokens, allowed`, pq.QuoteIdentifier(table), refilled)
+	return &PostgresStore{db: db, query: query}
+}
+
+func (self *PostgresStore) Take(key string, limit int, window time.Duration) (*Result, error) {
+	var tokens float64
+	var allowed bool
+	rate := float64(limit) / window.Seconds()
+	err := self.db.QueryRow(self.query, key, limit, rate).Scan(&tokens, &allowed)
+	if err != nil {
+		return nil, err
+	}
+	return result(allowed, tokens, limit, window), nil
+}
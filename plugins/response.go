@@ -1,8 +1,14 @@
 package plugins
 
+import (
+	"net/http"
+)
+
 type Response struct {
 	Data         map[string]interface{}
 	Headers      map[string][]string
+	Cookies      []*http.Cookie
+	Body         string
 	ResponseCode int
 	Error        string
 }
@@ -0,0 +1,6 @@
+package plugins
+
+type Session struct {
+	Role     string            `json:"role"`
+	Settings map[string]string `json:"settings"`
+}
@@ -0,0 +1,26 @@
+package plugins
+
+import (
+	"context"
+	"database/sql"
+)
+
+// QueryRower is implemented by both *sql.DB and *sql.Tx.
+type QueryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type txKey struct{}
+
+// WithTx returns context in which plugins run their queries in tx instead
+// of their own connection. Test runner uses it, so that plugins see fixtures
+// and their changes are rolled back.
+func WithTx(ctx context.Context, tx *sql.Tx) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+// TxFromContext returns transaction set by WithTx or nil.
+func TxFromContext(ctx context.Context) *sql.Tx {
+	tx, _ := ctx.Value(txKey{}).(*sql.Tx)
+	return tx
+}
@@ -0,0 +1,126 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/gophergala2016/dbserver/plugins"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Delivery struct {
+	Id      int64
+	Event   string
+	Payload string
+	Attempt int
+	Url     string
+	Secret  string
+}
+
+// Sign returns signature header value. Receivers recompute hex encoded
+// HMAC-SHA256 of "<timestamp>.<body>" with subscription secret and compare it
+// with v1 value.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%v.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%v,v1=%v", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// RetryDelay is time until failed delivery is posted again, starting with
+// retry_interval.
+func (self *Webhook) RetryDelay(attempt int) time.Duration {
+	return plugins.Backoff(self.RetryInterval.Duration, attempt)
+}
+
+// Deliver posts payload to subscriber. Any 2xx response is success.
+func (self *Webhook) Deliver(delivery *Delivery) (int, error) {
+	body := []byte(delivery.Payload)
+	request, err := http.NewRequest("POST", delivery.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "dbservice-webhook")
+	request.Header.Set("X-Webhook-Event", delivery.Event)
+	request.Header.Set("X-Webhook-Id", strconv.FormatInt(delivery.Id, 10))
+	request.Header.Set("X-Webhook-Attempt", strconv.Itoa(delivery.Attempt))
+	request.Header.Set(self.SignatureHeader, Sign(delivery.Secret, time.Now().Unix(), body))
+	response, err := self.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("unexpected status code %v", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+func (self *Webhook) work() {
+	for {
+		found, err := self.deliverNext()
+		if err != nil {
+			log.Printf("Webhook worker error: %v\n", err)
+		}
+		if !found || err != nil {
+			time.Sleep(self.PollInterval.Duration)
+		}
+	}
+}
+
+// deliverNext locks single pending delivery for the time of request, so
+// several workers and dbservice instances can share the queue.
+func (self *Webhook) deliverNext() (bool, error) {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	delivery := &Delivery{}
+	err = tx.QueryRow(fmt.Sprintf(`select d.id, d.event, d.payload, d.attempts + 1, s.url, s.secret
+from %v d join %v s on s.id = d.subscription_id
+where d.status = 'pending' and d.next_attempt_at <= now()
+order by d.next_attempt_at, d.id limit 1 for update of d skip locked`,
+		quoteIdentifier(self.DeliveriesTable), quoteIdentifier(self.SubscriptionsTable))).Scan(
+		&delivery.Id, &delivery.Event, &delivery.Payload, &delivery.Attempt, &delivery.Url, &delivery.Secret)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	start := time.Now()
+	statusCode, deliveryErr := self.Deliver(delivery)
+	duration := time.Since(start)
+	var errorMessage sql.NullString
+	status := "delivered"
+	if deliveryErr != nil {
+		errorMessage = sql.NullString{String: deliveryErr.Error(), Valid: true}
+		status = "pending"
+		if delivery.Attempt >= self.RetryAttempts {
+			status = "failed"
+		}
+		log.Printf("Webhook %v #%v to %v failed (attempt %v): %v\n", delivery.Event, delivery.Id, delivery.Url, delivery.Attempt, deliveryErr)
+	}
+	_, err = tx.Exec(fmt.Sprintf(`insert into %v (delivery_id, attempt, status_code, error, duration_ms) values ($1, $2, $3, $4, $5)`,
+		quoteIdentifier(self.AttemptsTable)),
+		delivery.Id, delivery.Attempt, sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}, errorMessage,
+		float64(duration)/float64(time.Millisecond))
+	if err != nil {
+		return true, err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`update %v set status = $2, attempts = $3,
+next_attempt_at = now() + $4 * interval '1 microsecond' where id = $1`, quoteIdentifier(self.DeliveriesTable)),
+		delivery.Id, status, delivery.Attempt, self.RetryDelay(delivery.Attempt).Nanoseconds()/1000)
+	if err != nil {
+		return true, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gophergala2016/dbserver/plugins"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Webhook struct {
+	SubscriptionsTable string           `toml:"subscriptions_table"`
+	DeliveriesTable    string           `toml:"deliveries_table"`
+	AttemptsTable      string           `toml:"attempts_table"`
+	SignatureHeader    string           `toml:"signature_header"`
+	RetryAttempts      int              `toml:"retry_attempts"`
+	RetryInterval      plugins.Duration `toml:"retry_interval"`
+	Timeout            plugins.Duration
+	PollInterval       plugins.Duration `toml:"poll_interval"`
+	Workers            int
+	db                 *sql.DB
+	client             *http.Client
+}
+
+func (self *Webhook) ParseConfig(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error while reading plugin config: %v", err))
+	}
+	self.SubscriptionsTable = "webhook_subscriptions"
+	self.DeliveriesTable = "webhook_deliveries"
+	self.AttemptsTable = "webhook_attempts"
+	self.SignatureHeader = "X-Webhook-Signature"
+	self.RetryAttempts = 8
+	self.RetryInterval.Duration = 30 * time.Second
+	self.Timeout.Duration = 10 * time.Second
+	self.PollInterval.Duration = time.Second
+	self.Workers = 1
+	_, err = toml.Decode(string(content), self)
+	if err != nil {
+		return err
+	}
+	self.client = &http.Client{Timeout: self.Timeout.Duration}
+	return nil
+}
+
+// SetDb creates delivery tables and starts delivery workers.
+func (self *Webhook) SetDb(db *sql.DB) {
+	self.db = db
+	err := self.createTables()
+	if err != nil {
+		log.Printf("Webhook tables error: %v\n", err)
+		return
+	}
+	for i := 0; i < self.Workers; i++ {
+		go self.work()
+	}
+}
+
+func (self *Webhook) createTables() error {
+	_, err := self.db.Exec(fmt.Sprintf(`create table if not exists %[1]v (
+  id bigserial primary key,
+  subscription_id bigint not null,
+  event text not null,
+  payload jsonb not null,
+  status text not null default 'pending',
+  attempts integer not null default 0,
+  next_attempt_at timestamptz not null default now(),
+  created_at timestamptz not null default now()
+);
+create index if not exists %[3]v on %[1]v (next_attempt_at) where status = 'pending';
+create table if not exists %[2]v (
+  id bigserial primary key,
+  delivery_id bigint not null references %[1]v (id) on delete cascade,
+  attempt integer not null,
+  status_code integer,
+  error text,
+  duration_ms double precision not null,
+  created_at timestamptz not null default now()
+)`, quoteIdentifier(self.DeliveriesTable), quoteIdentifier(self.AttemptsTable),
+		pq.QuoteIdentifier(strings.Replace(self.DeliveriesTable, ".", "_", -1)+"_pending_idx")))
+	return err
+}
+
+// Process queues delivery of route result to every active subscription of
+// the event.
+func (self *Webhook) Process(data map[string]interface{}, arg map[string]interface{}) *plugins.Response {
+	response := &plugins.Response{Data: data}
+	event, _ := arg["event"].(string)
+	if event == "" {
+		response.ResponseCode = http.StatusInternalServerError
+		response.Error = "webhook plugin requires event argument"
+		return response
+	}
+	payload, err := json.Marshal(data)
+	if err == nil {
+		_, err = self.db.Exec(fmt.Sprintf(`insert into %v (subscription_id, event, payload)
+select id, $1, $2 from %v where active and ($1 = any(events) or '*' = any(events))`,
+			quoteIdentifier(self.DeliveriesTable), quoteIdentifier(self.SubscriptionsTable)), event, string(payload))
+	}
+	if err != nil {
+		response.ResponseCode = http.StatusInternalServerError
+		response.Error = err.Error()
+	}
+	return response
+}
+
+func (self *Webhook) ProcessBeforeHook(data map[string]interface{}, r *http.Request) *plugins.Response {
+	return nil
+}
+
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newWebhook(t *testing.T) *Webhook {
+	webhook := &Webhook{}
+	err := webhook.ParseConfig("test_config/webhook.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webhook
+}
+
+func TestParseConfig(t *testing.T) {
+	webhook := newWebhook(t)
+	if webhook.SubscriptionsTable != "partner_webhooks" {
+		t.Errorf("Expected subscriptions table to be 'partner_webhooks', but got: '%v'", webhook.SubscriptionsTable)
+	}
+	if webhook.DeliveriesTable != "webhook_deliveries" {
+		t.Errorf("Expected default deliveries table, but got: '%v'", webhook.DeliveriesTable)
+	}
+	if webhook.RetryAttempts != 3 || webhook.RetryInterval.Duration != time.Minute {
+		t.Errorf("Expected 3 attempts with 1m interval, but got %v with %v", webhook.RetryAttempts, webhook.RetryInterval.Duration)
+	}
+	if webhook.client.Timeout != 2*time.Second {
+		t.Errorf("Expected 2s timeout, but got: %v", webhook.client.Timeout)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	webhook := newWebhook(t)
+	if webhook.RetryDelay(1) != time.Minute {
+		t.Errorf("Expected first retry after 1m, but got %v", webhook.RetryDelay(1))
+	}
+	if webhook.RetryDelay(3) != 4*time.Minute {
+		t.Errorf("Expected third retry after 4m, but got %v", webhook.RetryDelay(3))
+	}
+}
+
+func TestSign(t *testing.T) {
+	signature := Sign("secret", 1454198400, []byte(`{"id":1}`))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(`1454198400.{"id":1}`))
+	expected := "t=1454198400,v1=" + hex.EncodeToString(mac.Sum(nil))
+	if signature != expected {
+		t.Errorf("Expected signature %v, but got %v", expected, signature)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	code := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+	webhook := newWebhook(t)
+	delivery := &Delivery{Id: 5, Event: "product.created", Payload: `{"id":1}`, Attempt: 2, Url: server.URL, Secret: "secret"}
+	statusCode, err := webhook.Deliver(delivery)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if statusCode != http.StatusNoContent {
+		t.Errorf("Expected to get 204 status code, but got %v", statusCode)
+	}
+	if string(body) != `{"id":1}` {
+		t.Errorf("Expected to receive payload, but got %s", body)
+	}
+	if received.Header.Get("X-Webhook-Event") != "product.created" || received.Header.Get("X-Webhook-Id") != "5" ||
+		received.Header.Get("X-Webhook-Attempt") != "2" {
+		t.Errorf("Unexpected webhook headers: %v", received.Header)
+	}
+	signature := received.Header.Get("X-Webhook-Signature")
+	timestamp := strings.TrimPrefix(strings.Split(signature, ",")[0], "t=")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	if !strings.HasSuffix(signature, ",v1="+hex.EncodeToString(mac.Sum(nil))) {
+		t.Errorf("Signature doesn't match payload: %v", signature)
+	}
+	code = http.StatusServiceUnavailable
+	statusCode, err = webhook.Deliver(delivery)
+	if err == nil || statusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected to get error with 503 status code, but got %v, %v", statusCode, err)
+	}
+}
+
+func TestProcessRequiresEvent(t *testing.T) {
+	webhook := newWebhook(t)
+	response := webhook.Process(map[string]interface{}{"id": 1}, map[string]interface{}{})
+	if response.ResponseCode != http.StatusInternalServerError {
+		t.Errorf("Expected to get 500 status code without event, but got %v", response.ResponseCode)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,19 +18,68 @@ type Route struct {
 	Path            string
 	Collection      bool
 	Custom          bool
+	Description     string
 	Versions        map[int]*RouteVersion
 	PluginPipelines []*PluginPipeline
+	Stream          *Stream
+	ResponseSchema  map[string]interface{}
 }
 
 type PluginPipeline struct {
-	Name     string
-	Argument map[string]interface{}
+	Name     string                 `json:"name"`
+	Argument map[string]interface{} `json:"argument,omitempty"`
 }
 
 type RouteVersion struct {
 	Version     int
 	Schema      *gojsonschema.Schema
+	SchemaJson  map[string]interface{}
+	SchemaFile  string
+	Files       map[string]*FileRule
 	SqlTemplate *template.Template
+	SqlFile     string
+}
+
+// HttpMethod returns request method that route is served with.
+func (self *Route) HttpMethod() string {
+	if self.Stream != nil {
+		return "GET"
+	}
+	return self.Method
+}
+
+// GetDescription returns description from route definition or from route
+// schema.
+func (self *Route) GetDescription(version int) string {
+	if self.Description != "" {
+		return self.Description
+	}
+	routeVersion := self.Versions[self.GetAvailableVersion(version)]
+	if routeVersion == nil || routeVersion.SchemaJson == nil {
+		return ""
+	}
+	description, _ := routeVersion.SchemaJson["description"].(string)
+	return description
+}
+
+func (self *Route) PipelineArgument(name string) map[string]interface{} {
+	for _, pp := range self.PluginPipelines {
+		if pp.Name == name {
+			return pp.Argument
+		}
+	}
+	return nil
+}
+
+// HasPipeline reports whether route goes through plugin, with or without
+// argument.
+func (self *Route) HasPipeline(name string) bool {
+	for _, pp := range self.PluginPipelines {
+		if pp.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (self *Route) validate(params interface{}, version int) (string, error) {
@@ -60,23 +110,45 @@ func (self *Route) validate(params interface{}, version int) (string, error) {
 }
 
 func (self *Route) Sql(data map[string]interface{}, version int) (string, error) {
+	return self.SqlContext(context.Background(), data, version)
+}
+
+// SqlContext is Sql that records validation and rendering in request trace.
+func (self *Route) SqlContext(ctx context.Context, data map[string]interface{}, version int) (string, error) {
+	requestedVersion := version
 	version = self.GetAvailableVersion(version)
 	route := self.Versions[version]
 	if route == nil {
 		return "", fmt.Errorf("Route version %v missing from %v route", version, self.Name)
 	}
-	var out bytes.Buffer
+	_, span := startSpan(ctx, "schema_validation", spanKindInternal)
+	span.SetAttribute("dbservice.schema", route.SchemaFile)
 	response, err := self.validate(data["params"], version)
+	span.SetError(err)
+	span.SetAttribute("dbservice.valid", err == nil && response == "")
+	span.End()
 	if err != nil {
 		return "", err
 	}
 	if response != "" {
+		validationFailures.Inc(self.Name, versionLabel(requestedVersion))
 		return response, errors.New("schema validation failed")
 	}
+	_, span = startSpan(ctx, "render_template", spanKindInternal)
+	defer span.End()
+	span.SetAttribute("dbservice.template", route.SqlFile)
+	sql, err := self.render(route, data)
+	span.SetError(err)
+	return sql, err
+}
+
+// render executes sql template of route version without validating params.
+func (self *Route) render(route *RouteVersion, data map[string]interface{}) (string, error) {
+	var out bytes.Buffer
 	if !self.Custom {
 		out.Write([]byte("with response_table as ("))
 	}
-	err = route.SqlTemplate.Execute(&out, data)
+	err := route.SqlTemplate.Execute(&out, data)
 	if err != nil {
 		return "", err
 	}
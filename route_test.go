@@ -24,7 +24,7 @@ func TestRouteSql(t *testing.T) {
 	if err != nil {
 		t.Errorf("Expected not to get error, but got: %v", err)
 	}
-	tmpl, err := makeTemplate(`select * from users where id={{.id}}`)
+	tmpl, err := makeTemplate(`select * from users where id={{.params.id}}`)
 	if err != nil {
 		t.Errorf("Expected not to get error, but got: %v", err)
 	}
@@ -39,7 +39,7 @@ func TestRouteSql(t *testing.T) {
 	}
 	params := make(map[string]interface{})
 	params["id"] = 23
-	sql, err := route.Sql(params, 0)
+	sql, err := route.Sql(map[string]interface{}{"params": params}, 0)
 	if err != nil {
 		t.Errorf("Expected not to get error, but got: %v", err)
 	}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type RouteTable struct {
+	Version            int          `json:"version"`
+	MinVersion         int          `json:"min_version"`
+	DeprecatedVersions []int        `json:"deprecated_versions"`
+	Plugins            []string     `json:"plugins"`
+	Routes             []*RouteInfo `json:"routes"`
+}
+
+type RouteInfo struct {
+	Name       string              `json:"name"`
+	Method     string              `json:"method"`
+	Collection bool                `json:"collection"`
+	Stream     bool                `json:"stream"`
+	Plugins    []*PluginPipeline   `json:"plugins"`
+	Versions   []*RouteVersionInfo `json:"versions"`
+}
+
+// RouteVersionInfo is what requests of api version are served with: sql
+// template and schema are resolved the same way as for requests.
+type RouteVersionInfo struct {
+	Version    int      `json:"version"`
+	Resolved   int      `json:"resolved"`
+	Deprecated bool     `json:"deprecated"`
+	Paths      []string `json:"paths"`
+	Sql        string   `json:"sql"`
+	Schema     string   `json:"schema"`
+}
+
+// apiVersions returns versions that routes are registered for, 0 if api is
+// not versioned.
+func apiVersions(api *Api) []int {
+	if api.Version == 0 {
+		return []int{0}
+	}
+	versions := make([]int, 0)
+	for i := api.MinVersion; i <= api.Version; i++ {
+		versions = append(versions, i)
+	}
+	return versions
+}
+
+func NewRouteTable(api *Api) *RouteTable {
+	table := &RouteTable{
+		Version:            api.Version,
+		MinVersion:         api.MinVersion,
+		DeprecatedVersions: api.DeprecatedVersions,
+		Plugins:            api.PluginsList,
+		Routes:             make([]*RouteInfo, 0, len(api.Routes)),
+	}
+	if table.DeprecatedVersions == nil {
+		table.DeprecatedVersions = []int{}
+	}
+	if table.Plugins == nil {
+		table.Plugins = []string{}
+	}
+	for _, route := range api.Routes {
+		info := &RouteInfo{
+			Name:       route.Name,
+			Method:     route.HttpMethod(),
+			Collection: route.Collection,
+			Stream:     route.Stream != nil,
+			Plugins:    route.PluginPipelines,
+			Versions:   make([]*RouteVersionInfo, 0),
+		}
+		if info.Plugins == nil {
+			info.Plugins = []*PluginPipeline{}
+		}
+		if route.Stream != nil {
+			// Stream routes are registered once and don't have sql.
+			info.Versions = append(info.Versions, &RouteVersionInfo{Paths: []string{route.Path}})
+			table.Routes = append(table.Routes, info)
+			continue
+		}
+		for _, version := range apiVersions(api) {
+			resolved := route.GetAvailableVersion(version)
+			versionInfo := &RouteVersionInfo{
+				Version:    version,
+				Resolved:   resolved,
+				Deprecated: api.IsDeprecated(version),
+				Paths:      make([]string, 0),
+			}
+			if version != 0 {
+				versionInfo.Paths = append(versionInfo.Paths, "/v"+strconv.Itoa(version)+route.Path)
+			}
+			// Requests without version get the latest one.
+			if version == api.Version {
+				versionInfo.Paths = append(versionInfo.Paths, route.Path)
+			}
+			if routeVersion := route.Versions[resolved]; routeVersion != nil {
+				versionInfo.Sql = routeVersion.SqlFile
+				versionInfo.Schema = routeVersion.SchemaFile
+			}
+			info.Versions = append(info.Versions, versionInfo)
+		}
+		table.Routes = append(table.Routes, info)
+	}
+	return table
+}
+
+func (self *RouteInfo) pluginNames() string {
+	names := make([]string, 0, len(self.Plugins))
+	for _, pipeline := range self.Plugins {
+		names = append(names, pipeline.Name)
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, ",")
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func (self *RouteTable) Print(w *tabwriter.Writer) error {
+	fmt.Fprintln(w, "ROUTE\tVERSION\tMETHOD\tPATHS\tSQL\tSCHEMA\tPLUGINS\tDEPRECATED")
+	for _, route := range self.Routes {
+		for _, version := range route.Versions {
+			versionName := "-"
+			if version.Version != 0 {
+				versionName = strconv.Itoa(version.Version)
+			}
+			sql := version.Sql
+			if sql == "" && !route.Stream {
+				sql = "missing"
+			}
+			deprecated := ""
+			if version.Deprecated {
+				deprecated = "yes"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", route.Name, versionName, route.Method,
+				strings.Join(version.Paths, " "), orDash(sql), orDash(version.Schema), route.pluginNames(), deprecated)
+		}
+	}
+	return w.Flush()
+}
+
+func routesCommand(args []string) error {
+	flags := flag.NewFlagSet("routes", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "print routes as json")
+	flags.Parse(args)
+	api, err := loadApi()
+	if err != nil {
+		return err
+	}
+	table := NewRouteTable(api)
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(table)
+	}
+	return table.Print(tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0))
+}
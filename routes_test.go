@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"text/tabwriter"
+)
+
+func TestRouteTable(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := NewRouteTable(api)
+	if table.Version != 5 || table.MinVersion != 3 || len(table.Routes) != 3 {
+		t.Fatalf("Unexpected route table: %+v", table)
+	}
+	getUsers := table.Routes[0]
+	if getUsers.Name != "get_users" || getUsers.Method != "GET" || len(getUsers.Versions) != 3 {
+		t.Fatalf("Unexpected get_users route: %+v", getUsers)
+	}
+	expected := []*RouteVersionInfo{
+		{Version: 3, Resolved: 4, Deprecated: true, Paths: []string{"/v3/users"}, Sql: "testapp/sql/get_users.v4.sql"},
+		{Version: 4, Resolved: 4, Deprecated: true, Paths: []string{"/v4/users"}, Sql: "testapp/sql/get_users.v4.sql"},
+		{Version: 5, Resolved: 0, Paths: []string{"/v5/users", "/users"}, Sql: "testapp/sql/get_users.sql"},
+	}
+	for i, version := range getUsers.Versions {
+		if !reflect.DeepEqual(version, expected[i]) {
+			t.Errorf("Expected version %+v, but got %+v", expected[i], version)
+		}
+	}
+	createUser := table.Routes[1]
+	if createUser.Versions[0].Schema != "testapp/schemas/create_user.v4.schema" || createUser.Versions[2].Schema != "testapp/schemas/create_user.schema" {
+		t.Errorf("Unexpected create_user schemas: %+v %+v", createUser.Versions[0], createUser.Versions[2])
+	}
+	content, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"deprecated_versions":[1,3,4]`) || !strings.Contains(string(content), `"paths":["/v5/users","/users"]`) {
+		t.Errorf("Unexpected json: %s", content)
+	}
+}
+
+func TestRouteTablePrint(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = NewRouteTable(api).Print(tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 10 || !strings.HasPrefix(lines[0], "ROUTE") {
+		t.Fatalf("Unexpected output:\n%v", out.String())
+	}
+	if fields := strings.Fields(lines[1]); !reflect.DeepEqual(fields, []string{"get_users", "3", "GET", "/v3/users", "testapp/sql/get_users.v4.sql", "-", "-", "yes"}) {
+		t.Errorf("Unexpected line: %v", fields)
+	}
+}
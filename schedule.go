@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const scheduleTable = "dbservice_schedule"
+
+type Task struct {
+	*Route
+	Cron     string
+	Schedule *CronSchedule
+}
+
+type Schedule struct {
+	Tasks    []*Task
+	Location *time.Location
+}
+
+type TaskStatus struct {
+	Name         string     `json:"name"`
+	Cron         string     `json:"cron"`
+	NextRunAt    time.Time  `json:"next_run_at"`
+	ScheduledAt  *time.Time `json:"scheduled_at"`
+	StartedAt    *time.Time `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at"`
+	DurationMs   *float64   `json:"duration_ms"`
+	Status       *string    `json:"status"`
+	RowsAffected *int64     `json:"rows_affected"`
+	Error        *string    `json:"error"`
+}
+
+func (self *Schedule) CreateTable(db *sql.DB) error {
+	_, err := db.Exec(`create table if not exists ` + scheduleTable + ` (
+  name text primary key,
+  scheduled_at timestamptz not null,
+  started_at timestamptz not null,
+  finished_at timestamptz not null,
+  status text not null,
+  rows_affected bigint,
+  error text
+)`)
+	return err
+}
+
+func (self *Schedule) Start(db *sql.DB) {
+	for _, task := range self.Tasks {
+		go func(task *Task) {
+			for {
+				scheduledAt := task.Schedule.Next(time.Now().In(self.Location))
+				if scheduledAt.IsZero() {
+					log.Printf("Task %v will never run\n", task.Name)
+					return
+				}
+				time.Sleep(time.Until(scheduledAt))
+				err := self.run(db, task, scheduledAt)
+				if err != nil {
+					log.Printf("Task %v error: %v\n", task.Name, err)
+				}
+			}
+		}(task)
+	}
+}
+
+// run executes task unless another dbservice instance holds its advisory
+// lock or has already run it for the same scheduled time.
+func (self *Schedule) run(db *sql.DB, task *Task, scheduledAt time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var locked bool
+	err = tx.QueryRow("select pg_try_advisory_xact_lock(hashtext($1), hashtext($2))", scheduleTable, task.Name).Scan(&locked)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	var lastScheduledAt time.Time
+	err = tx.QueryRow("select scheduled_at from "+scheduleTable+" where name = $1", task.Name).Scan(&lastScheduledAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && !lastScheduledAt.Before(scheduledAt) {
+		return nil
+	}
+	startedAt := time.Now()
+	status := "success"
+	var rowsAffected sql.NullInt64
+	var taskError sql.NullString
+	_, err = tx.Exec("savepoint task")
+	if err != nil {
+		return err
+	}
+	rowsAffected.Int64, err = self.exec(tx, task, scheduledAt)
+	rowsAffected.Valid = err == nil
+	if err != nil {
+		status = "error"
+		taskError = sql.NullString{String: err.Error(), Valid: true}
+		_, err = tx.Exec("rollback to savepoint task")
+		if err != nil {
+			return err
+		}
+	}
+	finishedAt := time.Now()
+	if taskError.Valid {
+		log.Printf("Task %v failed after %s: %v\n", task.Name, finishedAt.Sub(startedAt), taskError.String)
+	} else {
+		log.Printf("Task %v affected %v rows in %s\n", task.Name, rowsAffected.Int64, finishedAt.Sub(startedAt))
+	}
+	_, err = tx.Exec(`insert into `+scheduleTable+` (name, scheduled_at, started_at, finished_at, status, rows_affected, error)
+values ($1, $2, $3, $4, $5, $6, $7)
+on conflict (name) do update set scheduled_at = excluded.scheduled_at, started_at = excluded.started_at,
+finished_at = excluded.finished_at, status = excluded.status, rows_affected = excluded.rows_affected, error = excluded.error`,
+		task.Name, scheduledAt, startedAt, finishedAt, status, rowsAffected, taskError)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (self *Schedule) exec(tx *sql.Tx, task *Task, scheduledAt time.Time) (int64, error) {
+	data := map[string]interface{}{
+		"task": map[string]interface{}{
+			"name":         task.Name,
+			"scheduled_at": scheduledAt.Format(time.RFC3339),
+		},
+	}
+	query, err := task.Sql(data, 0)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (self *Schedule) Status(db *sql.DB) ([]*TaskStatus, error) {
+	statuses := make([]*TaskStatus, 0, len(self.Tasks))
+	byName := make(map[string]*TaskStatus)
+	now := time.Now().In(self.Location)
+	for _, task := range self.Tasks {
+		status := &TaskStatus{Name: task.Name, Cron: task.Cron, NextRunAt: task.Schedule.Next(now)}
+		statuses = append(statuses, status)
+		byName[task.Name] = status
+	}
+	rows, err := db.Query(`select name, scheduled_at, started_at, finished_at,
+extract(epoch from finished_at - started_at) * 1000, status, rows_affected, error from ` + scheduleTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		last := &TaskStatus{}
+		err = rows.Scan(&name, &last.ScheduledAt, &last.StartedAt, &last.FinishedAt, &last.DurationMs,
+			&last.Status, &last.RowsAffected, &last.Error)
+		if err != nil {
+			return nil, err
+		}
+		status := byName[name]
+		if status == nil {
+			continue
+		}
+		last.Name, last.Cron, last.NextRunAt = status.Name, status.Cron, status.NextRunAt
+		*status = *last
+	}
+	return statuses, rows.Err()
+}
+
+// adminHandler protects admin endpoints with token from [admin] section of
+// config.toml.
+func adminHandler(token string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h(w, r, p)
+	}
+}
+
+func scheduleStatusHandler(schedule *Schedule) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		statuses, err := schedule.Status(db)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		content, err := json.Marshal(statuses)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(content))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	schedule, err := ParseSchedule("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if schedule.Location != time.UTC {
+		t.Errorf("Expected to get UTC location, but got %v", schedule.Location)
+	}
+	if len(schedule.Tasks) != 2 {
+		t.Fatalf("Expected to get 2 tasks, but got %v", len(schedule.Tasks))
+	}
+	if schedule.Tasks[0].Name != "cleanup_expired" || schedule.Tasks[0].Cron != "0 3 * * *" {
+		t.Errorf("Unexpected first task: %v '%v'", schedule.Tasks[0].Name, schedule.Tasks[0].Cron)
+	}
+	if schedule.Tasks[1].Name != "rollup_stats" || schedule.Tasks[1].Cron != "@hourly" {
+		t.Errorf("Unexpected second task: %v '%v'", schedule.Tasks[1].Name, schedule.Tasks[1].Cron)
+	}
+	data := map[string]interface{}{"task": map[string]interface{}{"scheduled_at": "2016-01-30T11:00:00Z"}}
+	query, err := schedule.Tasks[1].Sql(data, 0)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if query != "insert into hourly_stats (hour, orders) select date_trunc('hour', '2016-01-30T11:00:00Z'::timestamptz), count(*) from orders" {
+		t.Errorf("Unexpected task sql: %v", query)
+	}
+}
+
+func TestParseTask(t *testing.T) {
+	_, err := ParseTask([]byte("'0 3 * *' cleanup"))
+	if err == nil {
+		t.Error("Expected to get error for invalid cron expression, but got nil")
+	}
+	_, err = ParseTask([]byte("'0 3 * * *'"))
+	if err == nil {
+		t.Error("Expected to get error for missing task name, but got nil")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	h := adminHandler("secret", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for token, code := range map[string]int{"": http.StatusUnauthorized, "Bearer wrong": http.StatusUnauthorized, "Bearer secret": http.StatusNoContent} {
+		r := httptest.NewRequest("GET", "/_admin/schedule", nil)
+		if token != "" {
+			r.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		if w.Code != code {
+			t.Errorf("Expected to get %v status code for '%v', but got %v", code, token, w.Code)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Storage interface {
+	Store(key string, mimeType string, content io.Reader, size int64) (string, error)
+	Url(key string) string
+	Delete(key string) error
+}
+
+func NewStorage(config StorageConfig) (Storage, error) {
+	switch config.Type {
+	case "local":
+		return &LocalStorage{Directory: config.Directory, UrlPrefix: config.UrlPrefix}, nil
+	case "s3":
+		if config.Endpoint == "" || config.Bucket == "" {
+			return nil, fmt.Errorf("s3 storage requires endpoint and bucket")
+		}
+		return &S3Storage{
+			Endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+			Region:    config.Region,
+			Bucket:    config.Bucket,
+			AccessKey: config.AccessKey,
+			SecretKey: config.SecretKey,
+			PublicUrl: strings.TrimSuffix(config.PublicUrl, "/"),
+			client:    http.DefaultClient,
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown storage type: %v", config.Type)
+}
+
+func storageKey(field string, filename string) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return field + "/" + hex.EncodeToString(buf) + strings.ToLower(filepath.Ext(filename)), nil
+}
+
+type LocalStorage struct {
+	Directory string
+	UrlPrefix string
+}
+
+func (self *LocalStorage) Store(key string, mimeType string, content io.Reader, size int64) (string, error) {
+	filePath := filepath.Join(self.Directory, filepath.FromSlash(key))
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, content)
+	if err != nil {
+		return "", err
+	}
+	return self.Url(key), nil
+}
+
+func (self *LocalStorage) Url(key string) string {
+	if self.UrlPrefix == "" {
+		return ""
+	}
+	return path.Join(self.UrlPrefix, key)
+}
+
+func (self *LocalStorage) Delete(key string) error {
+	return os.Remove(filepath.Join(self.Directory, filepath.FromSlash(key)))
+}
+
+// S3Storage uploads files to S3 compatible storage (AWS, MinIO, ...) using
+// path style urls and signature version 4.
+type S3Storage struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PublicUrl string
+	client    *http.Client
+	now       func() time.Time
+}
+
+func (self *S3Storage) Store(key string, mimeType string, content io.Reader, size int64) (string, error) {
+	body, err := ioutil.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("PUT", self.objectUrl(key), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mimeType)
+	err = self.do(req, body)
+	if err != nil {
+		return "", fmt.Errorf("s3 upload of %v failed: %v", key, err)
+	}
+	return self.Url(key), nil
+}
+
+func (self *S3Storage) Url(key string) string {
+	if self.PublicUrl != "" {
+		return self.PublicUrl + "/" + key
+	}
+	return self.objectUrl(key)
+}
+
+func (self *S3Storage) Delete(key string) error {
+	req, err := http.NewRequest("DELETE", self.objectUrl(key), nil)
+	if err != nil {
+		return err
+	}
+	err = self.do(req, nil)
+	if err != nil {
+		return fmt.Errorf("s3 delete of %v failed: %v", key, err)
+	}
+	return nil
+}
+
+func (self *S3Storage) objectUrl(key string) string {
+	return self.Endpoint + "/" + self.Bucket + "/" + key
+}
+
+// do signs and sends request.
+func (self *S3Storage) do(req *http.Request, body []byte) error {
+	now := time.Now()
+	if self.now != nil {
+		now = self.now()
+	}
+	signRequest(req, body, "s3", self.Region, self.AccessKey, self.SecretKey, now)
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, message)
+	}
+	return nil
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func signRequest(req *http.Request, body []byte, service string, region string, accessKey string, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalUri := req.URL.EscapedPath()
+	if canonicalUri == "" {
+		canonicalUri = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalUri,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	signingKey := hmacSha256([]byte("AWS4"+secretKey), date)
+	signingKey = hmacSha256(signingKey, region)
+	signingKey = hmacSha256(signingKey, service)
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, url.QueryEscape(key)+"="+strings.Replace(url.QueryEscape(value), "+", "%20", -1))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	// get-vanilla case from AWS signature version 4 test suite
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signRequest(req, nil, "service", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if req.Header.Get("Authorization") != expected {
+		t.Errorf("Expected authorization header:\n%v, but got:\n%v", expected, req.Header.Get("Authorization"))
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	uploads := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(uploads, r.URL.Path)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		uploads[r.URL.Path] = string(body)
+	}))
+	defer server.Close()
+	s3, err := NewStorage(StorageConfig{Type: "s3", Endpoint: server.URL, Bucket: "uploads", Region: "us-east-1", AccessKey: "minio", SecretKey: "minio123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := s3.Store("avatar/1.png", "image/png", strings.NewReader("png"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != server.URL+"/uploads/avatar/1.png" {
+		t.Errorf("Unexpected file url: %v", url)
+	}
+	if uploads["/uploads/avatar/1.png"] != "png" {
+		t.Errorf("Expected file to be uploaded to bucket, but got: %v", uploads)
+	}
+	err = s3.Delete("avatar/1.png")
+	if err != nil || len(uploads) != 0 {
+		t.Errorf("Expected file to be deleted from bucket, but got: %v %v", uploads, err)
+	}
+	s3.(*S3Storage).AccessKey = "unknown"
+	_, err = s3.Store("avatar/2.png", "image/png", strings.NewReader("png"), 3)
+	if err == nil {
+		t.Error("Expected to get error for rejected upload")
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	directory, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	local := &LocalStorage{Directory: directory, UrlPrefix: "/uploads"}
+	url, err := local.Store("avatar/1.txt", "text/plain", strings.NewReader("hello"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "/uploads/avatar/1.txt" {
+		t.Errorf("Unexpected file url: %v", url)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(directory, "avatar", "1.txt"))
+	if err != nil || string(content) != "hello" {
+		t.Errorf("Expected file to be stored, but got: %v %v", string(content), err)
+	}
+	err = local.Delete("avatar/1.txt")
+	if _, statErr := os.Stat(filepath.Join(directory, "avatar", "1.txt")); err != nil || !os.IsNotExist(statErr) {
+		t.Errorf("Expected file to be deleted, but got: %v", err)
+	}
+}
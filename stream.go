@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamHistorySize = 100
+	streamBufferSize  = 64
+)
+
+type Stream struct {
+	Channel   string
+	Filter    map[string]string
+	Heartbeat time.Duration
+}
+
+// Values returns values that notification payload fields have to be equal to
+// for client with given request data. Conditions on missing params are
+// skipped, other missing values (like jwt claims) make it false.
+func (self *Stream) Values(data map[string]interface{}) (map[string]interface{}, bool) {
+	values := make(map[string]interface{})
+	for field, source := range self.Filter {
+		parts := strings.SplitN(source, ".", 2)
+		object, _ := data[parts[0]].(map[string]interface{})
+		value, ok := object[parts[1]]
+		if !ok || value == nil {
+			if parts[0] == "params" {
+				continue
+			}
+			return nil, false
+		}
+		values[field] = value
+	}
+	return values, true
+}
+
+type Event struct {
+	Id      int64
+	Channel string
+	Data    string
+	payload map[string]interface{}
+}
+
+type Subscriber struct {
+	Events chan *Event
+	values map[string]interface{}
+}
+
+func (self *Subscriber) matches(event *Event) bool {
+	if len(self.values) == 0 {
+		return true
+	}
+	if event.payload == nil {
+		return false
+	}
+	for field, value := range self.values {
+		payloadValue, ok := event.payload[field]
+		if !ok || fmt.Sprint(payloadValue) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Broker listens to PostgreSQL notifications and passes them to stream
+// subscribers. Last events of every channel are kept, so clients can resume
+// from Last-Event-ID after reconnect.
+type Broker struct {
+	listener    *pq.Listener
+	lock        sync.Mutex
+	lastId      int64
+	history     map[string][]*Event
+	subscribers map[string]map[*Subscriber]bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		// Ids keep growing after restart.
+		lastId:      time.Now().UnixNano(),
+		history:     make(map[string][]*Event),
+		subscribers: make(map[string]map[*Subscriber]bool),
+	}
+}
+
+func (self *Broker) Listen(connectionString string, channels []string) error {
+	self.listener = pq.NewListener(connectionString, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Stream listener error: %v\n", err)
+		}
+	})
+	for _, channel := range channels {
+		err := self.listener.Listen(channel)
+		if err != nil && err != pq.ErrChannelAlreadyOpen {
+			return err
+		}
+	}
+	go func() {
+		for {
+			select {
+			case notification := <-self.listener.Notify:
+				if notification != nil {
+					self.Publish(notification.Channel, notification.Extra)
+				}
+			case <-time.After(time.Minute):
+				go self.listener.Ping()
+			}
+		}
+	}()
+	return nil
+}
+
+func (self *Broker) Publish(channel string, data string) {
+	event := &Event{Channel: channel, Data: data}
+	payload := make(map[string]interface{})
+	if json.Unmarshal([]byte(data), &payload) == nil {
+		event.payload = payload
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastId++
+	event.Id = self.lastId
+	history := append(self.history[channel], event)
+	if len(history) > streamHistorySize {
+		history = history[len(history)-streamHistorySize:]
+	}
+	self.history[channel] = history
+	for subscriber := range self.subscribers[channel] {
+		if !subscriber.matches(event) {
+			continue
+		}
+		select {
+		case subscriber.Events <- event:
+		default:
+			// Slow client is disconnected, it can catch up with Last-Event-ID.
+			delete(self.subscribers[channel], subscriber)
+			close(subscriber.Events)
+		}
+	}
+}
+
+// Subscribe returns new subscriber together with kept events that come after
+// lastId and match subscriber values.
+func (self *Broker) Subscribe(channel string, values map[string]interface{}, lastId int64) (*Subscriber, []*Event) {
+	subscriber := &Subscriber{
+		Events: make(chan *Event, streamBufferSize),
+		values: values,
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	missed := make([]*Event, 0)
+	if lastId != 0 {
+		for _, event := range self.history[channel] {
+			if event.Id > lastId && subscriber.matches(event) {
+				missed = append(missed, event)
+			}
+		}
+	}
+	if self.subscribers[channel] == nil {
+		self.subscribers[channel] = make(map[*Subscriber]bool)
+	}
+	self.subscribers[channel][subscriber] = true
+	return subscriber, missed
+}
+
+func (self *Broker) Unsubscribe(channel string, subscriber *Subscriber) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.subscribers[channel], subscriber)
+}
+
+func streamChannels(routes []*Route) []string {
+	channels := make([]string, 0)
+	for _, route := range routes {
+		if route.Stream != nil {
+			channels = append(channels, route.Stream.Channel)
+		}
+	}
+	return channels
+}
+
+func streamHandler(api *Api, route *Route, broker *Broker) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		urlParams := make(map[string]interface{})
+		for _, urlParam := range ps {
+			urlParams[urlParam.Key] = urlParam.Value
+		}
+		params, err := getRequestParams(r, urlParams)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lastEventId := r.Header.Get("Last-Event-ID")
+		if value, ok := params["last_event_id"].(string); ok {
+			lastEventId = value
+			delete(params, "last_event_id")
+		}
+		var lastId int64
+		if lastEventId != "" {
+			lastId, err = strconv.ParseInt(lastEventId, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		data := make(map[string]interface{})
+		data["params"] = params
+		if !runBeforeHooks(api, data, r, w) {
+			return
+		}
+		if !runRouteHooks(api, route, data, r, w) {
+			return
+		}
+		if route.Versions[0] != nil {
+			errorsJson, err := route.validate(params, 0)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			if errorsJson != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, errorsJson)
+				return
+			}
+		}
+		values, ok := route.Stream.Values(data)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		subscriber, missed := broker.Subscribe(route.Stream.Channel, values, lastId)
+		defer broker.Unsubscribe(route.Stream.Channel, subscriber)
+		if isWebSocketRequest(r) {
+			serveWebSocket(w, r, route.Stream, subscriber, missed)
+		} else {
+			serveEventStream(w, r, route.Stream, subscriber, missed)
+		}
+	}
+}
+
+func serveEventStream(w http.ResponseWriter, r *http.Request, stream *Stream, subscriber *Subscriber, missed []*Event) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Streaming is not supported by response writer")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(stream.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-subscriber.Events:
+			if !ok {
+				return
+			}
+			writeEvent(w, event)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event *Event) {
+	fmt.Fprintf(w, "id: %v\n", event.Id)
+	for _, line := range strings.Split(event.Data, "\n") {
+		fmt.Fprintf(w, "data: %v\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+func eventMessage(event *Event) ([]byte, error) {
+	message := struct {
+		Id   string      `json:"id"`
+		Data interface{} `json:"data"`
+	}{Id: strconv.FormatInt(event.Id, 10), Data: event.Data}
+	if json.Valid([]byte(event.Data)) {
+		message.Data = json.RawMessage(event.Data)
+	}
+	return json.Marshal(message)
+}
+
+func serveWebSocket(w http.ResponseWriter, r *http.Request, stream *Stream, subscriber *Subscriber, missed []*Event) {
+	conn, err := acceptWebSocket(w, r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+	closed := make(chan struct{})
+	go func() {
+		conn.readLoop()
+		close(closed)
+	}()
+	send := func(event *Event) error {
+		message, err := eventMessage(event)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(opText, message)
+	}
+	for _, event := range missed {
+		if send(event) != nil {
+			return
+		}
+	}
+	heartbeat := time.NewTicker(stream.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-subscriber.Events:
+			if !ok {
+				conn.WriteMessage(opClose, closeMessage(closeGoingAway))
+				return
+			}
+			err = send(event)
+		case <-heartbeat.C:
+			err = conn.WriteMessage(opPing, nil)
+		case <-closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
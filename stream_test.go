@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"github.com/julienschmidt/httprouter"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStreamRoute(t *testing.T) {
+	route, err := ParseRoute([]byte("stream /orders/changes, name: 'order_changes', channel: 'orders', heartbeat: '5s', filter: 'user_id=jwt.user_id status=params.status'"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if route.Stream == nil {
+		t.Fatal("Expected to get stream route, but got nil stream")
+	}
+	if route.HttpMethod() != "GET" {
+		t.Errorf("Expected stream to be served with GET, but got %v", route.HttpMethod())
+	}
+	if route.Stream.Channel != "orders" || route.Stream.Heartbeat != 5*time.Second {
+		t.Errorf("Unexpected stream options: %+v", route.Stream)
+	}
+	if route.Stream.Filter["user_id"] != "jwt.user_id" || route.Stream.Filter["status"] != "params.status" {
+		t.Errorf("Unexpected stream filter: %v", route.Stream.Filter)
+	}
+	route, err = ParseRoute([]byte("stream /changes, name: 'changes'"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if route.Stream.Channel != "changes" {
+		t.Errorf("Expected channel to default to route name, but got %v", route.Stream.Channel)
+	}
+	_, err = ParseRoute([]byte("stream /changes, name: 'changes', filter: 'user_id'"))
+	if err == nil {
+		t.Error("Expected to get error for invalid filter, but got nil")
+	}
+	for _, heartbeat := range []string{"0s", "-5s"} {
+		_, err = ParseRoute([]byte("stream /changes, name: 'changes', heartbeat: '" + heartbeat + "'"))
+		if err == nil {
+			t.Errorf("Expected to get error for %v heartbeat, but got nil", heartbeat)
+		}
+	}
+}
+
+func TestStreamValues(t *testing.T) {
+	stream := &Stream{Filter: map[string]string{"user_id": "jwt.user_id", "status": "params.status"}}
+	values, ok := stream.Values(map[string]interface{}{
+		"params": map[string]interface{}{},
+		"jwt":    map[string]interface{}{"user_id": float64(7)},
+	})
+	if !ok || len(values) != 1 || values["user_id"] != float64(7) {
+		t.Errorf("Expected to filter by user_id only, but got %v, %v", values, ok)
+	}
+	_, ok = stream.Values(map[string]interface{}{"params": map[string]interface{}{"status": "new"}})
+	if ok {
+		t.Error("Expected missing jwt claim to deny subscription")
+	}
+}
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker()
+	all, _ := broker.Subscribe("orders", nil, 0)
+	own, _ := broker.Subscribe("orders", map[string]interface{}{"user_id": float64(7)}, 0)
+	broker.Publish("orders", `{"id": 1, "user_id": 7}`)
+	broker.Publish("orders", `{"id": 2, "user_id": 8}`)
+	broker.Publish("products", `{"id": 3}`)
+	if len(all.Events) != 2 {
+		t.Errorf("Expected to get 2 events, but got %v", len(all.Events))
+	}
+	if len(own.Events) != 1 {
+		t.Fatalf("Expected to get 1 filtered event, but got %v", len(own.Events))
+	}
+	first := <-own.Events
+	if first.Data != `{"id": 1, "user_id": 7}` {
+		t.Errorf("Unexpected event data: %v", first.Data)
+	}
+	_, missed := broker.Subscribe("orders", nil, first.Id)
+	if len(missed) != 1 || missed[0].Data != `{"id": 2, "user_id": 8}` {
+		t.Errorf("Expected to get 1 missed event, but got %v", missed)
+	}
+	broker.Unsubscribe("orders", all)
+	broker.Publish("orders", `{"id": 4, "user_id": 7}`)
+	if len(all.Events) != 2 {
+		t.Errorf("Expected unsubscribed client not to get events, but got %v", len(all.Events))
+	}
+}
+
+func streamServer(broker *Broker, route *Route) *httptest.Server {
+	api := &Api{Plugins: make(map[string]Plugin)}
+	router := httprouter.New()
+	router.GET(route.Path, streamHandler(api, route, broker))
+	return httptest.NewServer(router)
+}
+
+func waitForSubscriber(broker *Broker, channel string) {
+	for i := 0; i < 100; i++ {
+		broker.lock.Lock()
+		count := len(broker.subscribers[channel])
+		broker.lock.Unlock()
+		if count > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	broker := NewBroker()
+	route, _ := ParseRoute([]byte("stream /changes, name: 'changes', heartbeat: '50ms', filter: 'kind=params.kind'"))
+	server := streamServer(broker, route)
+	defer server.Close()
+	broker.Publish("changes", `{"kind": "a", "n": 1}`)
+	lastId := broker.lastId
+	broker.Publish("changes", `{"kind": "a", "n": 2}`)
+	request, _ := http.NewRequest("GET", server.URL+"/changes?kind=a", nil)
+	request.Header.Set("Last-Event-ID", strconv.FormatInt(lastId, 10))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected to get event stream, but got %v", response.Header.Get("Content-Type"))
+	}
+	waitForSubscriber(broker, "changes")
+	broker.Publish("changes", `{"kind": "b", "n": 3}`)
+	broker.Publish("changes", `{"kind": "a", "n": 4}`)
+	reader := bufio.NewReader(response.Body)
+	expected := []string{
+		"id: " + strconv.FormatInt(lastId+1, 10), `data: {"kind": "a", "n": 2}`, "",
+		"id: " + strconv.FormatInt(lastId+3, 10), `data: {"kind": "a", "n": 4}`, "",
+		": heartbeat",
+	}
+	for _, line := range expected {
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if strings.TrimRight(got, "\n") != line {
+			t.Errorf("Expected to get '%v' line, but got '%v'", line, strings.TrimRight(got, "\n"))
+		}
+	}
+}
+
+func TestWebSocketStream(t *testing.T) {
+	broker := NewBroker()
+	route, _ := ParseRoute([]byte("stream /changes, name: 'changes'"))
+	server := streamServer(broker, route)
+	defer server.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /changes HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected to get 101 status code, but got %v", response.StatusCode)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept header: %v", response.Header.Get("Sec-WebSocket-Accept"))
+	}
+	waitForSubscriber(broker, "changes")
+	broker.Publish("changes", `{"n":1}`)
+	opcode, payload, err := readFrame(reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := `{"id":"` + strconv.FormatInt(broker.lastId, 10) + `","data":{"n":1}}`
+	if opcode != opText || string(payload) != expected {
+		t.Errorf("Expected to get %v text message, but got %v %s", expected, opcode, payload)
+	}
+	// Client frames are masked.
+	frame := encodeFrame(opPing, nil)
+	frame[1] |= 0x80
+	conn.Write(append(frame, 1, 2, 3, 4))
+	opcode, _, err = readFrame(reader)
+	if err != nil || opcode != opPong {
+		t.Errorf("Expected to get pong, but got %v, %v", opcode, err)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	r := httptest.NewRequest("GET", "/changes", nil)
+	r.Host = "api.example.com"
+	header := make(http.Header)
+	for origin, allowed := range map[string]bool{
+		"":                          true,
+		"https://api.example.com":   true,
+		"https://evil.example.com":  false,
+		"https://app.example.com":   true,
+		"https://other.example.com": false,
+	} {
+		r.Header.Set("Origin", origin)
+		header.Set("Access-Control-Allow-Origin", "")
+		if origin == "https://app.example.com" {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if allowedOrigin(r, header) != allowed {
+			t.Errorf("Expected origin %q allowed to be %v", origin, allowed)
+		}
+	}
+	header.Set("Access-Control-Allow-Origin", "*")
+	r.Header.Set("Origin", "https://evil.example.com")
+	if !allowedOrigin(r, header) {
+		t.Errorf("Expected any origin to be allowed with wildcard cors policy")
+	}
+	w := httptest.NewRecorder()
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if _, err := acceptWebSocket(w, r); err == nil || w.Code != http.StatusForbidden {
+		t.Errorf("Expected cross-site handshake to be rejected, but got %v %v", w.Code, err)
+	}
+}
@@ -0,0 +1 @@
+delete from sessions where expires_at < now() returning id
@@ -0,0 +1 @@
+insert into hourly_stats (hour, orders) select date_trunc('hour', {{quote .task.scheduled_at}}::timestamptz), count(*) from orders
@@ -0,0 +1 @@
+update orders set receipt_sent_at = now() where id = {{.params.id}} returning id
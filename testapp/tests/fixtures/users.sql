@@ -0,0 +1 @@
+insert into users (name, email) values ('Ann', 'ann@example.com');
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gophergala2016/dbserver/plugins"
+	"github.com/gophergala2016/dbserver/plugins/jwt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type TestFile struct {
+	Path     string `toml:"-"`
+	Fixtures []string
+	Cases    []*TestCase `toml:"case"`
+}
+
+type TestCase struct {
+	Name     string
+	Route    string
+	Version  int
+	Params   map[string]interface{}
+	Headers  map[string]string
+	Jwt      map[string]interface{}
+	Fixtures []string
+	Status   int
+	Expect   string
+	Golden   string
+	file     *TestFile
+}
+
+func (self *TestCase) String() string {
+	return filepath.Base(self.file.Path) + ": " + self.Name
+}
+
+// ParseTestFiles reads test cases from tests/*.toml. Fixtures and golden
+// files are relative to tests folder.
+func ParseTestFiles(path string) ([]*TestFile, error) {
+	names, err := filepath.Glob(filepath.Join(path, "tests", "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	files := make([]*TestFile, 0, len(names))
+	for _, name := range names {
+		file := &TestFile{Path: name}
+		_, err = toml.DecodeFile(name, file)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		for i, testCase := range file.Cases {
+			testCase.file = file
+			if testCase.Name == "" {
+				testCase.Name = fmt.Sprintf("case %v", i+1)
+			}
+			if testCase.Route == "" {
+				return nil, fmt.Errorf("%v: route is missing", testCase)
+			}
+			if testCase.Status == 0 {
+				testCase.Status = http.StatusOK
+			}
+			if testCase.Expect != "" && !json.Valid([]byte(testCase.Expect)) {
+				return nil, fmt.Errorf("%v: expect is not valid json", testCase)
+			}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+type TestResult struct {
+	Case     *TestCase
+	Status   int
+	Body     string
+	Failures []string
+}
+
+func (self *TestResult) fail(format string, args ...interface{}) {
+	self.Failures = append(self.Failures, fmt.Sprintf(format, args...))
+}
+
+func (self *TestCase) request(api *Api, route *Route) (*http.Request, error) {
+	r, err := http.NewRequest(route.HttpMethod(), route.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.RemoteAddr = "127.0.0.1:0"
+	for name, value := range self.Headers {
+		r.Header.Set(name, value)
+	}
+	if self.Jwt != nil {
+		plugin, ok := api.Plugins["jwt"].(*jwt.JWT)
+		if !ok {
+			return nil, errors.New("jwt claims are set, but jwt plugin is not configured")
+		}
+		claims := make(map[string]interface{})
+		for key, value := range self.Jwt {
+			claims[key] = value
+		}
+		if _, ok := claims["exp"]; !ok {
+			claims["exp"] = time.Now().Add(time.Hour).Unix()
+		}
+		token, err := plugin.GenerateToken(claims)
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set("Authorization", "Bearer "+string(token))
+	}
+	return r, nil
+}
+
+func (self *TestCase) params() (map[string]interface{}, error) {
+	// Round trip through json, so that params look like decoded request body.
+	content, err := json.Marshal(self.Params)
+	if err != nil {
+		return nil, err
+	}
+	params := make(map[string]interface{})
+	err = json.Unmarshal(content, &params)
+	return params, err
+}
+
+func runFixture(tx *sql.Tx, name string) error {
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(string(content))
+	if err != nil {
+		return fmt.Errorf("fixture %v: %v", name, err)
+	}
+	return nil
+}
+
+// execute runs fixtures, route hooks and sql in transaction that is always
+// rolled back, so cases don't see each other's changes. Plugins run their
+// queries in the same transaction, so e.g. API keys can come from fixtures.
+func (self *TestCase) execute(db *sql.DB, api *Api, r *http.Request, item *BatchItem, version int) (*BatchResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	dir := filepath.Dir(self.file.Path)
+	for _, fixture := range append(append([]string{}, self.file.Fixtures...), self.Fixtures...) {
+		err = runFixture(tx, filepath.Join(dir, fixture))
+		if err != nil {
+			return nil, err
+		}
+	}
+	r = r.WithContext(plugins.WithTx(r.Context(), tx))
+	header := http.Header{}
+	result := prepareBatchItem(api, newBatchHooks(api, r, header), item, version, r, header)
+	if result.Status != 0 {
+		return result, nil
+	}
+	sessions, err := getSessions(api, result.data)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		err = applySession(tx, session)
+		if err != nil {
+			return nil, err
+		}
+	}
+	value, found, err := queryJson(tx, result.sql)
+	if err != nil {
+		return nil, err
+	}
+	result.setValue(value, found)
+	if result.Status == http.StatusOK {
+		result.Body = batchBody(result.value)
+	}
+	return result, nil
+}
+
+// RunTestCase runs route of test case the same way as batch item, but
+// response plugins are not run: body is result of sql query.
+func RunTestCase(db *sql.DB, api *Api, testCase *TestCase, update bool) *TestResult {
+	result := &TestResult{Case: testCase}
+	route := api.GetRoute(testCase.Route)
+	if route == nil {
+		result.fail("unknown route %v", testCase.Route)
+		return result
+	}
+	r, err := testCase.request(api, route)
+	if err == nil {
+		var params map[string]interface{}
+		params, err = testCase.params()
+		if err == nil {
+			version := testCase.Version
+			if version == 0 {
+				version = api.Version
+			}
+			var batchResult *BatchResult
+			batchResult, err = testCase.execute(db, api, r, &BatchItem{Route: testCase.Route, Params: params}, version)
+			if err == nil {
+				result.Status, result.Body = batchResult.Status, string(batchResult.Body)
+			}
+		}
+	}
+	if err != nil {
+		result.Status = http.StatusInternalServerError
+		result.Body = err.Error()
+	}
+	if result.Status != testCase.Status {
+		result.fail("status: expected %v, got %v\n%v", testCase.Status, result.Status, result.Body)
+		return result
+	}
+	if testCase.Expect != "" {
+		var expected, actual interface{}
+		json.Unmarshal([]byte(testCase.Expect), &expected)
+		err = json.Unmarshal([]byte(result.Body), &actual)
+		if err != nil {
+			result.fail("response is not json: %v", result.Body)
+			return result
+		}
+		for _, failure := range matchJson("$", expected, actual) {
+			result.fail("%v", failure)
+		}
+	}
+	if testCase.Golden != "" {
+		compareGolden(result, filepath.Join(filepath.Dir(testCase.file.Path), testCase.Golden), update)
+	}
+	return result
+}
+
+func indentJson(value string) (string, error) {
+	var decoded interface{}
+	err := json.Unmarshal([]byte(value), &decoded)
+	if err != nil {
+		return "", err
+	}
+	content, err := json.MarshalIndent(decoded, "", "  ")
+	return string(content) + "\n", err
+}
+
+func compareGolden(result *TestResult, name string, update bool) {
+	actual, err := indentJson(result.Body)
+	if err != nil {
+		result.fail("response is not json: %v", result.Body)
+		return
+	}
+	if update {
+		err = ioutil.WriteFile(name, []byte(actual), 0644)
+		if err != nil {
+			result.fail("%v", err)
+		}
+		return
+	}
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		result.fail("%v (run with -update to create it)", err)
+		return
+	}
+	expected, err := indentJson(string(content))
+	if err != nil {
+		result.fail("golden file %v is not json", name)
+		return
+	}
+	if expected != actual {
+		result.fail("response differs from %v:\n%v", name, diffLines(expected, actual))
+	}
+}
+
+// matchJson compares expected value with actual one. Objects match if
+// actual has every expected key, arrays need to have the same length.
+func matchJson(path string, expected interface{}, actual interface{}) []string {
+	failures := make([]string, 0)
+	switch expected := expected.(type) {
+	case map[string]interface{}:
+		actual, ok := actual.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, key := range sortedKeys(expected) {
+			value, ok := actual[key]
+			if !ok {
+				failures = append(failures, fmt.Sprintf("%v.%v: missing", path, key))
+				continue
+			}
+			failures = append(failures, matchJson(path+"."+key, expected[key], value)...)
+		}
+		return failures
+	case []interface{}:
+		actual, ok := actual.([]interface{})
+		if !ok {
+			break
+		}
+		if len(actual) != len(expected) {
+			return append(failures, fmt.Sprintf("%v: expected %v items, got %v", path, len(expected), len(actual)))
+		}
+		for i := range expected {
+			failures = append(failures, matchJson(fmt.Sprintf("%v[%v]", path, i), expected[i], actual[i])...)
+		}
+		return failures
+	default:
+		if expected == actual {
+			return failures
+		}
+	}
+	expectedJson, _ := json.Marshal(expected)
+	actualJson, _ := json.Marshal(actual)
+	return append(failures, fmt.Sprintf("%v: expected %s, got %s", path, expectedJson, actualJson))
+}
+
+// diffLines returns line diff of two texts, removed lines are prefixed with
+// "-" and added ones with "+".
+func diffLines(a string, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var buffer bytes.Buffer
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			buffer.WriteString("  " + x[i] + "\n")
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			buffer.WriteString("- " + x[i] + "\n")
+			i++
+		default:
+			buffer.WriteString("+ " + y[j] + "\n")
+			j++
+		}
+	}
+	return buffer.String()
+}
+
+func testCommand(args []string) error {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	run := flags.String("run", "", "run only cases whose file or name contains this text")
+	update := flags.Bool("update", false, "write responses to golden files")
+	flags.Parse(args)
+	api, err := loadApi()
+	if err != nil {
+		return err
+	}
+	files, err := ParseTestFiles(".")
+	if err != nil {
+		return err
+	}
+	// Plugins don't get the connection, that would start webhook workers,
+	// their queries run in transaction of every case instead.
+	db, err := GetDbConnection()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	passed, failed := 0, 0
+	for _, file := range files {
+		for _, testCase := range file.Cases {
+			if !strings.Contains(testCase.String(), *run) {
+				continue
+			}
+			result := RunTestCase(db, api, testCase, *update)
+			if len(result.Failures) == 0 {
+				passed++
+				fmt.Printf("PASS %v\n", testCase)
+				continue
+			}
+			failed++
+			fmt.Printf("FAIL %v\n", testCase)
+			for _, failure := range result.Failures {
+				fmt.Println("    " + strings.Replace(failure, "\n", "\n    ", -1))
+			}
+		}
+	}
+	fmt.Printf("%v passed, %v failed\n", passed, failed)
+	if failed > 0 {
+		return errors.New("tests failed")
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/gophergala2016/dbserver/plugins/apikey"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTestFiles(t *testing.T) {
+	files, err := ParseTestFiles("testapp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(files) != 1 || len(files[0].Cases) != 3 {
+		t.Fatalf("Expected to get 1 file with 3 cases, but got %v", files)
+	}
+	if !reflect.DeepEqual(files[0].Fixtures, []string{"fixtures/users.sql"}) {
+		t.Errorf("Unexpected fixtures: %v", files[0].Fixtures)
+	}
+	testCase := files[0].Cases[1]
+	if testCase.String() != "users.toml: creates user" || testCase.Status != 200 || testCase.Params["name"] != "John" {
+		t.Errorf("Unexpected case: %+v", testCase)
+	}
+	if files[0].Cases[2].Status != 400 {
+		t.Errorf("Expected status to be 400, but got %v", files[0].Cases[2].Status)
+	}
+}
+
+func TestRunTestCaseValidation(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ParseTestFiles("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(&fakeConnector{})
+	defer db.Close()
+	// Invalid params never reach route sql.
+	result := RunTestCase(db, api, files[0].Cases[2], false)
+	if len(result.Failures) != 0 {
+		t.Errorf("Expected case to pass, but got %v", result.Failures)
+	}
+	testCase := *files[0].Cases[2]
+	testCase.Status = 201
+	result = RunTestCase(db, api, &testCase, false)
+	if len(result.Failures) != 1 || !strings.HasPrefix(result.Failures[0], "status: expected 201, got 400") {
+		t.Errorf("Unexpected failures: %v", result.Failures)
+	}
+	testCase.Route = "missing"
+	result = RunTestCase(nil, api, &testCase, false)
+	if len(result.Failures) != 1 || result.Failures[0] != "unknown route missing" {
+		t.Errorf("Unexpected failures: %v", result.Failures)
+	}
+	testCase.Route = "create_user"
+	testCase.Jwt = map[string]interface{}{"user_id": 1}
+	result = RunTestCase(nil, api, &testCase, false)
+	if result.Status != 500 || !strings.Contains(result.Body, "jwt plugin is not configured") {
+		t.Errorf("Expected jwt claims to fail without jwt plugin, but got %v %v", result.Status, result.Body)
+	}
+}
+
+// fakeConnector opens connections that record queries and return api key
+// row only after fixture was executed in the same transaction. Tables
+// don't exist, other queries return empty json array.
+type fakeConnector struct {
+	queries []string
+	commits int
+}
+
+func (self *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{connector: self}, nil
+}
+
+func (self *fakeConnector) Driver() driver.Driver {
+	return nil
+}
+
+type fakeConn struct {
+	connector *fakeConnector
+	fixture   bool
+}
+
+func (self *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	self.connector.queries = append(self.connector.queries, query)
+	return &fakeStmt{conn: self, query: query}, nil
+}
+
+func (self *fakeConn) Close() error {
+	return nil
+}
+
+func (self *fakeConn) Begin() (driver.Tx, error) {
+	return self, nil
+}
+
+func (self *fakeConn) Commit() error {
+	self.connector.commits++
+	return nil
+}
+
+func (self *fakeConn) Rollback() error {
+	self.fixture = false
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (self *fakeStmt) Close() error {
+	return nil
+}
+
+func (self *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (self *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	self.conn.fixture = true
+	return driver.RowsAffected(1), nil
+}
+
+func (self *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if strings.Contains(self.query, "api_keys") {
+		rows := &fakeRows{columns: []string{"owner", "scopes", "expires_at"}}
+		if self.conn.fixture && args[0] == apikey.HashKey("secret") {
+			rows.values = [][]driver.Value{{"partner", []byte("{users:read}"), nil}}
+		}
+		return rows, nil
+	}
+	if strings.Contains(self.query, "to_regclass") {
+		return &fakeRows{columns: []string{"to_regclass"}, values: [][]driver.Value{{nil}}}, nil
+	}
+	return &fakeRows{columns: []string{"json"}, values: [][]driver.Value{{[]byte("[]")}}}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (self *fakeRows) Columns() []string {
+	return self.columns
+}
+
+func (self *fakeRows) Close() error {
+	return nil
+}
+
+func (self *fakeRows) Next(dest []driver.Value) error {
+	if len(self.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, self.values[0])
+	self.values = self.values[1:]
+	return nil
+}
+
+func TestRunTestCaseApiKey(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.AddPlugin("apikey", &apikey.ApiKey{
+		Header:        "X-Api-Key",
+		Table:         "api_keys",
+		HashColumn:    "key_hash",
+		OwnerColumn:   "owner",
+		ScopesColumn:  "scopes",
+		ExpiresColumn: "expires_at",
+	})
+	files, err := ParseTestFiles("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sql.OpenDB(&fakeConnector{})
+	defer db.Close()
+	testCase := *files[0].Cases[0]
+	testCase.Golden = ""
+	testCase.Headers = map[string]string{"X-Api-Key": "secret"}
+	// Key is only visible in transaction where fixture was executed.
+	result := RunTestCase(db, api, &testCase, false)
+	if len(result.Failures) != 0 {
+		t.Errorf("Expected case to pass, but got %v", result.Failures)
+	}
+	testCase.Headers["X-Api-Key"] = "unknown"
+	testCase.Status = 401
+	result = RunTestCase(db, api, &testCase, false)
+	if len(result.Failures) != 0 {
+		t.Errorf("Expected case to pass, but got %v", result.Failures)
+	}
+}
+
+func TestMatchJson(t *testing.T) {
+	actual := map[string]interface{}{
+		"id":   1.0,
+		"name": "Pen",
+		"tags": []interface{}{"a", "b"},
+		"shop": map[string]interface{}{"name": "Corner"},
+	}
+	failures := matchJson("$", map[string]interface{}{"name": "Pen", "shop": map[string]interface{}{}}, actual)
+	if len(failures) != 0 {
+		t.Errorf("Expected partial match, but got %v", failures)
+	}
+	expected := map[string]interface{}{
+		"id":    2.0,
+		"price": 5.0,
+		"tags":  []interface{}{"a"},
+		"shop":  map[string]interface{}{"name": "Market"},
+	}
+	failures = matchJson("$", expected, actual)
+	if !reflect.DeepEqual(failures, []string{
+		"$.id: expected 2, got 1",
+		"$.price: missing",
+		`$.shop.name: expected "Market", got "Corner"`,
+		"$.tags: expected 1 items, got 2",
+	}) {
+		t.Errorf("Unexpected failures: %v", failures)
+	}
+	failures = matchJson("$", []interface{}{1.0}, actual)
+	if len(failures) != 1 || !strings.HasPrefix(failures[0], "$: expected [1], got {") {
+		t.Errorf("Unexpected failures: %v", failures)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	diff := diffLines("[\n  1,\n  2\n]\n", "[\n  1,\n  3\n]\n")
+	if diff != "  [\n    1,\n-   2\n+   3\n  ]\n" {
+		t.Errorf("Unexpected diff:\n%v", diff)
+	}
+}
+
+func TestCompareGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "get_users.json")
+	result := &TestResult{Body: `[{"name":"Ann"}]`}
+	compareGolden(result, name, false)
+	if len(result.Failures) != 1 || !strings.Contains(result.Failures[0], "run with -update") {
+		t.Errorf("Expected missing golden file to fail, but got %v", result.Failures)
+	}
+	result = &TestResult{Body: `[{"name":"Ann"}]`}
+	compareGolden(result, name, true)
+	compareGolden(result, name, false)
+	if len(result.Failures) != 0 {
+		t.Errorf("Expected response to match golden file, but got %v", result.Failures)
+	}
+	result = &TestResult{Body: `[{"name":"Bob"}]`}
+	compareGolden(result, name, false)
+	if len(result.Failures) != 1 || !strings.Contains(result.Failures[0], "-     \"name\": \"Ann\"\n+     \"name\": \"Bob\"") {
+		t.Errorf("Unexpected failures: %v", result.Failures)
+	}
+}
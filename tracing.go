@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gophergala2016/dbserver/plugins"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceparentHeader  = "traceparent"
+	traceparentSetting = "dbservice.traceparent"
+)
+
+// Span kinds as defined by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// tracer is nil when tracing is disabled, spans are nil then too.
+var tracer *Tracer
+
+var droppedSpans = plugins.NewCounter("dbservice_tracing_dropped_spans_total",
+	"Spans dropped because export queue was full.")
+
+// SpanContext identifies span across services (W3C trace context).
+type SpanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Flags   byte
+}
+
+func (self SpanContext) Sampled() bool {
+	return self.Flags&1 == 1
+}
+
+func (self SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-%02x", self.TraceId, self.SpanId, self.Flags)
+}
+
+// ParseTraceparent parses traceparent header. Fields after flags are
+// ignored for future versions.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var spanContext SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return spanContext, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return spanContext, false
+	}
+	for _, part := range parts[:4] {
+		if part != strings.ToLower(part) {
+			return spanContext, false
+		}
+		if _, err := hex.DecodeString(part); err != nil {
+			return spanContext, false
+		}
+	}
+	hex.Decode(spanContext.TraceId[:], []byte(parts[1]))
+	hex.Decode(spanContext.SpanId[:], []byte(parts[2]))
+	flags, _ := hex.DecodeString(parts[3])
+	spanContext.Flags = flags[0]
+	if spanContext.TraceId == [16]byte{} || spanContext.SpanId == [8]byte{} {
+		return spanContext, false
+	}
+	return spanContext, true
+}
+
+type Span struct {
+	Name       string
+	Kind       int
+	Context    SpanContext
+	ParentId   [8]byte
+	Start      time.Time
+	Finish     time.Time
+	Attributes map[string]interface{}
+	Error      string
+	tracer     *Tracer
+}
+
+func (self *Span) SetAttribute(name string, value interface{}) {
+	if self == nil {
+		return
+	}
+	self.Attributes[name] = value
+}
+
+func (self *Span) SetError(err error) {
+	if self == nil || err == nil {
+		return
+	}
+	self.Error = err.Error()
+}
+
+// End finishes span and queues it for export if it's sampled.
+func (self *Span) End() {
+	if self == nil || !self.Finish.IsZero() {
+		return
+	}
+	self.Finish = time.Now()
+	if self.Context.Sampled() {
+		self.tracer.enqueue(self)
+	}
+}
+
+type spanKey struct{}
+
+func spanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// startSpan starts child of span in context. Spans are only recorded inside
+// of traced requests, so nil is returned if there is no parent.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := spanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, kind, parent.Context, true)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// startRequestSpan starts server span, incoming traceparent header is used
+// as parent. Version is the one from path.
+func startRequestSpan(r *http.Request, route *Route, version int) (*http.Request, *Span) {
+	if tracer == nil {
+		return r, nil
+	}
+	path := route.Path
+	if version > 0 {
+		path = "/v" + strconv.Itoa(version) + path
+	}
+	parent, ok := ParseTraceparent(r.Header.Get(traceparentHeader))
+	span := tracer.newSpan(r.Method+" "+path, spanKindServer, parent, ok)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("http.route", path)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("dbservice.route", route.Name)
+	return r.WithContext(context.WithValue(r.Context(), spanKey{}, span)), span
+}
+
+func endRequestSpan(span *Span, version int, recorder *statusRecorder) {
+	if span == nil {
+		return
+	}
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttribute("http.response.status_code", status)
+	if version != 0 {
+		span.SetAttribute("dbservice.api_version", version)
+	}
+	if status >= 500 {
+		span.Error = http.StatusText(status)
+	}
+	span.End()
+}
+
+// endPluginSpan records plugin response that stopped request.
+func endPluginSpan(span *Span, response *plugins.Response) {
+	if span == nil || response == nil || response.ResponseCode == 0 {
+		span.End()
+		return
+	}
+	span.SetAttribute("http.response.status_code", response.ResponseCode)
+	if response.ResponseCode >= 500 {
+		span.Error = http.StatusText(response.ResponseCode)
+	}
+	span.End()
+}
+
+var (
+	sqlDollarTagRegexp = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z0-9_]*)?\$`)
+	sqlNumberRegexp    = regexp.MustCompile(`(^|[^\w$."])\d+(?:\.\d+)?\b`)
+)
+
+// sanitizeSql replaces string and number literals with "?", so that params
+// don't end up in traces.
+func sanitizeSql(query string) string {
+	var out strings.Builder
+	for i := 0; i < len(query); {
+		if end := sqlLiteralEnd(query, i); end > i {
+			out.WriteString("?")
+			i = end
+			continue
+		}
+		out.WriteByte(query[i])
+		i++
+	}
+	return sqlNumberRegexp.ReplaceAllString(out.String(), "${1}?")
+}
+
+// sqlLiteralEnd returns end of string literal ('...', E'...' with backslash
+// escapes or $tag$...$tag$) that starts at i, or i if there is none.
+// Unterminated literal lasts until the end of query.
+func sqlLiteralEnd(query string, i int) int {
+	escapes := false
+	switch {
+	case query[i] == '$':
+		tag := sqlDollarTagRegexp.FindString(query[i:])
+		if tag == "" {
+			return i
+		}
+		end := strings.Index(query[i+len(tag):], tag)
+		if end == -1 {
+			return len(query)
+		}
+		return i + len(tag) + end + len(tag)
+	case (query[i] == 'E' || query[i] == 'e') && i+1 < len(query) && query[i+1] == '\'' &&
+		(i == 0 || !isWordByte(query[i-1])):
+		escapes = true
+		i++
+	case query[i] != '\'':
+		return i
+	}
+	for j := i + 1; j < len(query); j++ {
+		switch {
+		case escapes && query[j] == '\\':
+			j++
+		case query[j] == '\'' && j+1 < len(query) && query[j+1] == '\'':
+			j++
+		case query[j] == '\'':
+			return j + 1
+		}
+	}
+	return len(query)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// traceSql records query in span and propagates trace context into postgres,
+// both as comment (visible in pg_stat_activity and logs) and as
+// dbservice.traceparent setting.
+func traceSql(span *Span, query string, sessions []*plugins.Session) (string, []*plugins.Session) {
+	if span == nil {
+		return query, sessions
+	}
+	span.SetAttribute("db.system", "postgresql")
+	span.SetAttribute("db.statement", sanitizeSql(query))
+	traceparent := span.Context.Traceparent()
+	session := &plugins.Session{Settings: map[string]string{traceparentSetting: traceparent}}
+	return "/*traceparent='" + traceparent + "'*/ " + query, append(sessions[:len(sessions):len(sessions)], session)
+}
+
+// SpanExporter receives batches of spans encoded as OTLP JSON.
+type SpanExporter interface {
+	Export(payload []byte) error
+}
+
+// OtlpExporter sends spans to OTLP/HTTP collector.
+type OtlpExporter struct {
+	Endpoint string
+	Headers  map[string]string
+	client   *http.Client
+}
+
+func (self *OtlpExporter) Export(payload []byte) error {
+	request, err := http.NewRequest("POST", strings.TrimSuffix(self.Endpoint, "/")+"/v1/traces", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range self.Headers {
+		request.Header.Set(name, value)
+	}
+	response, err := self.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("OTLP collector responded with %v", response.Status)
+	}
+	return nil
+}
+
+// WriterExporter writes every batch as single line, it's used for stdout
+// and file exporters.
+type WriterExporter struct {
+	Writer io.Writer
+	mutex  sync.Mutex
+}
+
+func (self *WriterExporter) Export(payload []byte) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	_, err := self.Writer.Write(append(payload, '\n'))
+	return err
+}
+
+type Tracer struct {
+	ServiceName string
+	Exporter    SpanExporter
+	BatchSize   int
+	Interval    time.Duration
+	spans       chan *Span
+	stop        chan chan struct{}
+}
+
+func NewTracer(config TracingConfig) (*Tracer, error) {
+	var exporter SpanExporter
+	switch config.Exporter {
+	case "otlp":
+		exporter = &OtlpExporter{Endpoint: config.Endpoint, Headers: config.Headers, client: &http.Client{Timeout: 10 * time.Second}}
+	case "stdout":
+		exporter = &WriterExporter{Writer: os.Stdout}
+	case "file":
+		if config.File == "" {
+			return nil, errors.New("Tracing file exporter requires file")
+		}
+		file, err := os.OpenFile(config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporter = &WriterExporter{Writer: file}
+	default:
+		return nil, fmt.Errorf("Unknown tracing exporter: %v", config.Exporter)
+	}
+	return &Tracer{
+		ServiceName: config.ServiceName,
+		Exporter:    exporter,
+		BatchSize:   512,
+		Interval:    5 * time.Second,
+		spans:       make(chan *Span, 2048),
+		stop:        make(chan chan struct{}),
+	}, nil
+}
+
+func (self *Tracer) newSpan(name string, kind int, parent SpanContext, hasParent bool) *Span {
+	span := &Span{Name: name, Kind: kind, Start: time.Now(), Attributes: make(map[string]interface{}), tracer: self}
+	if hasParent {
+		span.Context.TraceId = parent.TraceId
+		span.Context.Flags = parent.Flags
+		span.ParentId = parent.SpanId
+	} else {
+		rand.Read(span.Context.TraceId[:])
+		span.Context.Flags = 1
+	}
+	rand.Read(span.Context.SpanId[:])
+	return span
+}
+
+// enqueue never blocks request, spans are dropped if exporter can't keep up.
+func (self *Tracer) enqueue(span *Span) {
+	select {
+	case self.spans <- span:
+	default:
+		droppedSpans.Inc()
+	}
+}
+
+// Start exports spans in batches, when batch is full or interval passes.
+func (self *Tracer) Start() {
+	go func() {
+		ticker := time.NewTicker(self.Interval)
+		defer ticker.Stop()
+		batch := make([]*Span, 0, self.BatchSize)
+		for {
+			select {
+			case span := <-self.spans:
+				batch = append(batch, span)
+				if len(batch) < self.BatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			case done := <-self.stop:
+				if len(batch) > 0 {
+					self.export(batch)
+				}
+				self.flush()
+				close(done)
+				return
+			}
+			self.export(batch)
+			batch = batch[:0]
+		}
+	}()
+}
+
+// Stop exports pending spans and stops exporting loop, it's called on shutdown.
+func (self *Tracer) Stop() {
+	if self == nil {
+		return
+	}
+	done := make(chan struct{})
+	self.stop <- done
+	<-done
+}
+
+// flush exports queued spans synchronously.
+func (self *Tracer) flush() {
+	batch := make([]*Span, 0)
+	for {
+		select {
+		case span := <-self.spans:
+			batch = append(batch, span)
+		default:
+			if len(batch) > 0 {
+				self.export(batch)
+			}
+			return
+		}
+	}
+}
+
+func (self *Tracer) export(spans []*Span) {
+	payload, err := json.Marshal(self.otlp(spans))
+	if err == nil {
+		err = self.Exporter.Export(payload)
+	}
+	if err != nil {
+		log.Printf("Exporting %v spans failed: %v\n", len(spans), err)
+	}
+}
+
+// otlp builds OTLP JSON (ExportTraceServiceRequest) document.
+func (self *Tracer) otlp(spans []*Span) map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		value := map[string]interface{}{
+			"traceId":           hex.EncodeToString(span.Context.TraceId[:]),
+			"spanId":            hex.EncodeToString(span.Context.SpanId[:]),
+			"name":              span.Name,
+			"kind":              span.Kind,
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.Finish.UnixNano(), 10),
+			"attributes":        otlpAttributes(span.Attributes),
+			"status":            map[string]interface{}{},
+		}
+		if span.ParentId != [8]byte{} {
+			value["parentSpanId"] = hex.EncodeToString(span.ParentId[:])
+		}
+		if span.Error != "" {
+			value["status"] = map[string]interface{}{"code": 2, "message": span.Error}
+		}
+		encoded = append(encoded, value)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": self.ServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "dbservice"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	encoded := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		var value map[string]interface{}
+		switch v := attributes[name].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": name, "value": value})
+	}
+	return encoded
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	spanContext, ok := ParseTraceparent(value)
+	if !ok || !spanContext.Sampled() || spanContext.Traceparent() != value {
+		t.Fatalf("Unexpected span context: %+v", spanContext)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-xbf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra"); !ok {
+		t.Errorf("Expected future version to be parsed")
+	}
+}
+
+func TestSanitizeSql(t *testing.T) {
+	for query, expected := range map[string]string{
+		`select * from users where name = 'O''Brien' and id in (1, 25) and price > 1.5 and "table2".x = $1 limit 10`: `select * from users where name = ? and id in (?, ?) and price > ? and "table2".x = $1 limit ?`,
+		`select E'it\'s 42', e'a\\' from type where note = 'x'`:                                                      `select ?, ? from type where note = ?`,
+		`select $$it's 42$$, $body$a $$ b$body$, $1`:                                                                 `select ?, ?, $1`,
+		`select 'unterminated 42`:                                                                                    `select ?`,
+	} {
+		if sanitized := sanitizeSql(query); sanitized != expected {
+			t.Errorf("Expected %v, but got %v", expected, sanitized)
+		}
+	}
+}
+
+func TestTraceSql(t *testing.T) {
+	tracer := &Tracer{spans: make(chan *Span, 10)}
+	parent := tracer.newSpan("request", spanKindServer, SpanContext{}, false)
+	ctx := context.WithValue(context.Background(), spanKey{}, parent)
+	_, span := startSpan(ctx, "db.query", spanKindClient)
+	query, sessions := traceSql(span, "select 1", nil)
+	traceparent := span.Context.Traceparent()
+	if query != "/*traceparent='"+traceparent+"'*/ select 1" {
+		t.Errorf("Unexpected query: %v", query)
+	}
+	if len(sessions) != 1 || sessions[0].Settings[traceparentSetting] != traceparent {
+		t.Errorf("Unexpected sessions: %+v", sessions)
+	}
+	if span.Context.TraceId != parent.Context.TraceId || span.ParentId != parent.Context.SpanId {
+		t.Errorf("Expected span to be child of request span")
+	}
+	if span.Attributes["db.statement"] != "select ?" {
+		t.Errorf("Unexpected statement: %v", span.Attributes["db.statement"])
+	}
+	if _, span := startSpan(context.Background(), "db.query", spanKindClient); span != nil {
+		t.Errorf("Expected no span without request span")
+	}
+}
+
+func TestRequestTrace(t *testing.T) {
+	api, err := ParseRoutes("testapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	tracer = &Tracer{ServiceName: "users", Exporter: &WriterExporter{Writer: &out}, spans: make(chan *Span, 100)}
+	defer func() {
+		tracer = nil
+	}()
+	r := httptest.NewRequest("POST", "/v5/users", strings.NewReader(`{"name": "John"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler(api, api.GetRoute("create_user"), 5)(w, r, httprouter.Params{})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, but got %v", w.Code)
+	}
+	tracer.flush()
+	var payload struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []map[string]interface{}
+			}
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceId      string
+					SpanId       string
+					ParentSpanId string
+					Name         string
+					Kind         int
+					Attributes   []struct {
+						Key   string
+						Value map[string]interface{}
+					}
+				}
+			}
+		}
+	}
+	err = json.Unmarshal(out.Bytes(), &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resource := payload.ResourceSpans[0].Resource.Attributes[0]
+	if resource["key"] != "service.name" || resource["value"].(map[string]interface{})["stringValue"] != "users" {
+		t.Errorf("Unexpected resource: %v", resource)
+	}
+	spans := payload.ResourceSpans[0].ScopeSpans[0].Spans
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+		if span.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Expected trace id to be propagated, but got %v", span.TraceId)
+		}
+	}
+	if strings.Join(names, ",") != "before_hooks,route_hooks,schema_validation,POST /v5/users" {
+		t.Fatalf("Unexpected spans: %v", names)
+	}
+	server := spans[3]
+	if server.Kind != spanKindServer || server.ParentSpanId != "00f067aa0ba902b7" || spans[2].ParentSpanId != server.SpanId {
+		t.Errorf("Unexpected span tree: %+v", spans)
+	}
+	for _, attribute := range server.Attributes {
+		if attribute.Key == "http.response.status_code" && attribute.Value["intValue"] != "400" {
+			t.Errorf("Unexpected status code: %v", attribute.Value)
+		}
+	}
+}
+
+func TestOtlpExporter(t *testing.T) {
+	var body []byte
+	var path, header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		header = r.Header.Get("Authorization")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	tracer, err := NewTracer(TracingConfig{Exporter: "otlp", Endpoint: server.URL + "/", Headers: map[string]string{"Authorization": "Bearer token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := tracer.newSpan("request", spanKindServer, SpanContext{}, false)
+	span.SetError(os.ErrNotExist)
+	span.End()
+	tracer.flush()
+	if path != "/v1/traces" || header != "Bearer token" {
+		t.Errorf("Unexpected request: %v %v", path, header)
+	}
+	if !strings.Contains(string(body), `"status":{"code":2,"message":"file does not exist"}`) {
+		t.Errorf("Unexpected body: %s", body)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "spans.json")
+	tracer, err := NewTracer(TracingConfig{Exporter: "file", File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		tracer.newSpan("request", spanKindServer, SpanContext{}, false).End()
+		tracer.flush()
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 2 || !json.Valid([]byte(lines[1])) {
+		t.Errorf("Unexpected file content: %s", content)
+	}
+	if _, err := NewTracer(TracingConfig{Exporter: "jaeger"}); err == nil {
+		t.Errorf("Expected unknown exporter to fail")
+	}
+}
+
+func TestTracerStop(t *testing.T) {
+	var buffer bytes.Buffer
+	tracer := &Tracer{Exporter: &WriterExporter{Writer: &buffer}, BatchSize: 10, Interval: time.Hour, spans: make(chan *Span, 10), stop: make(chan chan struct{})}
+	tracer.Start()
+	for i := 0; i < 3; i++ {
+		tracer.newSpan("request", spanKindServer, SpanContext{}, false).End()
+	}
+	tracer.Stop()
+	if count := strings.Count(buffer.String(), `"name":"request"`); count != 3 {
+		t.Errorf("Expected 3 exported spans, but got %v", count)
+	}
+	var stopped *Tracer
+	stopped.Stop()
+}
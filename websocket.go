@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+
+	closeGoingAway = 1001
+
+	maxWebSocketFrame = 1 << 20
+)
+
+const websocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketConn is minimal server side WebSocket (RFC 6455) connection. It
+// is enough for pushing messages to clients: client messages are read only
+// to answer pings and to notice closed connection.
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   sync.Mutex
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+	for _, v := range strings.Split(header.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWebSocketRequest(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// allowedOrigin protects from cross-site WebSocket hijacking, browsers send
+// cookies with handshake from any site. Same origin and origins allowed by
+// cors plugin (its headers are already set by hooks) are accepted. Clients
+// that are not browsers don't send Origin.
+func allowedOrigin(r *http.Request, header http.Header) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if originUrl, err := url.Parse(origin); err == nil && strings.EqualFold(originUrl.Host, r.Host) {
+		return true
+	}
+	allowed := header.Get("Access-Control-Allow-Origin")
+	return allowed == "*" || allowed == origin
+}
+
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, errors.New("unsupported websocket request")
+	}
+	if !allowedOrigin(r, w.Header()) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, fmt.Errorf("websocket origin %v is not allowed", r.Header.Get("Origin"))
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, errors.New("websocket is not supported by response writer")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+	for name, values := range w.Header() {
+		for _, value := range values {
+			response += name + ": " + value + "\r\n"
+		}
+	}
+	response += "Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	_, err = conn.Write([]byte(response))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &websocketConn{conn: conn, reader: rw.Reader}, nil
+}
+
+func (self *websocketConn) Close() error {
+	return self.conn.Close()
+}
+
+func (self *websocketConn) WriteMessage(opcode byte, payload []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, err := self.conn.Write(encodeFrame(opcode, payload))
+	return err
+}
+
+func encodeFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+	return append(frame, payload...)
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		_, err = io.ReadFull(r, extended)
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		_, err = io.ReadFull(r, extended)
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > maxWebSocketFrame {
+		return 0, nil, fmt.Errorf("websocket frame is too large: %v", length)
+	}
+	mask := make([]byte, 4)
+	if masked {
+		_, err = io.ReadFull(r, mask)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
+
+func closeMessage(code int) []byte {
+	message := make([]byte, 2)
+	binary.BigEndian.PutUint16(message, uint16(code))
+	return message
+}
+
+// readLoop answers pings and returns when connection is closed.
+func (self *websocketConn) readLoop() {
+	for {
+		opcode, payload, err := readFrame(self.reader)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opPing:
+			self.WriteMessage(opPong, payload)
+		case opClose:
+			self.WriteMessage(opClose, payload)
+			return
+		}
+	}
+}